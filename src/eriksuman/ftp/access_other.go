@@ -0,0 +1,9 @@
+//go:build !unix
+
+package ftp
+
+// checkWritable is not supported on this platform, so any failure is left to
+// the attempt to create the file
+func checkWritable(dir string) error {
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build unix
+
+package ftp
+
+import "syscall"
+
+// value of W_OK for access(2), which the syscall package doesn't export
+const accessWrite = 0x2
+
+// checkWritable returns an error if the process may not create files in dir
+func checkWritable(dir string) error {
+	return syscall.Access(dir, accessWrite)
+}
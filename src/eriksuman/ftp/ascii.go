@@ -0,0 +1,172 @@
+package ftp
+
+import (
+	"bytes"
+	"io"
+	"strings"
+)
+
+// line endings a client may request for ASCII transfers
+const (
+	eolCRLF = "\r\n"
+	eolLF   = "\n"
+	eolCR   = "\r"
+)
+
+// transfer types negotiated with the TYPE command
+const (
+	typeASCII  = "A"
+	typeBinary = "I"
+)
+
+// transfer modes negotiated with the MODE command
+const (
+	modeStream = "S"
+	modeZlib   = "Z"
+)
+
+// file structures negotiated with the STRU command
+const (
+	struFile = "F"
+)
+
+// toASCII converts the line endings in data to eol. LF, CRLF and lone CR line
+// endings are all recognized so that files which already contain CRLF are not
+// converted twice.
+func toASCII(data []byte, eol string) []byte {
+	data = bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1)
+	data = bytes.Replace(data, []byte("\r"), []byte("\n"), -1)
+	if eol == eolLF {
+		return data
+	}
+
+	return bytes.Replace(data, []byte("\n"), []byte(eol), -1)
+}
+
+// parseEOL converts the name of a line ending style to the line ending itself
+func parseEOL(name string) (string, bool) {
+	switch strings.ToUpper(name) {
+	case "CRLF":
+		return eolCRLF, true
+	case "LF":
+		return eolLF, true
+	case "CR":
+		return eolCR, true
+	default:
+		return "", false
+	}
+}
+
+// crlfReader encodes the data read from r for an ASCII transfer, converting LF,
+// CRLF and lone CR line endings to CRLF
+type crlfReader struct {
+	r       io.Reader
+	buf     []byte
+	pending []byte
+	err     error
+	// whether the last byte read was a CR, whose line ending was already sent
+	cr bool
+}
+
+func newCRLFReader(r io.Reader) *crlfReader {
+	return &crlfReader{r: r, buf: make([]byte, 32*1024)}
+}
+
+func (c *crlfReader) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+
+		var n int
+		n, c.err = c.r.Read(c.buf)
+		for _, b := range c.buf[:n] {
+			switch {
+			case b == '\r':
+				c.pending = append(c.pending, '\r', '\n')
+			case b == '\n' && !c.cr:
+				c.pending = append(c.pending, '\r', '\n')
+			case b != '\n':
+				c.pending = append(c.pending, b)
+			}
+			c.cr = b == '\r'
+		}
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// crlfWriter decodes the CRLF line endings of an ASCII transfer to LF as the
+// data is written to w. A CR at the end of one write is held back until the
+// next shows whether it begins a line ending, so Flush must be called once the
+// transfer is complete.
+type crlfWriter struct {
+	w  io.Writer
+	cr bool
+}
+
+func (c *crlfWriter) Write(p []byte) (int, error) {
+	buf := make([]byte, 0, len(p)+1)
+	for _, b := range p {
+		if c.cr && b != '\n' {
+			buf = append(buf, '\r')
+		}
+		c.cr = b == '\r'
+		if !c.cr {
+			buf = append(buf, b)
+		}
+	}
+
+	if _, err := c.w.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes a CR held back at the end of the data
+func (c *crlfWriter) Flush() error {
+	if !c.cr {
+		return nil
+	}
+
+	c.cr = false
+	_, err := c.w.Write([]byte{'\r'})
+	return err
+}
+
+// lfWriter decodes the line endings of an ASCII upload to the local LF as the
+// data is written to w. Unless the session's line ending is LF, each CR becomes
+// LF and an LF straight after a CR is dropped, so both CRLF and a lone CR end a
+// line, even when a CRLF is split between writes.
+type lfWriter struct {
+	w   io.Writer
+	eol string
+	// whether the last byte written was a CR
+	cr bool
+}
+
+func (l *lfWriter) Write(p []byte) (int, error) {
+	if l.eol == eolLF {
+		return l.w.Write(p)
+	}
+
+	buf := make([]byte, 0, len(p))
+	for _, b := range p {
+		switch {
+		case b == '\r':
+			buf = append(buf, '\n')
+		case b == '\n' && l.cr:
+			// the second half of a CRLF
+		default:
+			buf = append(buf, b)
+		}
+		l.cr = b == '\r'
+	}
+
+	if _, err := l.w.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,33 @@
+package ftp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLFWriter(t *testing.T) {
+	for _, tt := range []struct {
+		name, eol string
+		writes    []string
+		want      string
+	}{
+		{"CRLF", eolCRLF, []string{"one\r\ntwo\r\n"}, "one\ntwo\n"},
+		{"lone CR", eolCRLF, []string{"one\rtwo\r\n"}, "one\ntwo\n"},
+		{"CRLF split between writes", eolCRLF, []string{"one\r", "\ntwo\r", "\n"}, "one\ntwo\n"},
+		{"CR at the end", eolCRLF, []string{"one\r"}, "one\n"},
+		{"blank lines", eolCRLF, []string{"\r\n\r\n", "\r", "\r\n"}, "\n\n\n\n"},
+		{"CR", eolCR, []string{"one\rtwo\r", "three"}, "one\ntwo\nthree"},
+		{"LF unchanged", eolLF, []string{"one\r\ntwo\r", "\n"}, "one\r\ntwo\r\n"},
+	} {
+		var buf bytes.Buffer
+		w := &lfWriter{w: &buf, eol: tt.eol}
+		for _, s := range tt.writes {
+			if n, err := w.Write([]byte(s)); err != nil || n != len(s) {
+				t.Fatalf("%s: Write(%q) = %d, %v", tt.name, s, n, err)
+			}
+		}
+		if buf.String() != tt.want {
+			t.Errorf("%s: wrote %q, want %q", tt.name, buf.String(), tt.want)
+		}
+	}
+}
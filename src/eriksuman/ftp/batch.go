@@ -0,0 +1,163 @@
+package ftp
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// batchAnswer is the user's reply to the prompt before each file of a batch
+type batchAnswer int
+
+// enumeration for batchAnswer
+const (
+	batchYes batchAnswer = iota
+	batchNo
+	batchAll
+	batchQuit
+)
+
+// CommandMget downloads every remote file matching the patterns into the local
+// working directory. Patterns may contain shell wildcards in their last element.
+// With prompting on, the user is asked before each file.
+func (c *Client) CommandMget(patterns []string) {
+	prompt := c.prompt && isTerminal()
+	for _, pattern := range patterns {
+		files, err := c.remoteGlob(pattern)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		if len(files) == 0 {
+			fmt.Printf("%s: no matching files\n", pattern)
+			continue
+		}
+
+		for _, file := range files {
+			if prompt {
+				switch c.askBatch("mget", file) {
+				case batchNo:
+					continue
+				case batchAll:
+					prompt = false
+				case batchQuit:
+					return
+				}
+			}
+
+			dest := c.localPath(path.Base(file))
+			if !c.confirmOverwrite(dest, false) {
+				continue
+			}
+			if err := c.retrieve(file, dest); err != nil {
+				fmt.Println(err)
+			}
+		}
+	}
+}
+
+// CommandMput uploads every local file matching the patterns to the remote
+// current directory. With prompting on, the user is asked before each file.
+func (c *Client) CommandMput(patterns []string) {
+	prompt := c.prompt && isTerminal()
+	for _, pattern := range patterns {
+		files, err := filepath.Glob(c.localPath(pattern))
+		if err != nil {
+			fmt.Printf("%s: %v\n", pattern, err)
+			continue
+		}
+		if len(files) == 0 {
+			fmt.Printf("%s: no matching files\n", pattern)
+			continue
+		}
+
+		for _, file := range files {
+			if info, err := os.Stat(file); err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+
+			if prompt {
+				switch c.askBatch("mput", file) {
+				case batchNo:
+					continue
+				case batchAll:
+					prompt = false
+				case batchQuit:
+					return
+				}
+			}
+
+			if err := c.store(file, filepath.Base(file)); err != nil {
+				fmt.Println(err)
+			}
+		}
+	}
+}
+
+// CommandPrompt toggles interactive prompting during mget and mput
+func (c *Client) CommandPrompt() {
+	c.prompt = !c.prompt
+	if c.prompt {
+		fmt.Println("Interactive mode on.")
+	} else {
+		fmt.Println("Interactive mode off.")
+	}
+}
+
+// remoteGlob returns the regular files in the remote directory of pattern whose
+// names match its last element
+func (c *Client) remoteGlob(pattern string) ([]string, error) {
+	dir, name := path.Split(pattern)
+	if _, err := path.Match(name, ""); err != nil {
+		return nil, fmt.Errorf("%s: %v", pattern, err)
+	}
+
+	entries, err := c.CommandListEntries(strings.TrimSuffix(dir, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", pattern, err)
+	}
+
+	var files []string
+	for _, e := range entries {
+		if !e.Mode.IsRegular() {
+			continue
+		}
+		if ok, _ := path.Match(name, e.Name); ok {
+			files = append(files, dir+e.Name)
+		}
+	}
+
+	return files, nil
+}
+
+// askBatch asks the user whether to transfer file as part of the batch command
+// cmd. Unrecognized answers are asked again.
+func (c *Client) askBatch(cmd, file string) batchAnswer {
+	for {
+		fmt.Printf("%s %s? [y/n/a/q] ", cmd, file)
+		answer, err := c.in.ReadString('\n')
+		if err != nil {
+			return batchQuit
+		}
+
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y", "yes", "":
+			return batchYes
+		case "n", "no":
+			return batchNo
+		case "a", "all":
+			return batchAll
+		case "q", "quit":
+			return batchQuit
+		}
+	}
+}
+
+// isTerminal reports whether the user's input comes from a terminal. Prompts
+// are skipped otherwise, so that scripted input isn't taken as an answer.
+func isTerminal() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
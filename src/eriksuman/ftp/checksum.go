@@ -0,0 +1,120 @@
+package ftp
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+)
+
+// errChecksumMismatch is returned when a downloaded file doesn't match the
+// checksum reported by the server
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// hashAlgorithms lists the algorithms the HASH command supports, in the order they
+// are advertised, with their constructors
+var hashAlgorithms = []struct {
+	name    string
+	newHash func() hash.Hash
+}{
+	{"SHA-256", sha256.New},
+	{"SHA-1", sha1.New},
+	{"CRC32", func() hash.Hash { return crc32.NewIEEE() }},
+}
+
+// defaultHashAlgorithm is used by HASH until another is selected with OPTS HASH
+const defaultHashAlgorithm = "SHA-256"
+
+// newHashAlgorithm returns a hash for the named HASH algorithm, or nil if it is not
+// supported
+func newHashAlgorithm(name string) hash.Hash {
+	for _, a := range hashAlgorithms {
+		if strings.EqualFold(a.name, name) {
+			return a.newHash()
+		}
+	}
+	return nil
+}
+
+// hashFeature returns the HASH line advertised in reply to FEAT, with the selected
+// algorithm marked by a '*'
+func hashFeature(selected string) string {
+	names := make([]string, len(hashAlgorithms))
+	for i, a := range hashAlgorithms {
+		names[i] = a.name
+		if a.name == selected {
+			names[i] += "*"
+		}
+	}
+
+	return "HASH " + strings.Join(names, ";")
+}
+
+// fileChecksum streams the named file through h and returns the digest in upper
+// case hexadecimal, as the XCRC and XMD5 commands report it
+func fileChecksum(name string, h hash.Hash) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return strings.ToUpper(hex.EncodeToString(h.Sum(nil))), nil
+}
+
+// remoteChecksum asks the server for the checksum of the remote file, returning
+// the name of the algorithm, the digest and a hash to compare the local file
+// with. HASH is preferred, then XMD5 and XCRC. XMD5 is tried if the server's
+// features are unknown.
+func (c *Client) remoteChecksum(remote string) (string, string, hash.Hash, error) {
+	switch {
+	case c.features.Supports("HASH"):
+		algo, sum, err := c.CommandHASH(remote)
+		if err != nil {
+			return "", "", nil, err
+		}
+		h := newHashAlgorithm(algo)
+		if h == nil {
+			return "", "", nil, fmt.Errorf("unsupported hash algorithm %s", algo)
+		}
+		return algo, sum, h, nil
+	case c.features == nil || c.features.Supports("XMD5"):
+		sum, err := c.CommandXMD5(remote)
+		return string(CommandXMD5), sum, md5.New(), err
+	case c.features.Supports("XCRC"):
+		sum, err := c.CommandXCRC(remote)
+		return string(CommandXCRC), sum, crc32.NewIEEE(), err
+	default:
+		return "", "", nil, errors.New("the server supports none of HASH, XMD5 and XCRC")
+	}
+}
+
+// verifyChecksum compares the checksum of the local file with that the server
+// computes for the remote file, returning errChecksumMismatch if they differ
+func (c *Client) verifyChecksum(remote, local string) error {
+	algo, want, h, err := c.remoteChecksum(remote)
+	if err != nil {
+		return err
+	}
+
+	got, err := fileChecksum(local, h)
+	if err != nil {
+		return err
+	}
+
+	if !strings.EqualFold(want, got) {
+		return fmt.Errorf("%s: %w: remote %s %s, local %s", remote, errChecksumMismatch, algo, want, got)
+	}
+	return nil
+}
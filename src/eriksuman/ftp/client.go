@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
 // Client is an FTP client
@@ -14,129 +16,462 @@ type Client struct {
 	remoteAddr, localAddr string
 	// control connection
 	control *controlConn
+	// opens connections to the server, through a proxy when proxied is set
+	dialer  dialer
+	proxied bool
 	// data connection type (active/passive)
 	dataConnType dataConnType
 	// use extended or legacy pasv/port commands
 	extended bool
+	// use the RFC 1639 LPSV and LPRT commands, for IPv6 servers without EPSV
+	longAddr bool
+	// representation type used for transfers (ascii/binary)
+	transferType transferType
+	// transfers are compressed with MODE Z
+	compressed bool
+	// local working directory used for transfers
+	localDir string
+	// timeout for establishing connections
+	timeout time.Duration
+	// time allowed for an established data connection to make progress
+	dataIdleTimeout time.Duration
+	// credentials supplied up front, skipping the login prompts
+	user, password, account string
+	// suppress transfer progress output
+	quiet bool
+	// replace existing local files on download without asking
+	overwrite bool
+	// ask before each file transferred by mget and mput
+	prompt bool
+	// keep the modification times of files when they are transferred
+	preserveTimes bool
+	// compare the checksums of downloaded files with the server's
+	verify bool
+	// input from the user, shared by the prompts and the command loop
+	in *bufio.Reader
+	// reads command lines from in, with editing and history on a terminal
+	lines *lineEditor
+	// capabilities advertised by the server, nil until FEAT has been issued
+	features *Features
+	// number of connections large downloads are split across
+	segments int
+	// continue broken downloads from where they stopped, up to resumeRetries
+	// times
+	resumeOnError bool
+	resumeRetries int
+	// used to open the extra connections for segmented downloads
+	params sessionParams
+	login  credentials
+}
+
+// ClientOptions configures a client started with StartClient or Dial
+type ClientOptions struct {
+	// Passive selects passive data connections instead of active ones
+	Passive bool
+	// Extended prefers the EPSV/EPRT commands over PASV/PORT
+	Extended bool
+	// User and Password are used to log in instead of prompting when set
+	User, Password string
+	// Timeout is the time allowed for establishing connections. If zero, a
+	// default of 5 seconds is used.
+	Timeout time.Duration
+	// DataIdleTimeout is the time allowed for an established data connection
+	// to go without receiving data. If zero, a default of 10 seconds is used.
+	DataIdleTimeout time.Duration
+	// Quiet suppresses the progress of transfers
+	Quiet bool
+	// LogFormat is the format of the log file, "text" or "json". If empty,
+	// text is used.
+	LogFormat string
+	// Retries is the number of times a failed connection to the server is
+	// retried before giving up
+	Retries int
+	// RetryBackoff is the delay before the first retry, doubling after each
+	// one. If zero, a default of 1 second is used.
+	RetryBackoff time.Duration
+	// Overwrite replaces existing local files on download. Otherwise the user
+	// is asked first, or the file is skipped if the input is not a terminal.
+	Overwrite bool
+	// PreserveTimes sets the modification time of downloaded files to that of
+	// the remote file, and of uploaded files to that of the local file, when
+	// the server supports MDTM and MFMT
+	PreserveTimes bool
+	// Verify compares the checksum of each binary download with the one the
+	// server reports for the remote file, using HASH, XMD5 or XCRC
+	Verify bool
+	// KeepAlive is the interval between TCP keepalive probes on the control
+	// connection, keeping idle sessions alive through NAT devices and
+	// firewalls. If zero, a default of 15 seconds is used, and a negative
+	// value disables them.
+	KeepAlive time.Duration
+	// Proxy is the URL of a proxy all connections to the server are made
+	// through, either a SOCKS5 proxy as socks5://[user:password@]host[:port],
+	// or an HTTP proxy which tunnels with CONNECT as
+	// http://[user:password@]host[:port]. Active data connections can't be
+	// made through a proxy, so passive mode is used.
+	Proxy string
+	// ResumeOnError continues a binary download which fails part way through
+	// from where it stopped, reconnecting to the server if the control
+	// connection was lost
+	ResumeOnError bool
+	// ResumeRetries is the number of times a broken download is resumed. If
+	// zero, a default of 3 is used.
+	ResumeRetries int
+	// Segments is the number of connections a large binary download is split
+	// across, each fetching its own part of the file. The server must support
+	// REST and SIZE. If zero or one, files are downloaded over a single
+	// connection.
+	Segments int
+}
+
+// transferType represents the representation type negotiated with the TYPE command
+type transferType int
+
+// enumeration for transferType
+const (
+	transferTypeASCII transferType = iota
+	transferTypeBinary
+)
+
+// String returns the name of the transfer type as displayed to the user
+func (t transferType) String() string {
+	switch t {
+	case transferTypeASCII:
+		return "ascii"
+	case transferTypeBinary:
+		return "binary"
+	default:
+		return "unknown"
+	}
 }
 
 // StartClient bootstraps the ftp client, opening the log file and attempting to connect to host:port.
 // The return code from the server is verified and the user is then prompted to sign in and taken
-// into the command loop.
-func StartClient(host, port, log string) error {
-	// open control connection
-	cont, rply, localAddr, remoteAddr, err := newControlConn(host, port, log)
+// into the command loop. If opts is nil, the default options are used.
+func StartClient(host, port, log string, opts *ClientOptions) error {
+	c, err := Dial(host, port, log, opts)
 	if err != nil {
 		return err
 	}
-	defer cont.Close()
+	defer c.control.Close()
+
+	// enter command loop
+	c.commandLoop()
+
+	return nil
+}
+
+// Dial connects to the server at host:port, logging the control connection to
+// log, and logs in, prompting for any credentials not given in opts. Failed
+// connection attempts are retried as set by opts.Retries and opts.RetryBackoff.
+// The returned client is ready for commands, and should be closed with Close. If
+// opts is nil, the default options are used.
+func Dial(host, port, log string, opts *ClientOptions) (*Client, error) {
+	if opts == nil {
+		opts = new(ClientOptions)
+	}
+
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = connTimeout
+	}
+
+	dataIdleTimeout := opts.DataIdleTimeout
+	if dataIdleTimeout == 0 {
+		dataIdleTimeout = dataReadTimeout
+	}
+
+	format := formatText
+	if opts.LogFormat != "" {
+		f, err := parseLogFormat(opts.LogFormat)
+		if err != nil {
+			return nil, err
+		}
+		format = f
+	}
+
+	retry := retryPolicy{retries: opts.Retries, backoff: opts.RetryBackoff}
+	if retry.backoff == 0 {
+		retry.backoff = defaultRetryBackoff
+	}
+
+	resumeRetries := opts.ResumeRetries
+	if resumeRetries == 0 {
+		resumeRetries = defaultResumeRetries
+	}
+
+	keepAlive := opts.KeepAlive
+	if keepAlive == 0 {
+		keepAlive = defaultKeepAlive
+	}
+
+	d, err := newDialer(opts.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	// get local working directory
+	dir, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+
+	// open control connection
+	cont, rply, localAddr, remoteAddr, err := newControlConn(d, host, port, log, timeout, format, retry, keepAlive)
+	if err != nil {
+		if cont != nil {
+			cont.Close()
+		}
+		return nil, err
+	}
 
 	c := &Client{
-		control:    cont,
-		localAddr:  localAddr,
-		remoteAddr: remoteAddr,
-		extended:   false,
+		control:         cont,
+		localAddr:       localAddr,
+		remoteAddr:      remoteAddr,
+		extended:        opts.Extended,
+		localDir:        dir,
+		timeout:         timeout,
+		user:            opts.User,
+		dataIdleTimeout: dataIdleTimeout,
+		quiet:           opts.Quiet,
+		password:        opts.Password,
+		overwrite:       opts.Overwrite,
+		prompt:          true,
+		preserveTimes:   opts.PreserveTimes,
+		verify:          opts.Verify,
+		in:              bufio.NewReader(os.Stdin),
+		dialer:          d,
+		proxied:         opts.Proxy != "",
+		segments:        opts.Segments,
+		resumeOnError:   opts.ResumeOnError,
+		resumeRetries:   resumeRetries,
+		params: sessionParams{
+			host:      host,
+			port:      port,
+			logFile:   log,
+			format:    format,
+			retry:     retry,
+			keepAlive: keepAlive,
+		},
+	}
+	c.lines = newLineEditor(c.in, os.Stdout)
+
+	if opts.Passive {
+		c.dataConnType = dataConnTypePassive
+	}
+
+	// the server can't connect back to us through a proxy
+	if c.proxied {
+		if !opts.Passive {
+			fmt.Println("Warning: active data connections can't be made through a proxy, using passive mode.")
+		}
+		c.dataConnType = dataConnTypePassive
+	}
+
+	// fall back on credentials from the user's .netrc file
+	if c.user == "" {
+		c.loadNetrc(host)
 	}
 
 	// check initial reply code
 	fmt.Println(rply)
+	if err := c.checkGreeting(rply); err != nil {
+		cont.Close()
+		return nil, err
+	}
+
+	// identify the client, servers which don't support it just refuse
+	if err := c.CommandCLNT(); err != nil {
+		cont.Close()
+		return nil, err
+	}
+
+	// attempt to log in user
+	if err := c.logIn(); err != nil {
+		cont.Close()
+		return nil, err
+	}
+
+	// transfer files unchanged unless ascii is asked for, whatever type the
+	// server starts sessions with
+	if err := c.CommandTYPE(transferTypeBinary); err != nil {
+		fmt.Println(err)
+	}
+
+	// find out what the server supports
+	if _, err := c.CommandFEAT(); err != nil {
+		fmt.Println(err)
+	} else {
+		c.adaptToFeatures()
+	}
+
+	// ask for UTF-8 paths where the server supports them
+	if c.Supports("UTF8") {
+		if err := c.CommandOPTS("UTF8 ON"); err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	return c, nil
+}
+
+// checkGreeting checks the server's first reply, waiting for it to become ready
+// if it asks the client to
+func (c *Client) checkGreeting(rply *Reply) error {
 	switch rply.StatusCode {
-	case "220":
+	case StatusReady:
 		//server ready
-	case "120":
+	case StatusReadyMinute:
 		//server not ready, wait for 220
-		rply, err = cont.readReply()
+		rply, err := c.control.readReply()
 		if err != nil {
 			return err
 		}
 
-		if rply.StatusCode != "220" {
-			fmt.Printf("Connection failed: %v\n", rply)
-			return nil
+		if rply.StatusCode != StatusReady {
+			return fmt.Errorf("connection failed: %w", newReplyError(rply))
 		}
-	case "421":
+	case StatusNotAvailable:
 		// negative reply, abort
-		return nil
+		return fmt.Errorf("connection refused: %w", newReplyError(rply))
 	default:
-		c.closeAndExit("Unrecognized reply, exiting")
+		return fmt.Errorf("unrecognized reply: %w", newReplyError(rply))
 	}
 
-	// attempt to log in user
-	if err := c.logIn(); err != nil {
-		return err
+	return nil
+}
+
+// Close logs out and closes the connection to the server
+func (c *Client) Close() error {
+	c.control.getReplyForCommand(newCommand(CommandQUIT, ""))
+	return c.control.Close()
+}
+
+// loadNetrc fills in the client's credentials from the user's .netrc file if it
+// has an entry for host. A missing file is not an error.
+func (c *Client) loadNetrc(host string) {
+	p, err := netrcPath()
+	if err != nil {
+		return
 	}
 
-	// enter command loop
-	c.commandLoop()
+	entry, ok, err := lookupNetrc(p, host)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Printf("Failed to read %s: %v\n", p, err)
+		}
+		return
+	}
 
-	return nil
+	if ok && entry.login != "" {
+		c.user = entry.login
+		c.password = entry.password
+		c.account = entry.account
+	}
 }
 
 // logIn displays the necessary prompts and issues the commands to sign a user in.
+// A refused login is returned as an error.
 func (c *Client) logIn() error {
-	// ask user for a username
-	fmt.Print("Username: ")
-	in := bufio.NewReader(os.Stdin)
-	str, err := in.ReadString('\n')
-	if err != nil {
-		return err
+	in := c.in
+
+	// ask user for a username if one was not supplied
+	username := c.user
+	if username == "" {
+		fmt.Print("Username: ")
+		str, err := in.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		username = str[:len(str)-1]
 	}
 
 	// issue USER command to server
-	rply, err := c.control.getReplyForCommand(newCommand(CommandUSER, str[:len(str)-1]))
+	rply, err := c.control.getReplyForCommand(newCommand(CommandUSER, username))
 	if err != nil {
 		return err
 	}
+	c.login = credentials{user: username}
 
 	// check status code
 	fmt.Println(rply)
 	switch rply.StatusCode {
-	case "230":
+	case StatusLoggedIn:
 		// user already logged in
 		return nil
-	case "500", "501", "421":
-		// an error has occurred, exit
-		c.control.Close()
-		os.Exit(1)
-	case "331":
+	case StatusUserOK:
 		// need password, continue
-	case "332":
-		// ACCT not supported, abort
-		fmt.Println("Log in with accounts is not supported. Exiting.")
-		os.Exit(1)
+	case StatusLoginNeedAccount:
+		// need account before logging in
+		return c.sendAccount(in)
 	default:
-		c.closeAndExit("Unrecognized response, exiting")
+		// an error has occurred
+		return fmt.Errorf("login failed: %w", newReplyError(rply))
 	}
 
-	// ask user for password
-	fmt.Printf("Password: ")
-	str, err = in.ReadString('\n')
+	// ask user for password if one was not supplied
+	password := c.password
+	if password == "" {
+		fmt.Printf("Password: ")
+		str, err := in.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		password = str[:len(str)-1]
+	}
+
+	// issue PASS command to server
+	rply, err = c.control.getReplyForCommand(newCommand(CommandPASS, password))
 	if err != nil {
 		return err
 	}
+	c.login.password = password
 
-	// issue PASS command to server
-	rply, err = c.control.getReplyForCommand(newCommand(CommandPASS, str[:len(str)-1]))
+	// check status code
+	fmt.Println(rply)
+	switch rply.StatusCode {
+	case StatusLoggedIn, StatusCommandNotImplemented:
+		// logged in, continue
+	case StatusLoginNeedAccount:
+		// need account to complete login
+		return c.sendAccount(in)
+	default:
+		// incorrect username/password, or an error has occurred
+		return fmt.Errorf("login failed: %w", newReplyError(rply))
+	}
+
+	return nil
+}
+
+// sendAccount prompts for an account if one was not supplied and issues the ACCT
+// command to complete login
+func (c *Client) sendAccount(in *bufio.Reader) error {
+	account := c.account
+	if account == "" {
+		fmt.Print("Account: ")
+		str, err := in.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		account = str[:len(str)-1]
+	}
+
+	// issue ACCT command to server
+	rply, err := c.control.getReplyForCommand(newCommand(CommandACCT, account))
 	if err != nil {
 		return err
 	}
+	c.login.account = account
 
 	// check status code
 	fmt.Println(rply)
 	switch rply.StatusCode {
-	case "230", "202":
+	case StatusLoggedIn, StatusCommandNotImplemented:
 		// logged in, continue
-	case "530":
-		// incorrect username/password
-		c.closeAndExit("Login failed. Exiting.")
-	case "500", "503", "421", "332":
-		// an error has occurred, exit
-		c.closeAndExit("Exiting")
-	case "501":
-		// bad parameters
-		c.closeAndExit("Error in parameters. Exiting.")
 	default:
-		c.closeAndExit("Unrecognized response, exiting")
+		// incorrect account, or an error has occurred
+		return fmt.Errorf("login failed: %w", newReplyError(rply))
 	}
 
 	return nil
@@ -144,24 +479,23 @@ func (c *Client) logIn() error {
 
 // commandLoop displays a command prompt, reads, and executes commands from the user
 func (c *Client) commandLoop() {
-	in := bufio.NewReader(os.Stdin)
 	for {
-		fmt.Print("ftp> ")
-		cmd, err := in.ReadString('\n')
+		cmd, err := c.lines.readLine("ftp> ")
 		if err != nil {
 			fmt.Printf("ftp: %s", err)
 			os.Exit(1)
 		}
 
-		// remove newline, execute input command
-		c.executeCommand(cmd[:len(cmd)-1])
+		c.executeCommand(cmd)
 	}
 }
 
 // executeCommand attempts to parse command and execute its corresponding method
 func (c *Client) executeCommand(command string) {
-	// split string, switch on first token
-	cmd := strings.Split(strings.ToLower(command), " ")
+	// split string, switch on first token. Only the command is case
+	// insensitive, arguments are often file names and are kept as typed.
+	cmd := strings.Split(command, " ")
+	cmd[0] = strings.ToLower(cmd[0])
 	switch cmd[0] {
 	// change directory
 	case "cd":
@@ -183,7 +517,11 @@ func (c *Client) executeCommand(command string) {
 			fmt.Println("Usage: pwd")
 			return
 		}
-		c.CommandPWD()
+		if _, err := c.CommandPWD(); err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println(c.LastReply())
 	// current directory listing
 	case "ls":
 		if len(cmd) > 2 {
@@ -191,52 +529,283 @@ func (c *Client) executeCommand(command string) {
 			return
 		}
 		c.CommandLS("")
-	// download a file from server
+	// download a file or directory tree from server
 	case "get":
+		args := cmd[1:]
+		recursive, force, dryRun := false, false, false
+		for len(args) > 0 && (args[0] == "-r" || args[0] == "-f" || args[0] == "-n") {
+			recursive = recursive || args[0] == "-r"
+			force = force || args[0] == "-f"
+			dryRun = dryRun || args[0] == "-n"
+			args = args[1:]
+		}
+		switch {
+		case recursive && len(args) == 1:
+			c.CommandGetRecursive(args[0], force, dryRun)
+		case !recursive && !dryRun && len(args) == 1:
+			c.CommandGet(args[0], "", force)
+		case !recursive && !dryRun && len(args) == 2:
+			c.CommandGet(args[0], args[1], force)
+		default:
+			fmt.Println("Usage: get [-r [-n]] [-f] <filename> [local path]")
+		}
+	// upload a file or directory tree
+	case "put":
+		args := cmd[1:]
+		recursive, dryRun := false, false
+		for len(args) > 0 && (args[0] == "-r" || args[0] == "-n") {
+			recursive = recursive || args[0] == "-r"
+			dryRun = dryRun || args[0] == "-n"
+			args = args[1:]
+		}
+		switch {
+		case recursive && len(args) == 1:
+			c.CommandPutRecursive(args[0], dryRun)
+		case !recursive && !dryRun && len(args) == 1:
+			c.CommandPut(args[0])
+		default:
+			fmt.Println("Usage: put [-r [-n]] <filename>")
+		}
+	// download or upload files matching patterns
+	case "mget":
+		if len(cmd) < 2 {
+			fmt.Println("Usage: mget <pattern> [pattern ...]")
+			return
+		}
+		c.CommandMget(cmd[1:])
+	case "mput":
+		if len(cmd) < 2 {
+			fmt.Println("Usage: mput <pattern> [pattern ...]")
+			return
+		}
+		c.CommandMput(cmd[1:])
+	// reset the session and log in again
+	case "reinit":
+		if len(cmd) != 1 {
+			fmt.Println("Usage: reinit")
+			return
+		}
+		c.CommandReinit()
+	// toggle echoing the protocol traffic
+	case "debug":
+		if len(cmd) != 1 {
+			fmt.Println("Usage: debug")
+			return
+		}
+		c.CommandDebug()
+	// toggle prompting during mget and mput
+	case "prompt":
+		if len(cmd) != 1 {
+			fmt.Println("Usage: prompt")
+			return
+		}
+		c.CommandPrompt()
+	// append a local file to a remote file
+	case "append":
+		switch len(cmd) {
+		case 2:
+			c.CommandAppend(cmd[1], filepath.Base(cmd[1]))
+		case 3:
+			c.CommandAppend(cmd[1], cmd[2])
+		default:
+			fmt.Println("Usage: append <local file> [remote file]")
+		}
+	// total size of a remote directory tree
+	case "du":
+		switch {
+		case len(cmd) == 1:
+			c.CommandDU("", false)
+		case len(cmd) == 2 && cmd[1] == "-d":
+			c.CommandDU("", true)
+		case len(cmd) == 2:
+			c.CommandDU(cmd[1], false)
+		case len(cmd) == 3 && cmd[1] == "-d":
+			c.CommandDU(cmd[2], true)
+		default:
+			fmt.Println("Usage: du [-d] [directory]")
+		}
+	// create a remote directory
+	case "mkdir":
+		if len(cmd) != 2 {
+			fmt.Println("Usage: mkdir <directory>")
+			return
+		}
+		c.CommandMkdir(cmd[1])
+	// size of one or more remote files
+	case "size":
+		if len(cmd) < 2 {
+			fmt.Println("Usage: size <filename> [filename ...]")
+			return
+		}
+		sizes, err := c.CommandSizes(cmd[1:])
+		if err != nil {
+			fmt.Printf("An unexpected error occurred: %v\n", err)
+			return
+		}
+		for _, file := range cmd[1:] {
+			if size, ok := sizes[file]; ok {
+				fmt.Printf("%s: %d bytes\n", file, size)
+			}
+		}
+	// modification time of a remote file
+	case "modtime":
 		if len(cmd) != 2 {
-			fmt.Println("Usage: get <filename>")
+			fmt.Println("Usage: modtime <filename>")
+			return
+		}
+		t, err := c.CommandMDTM(cmd[1])
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Printf("%s: %s\n", cmd[1], t.Local().Format(time.RFC1123))
+	// checksum of a remote file
+	case "hash":
+		if len(cmd) != 2 {
+			fmt.Println("Usage: hash <filename>")
+			return
+		}
+		algo, sum, err := c.CommandHASH(cmd[1])
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Printf("%s: %s %s\n", cmd[1], algo, sum)
+	// compare a local file with a remote one by checksum
+	case "verify":
+		if len(cmd) < 2 || len(cmd) > 3 {
+			fmt.Println("Usage: verify <remote file> [local file]")
+			return
+		}
+		local := c.getDest(cmd[1], "")
+		if len(cmd) == 3 {
+			local = c.localPath(cmd[2])
+		}
+		if err := c.verifyChecksum(cmd[1], local); err != nil {
+			fmt.Println(err)
 			return
 		}
-		c.CommandGet(cmd[1])
+		fmt.Println("Checksum verified.")
+	// available space on the server
+	case "avbl":
+		if len(cmd) > 2 {
+			fmt.Println("Usage: avbl [path]")
+			return
+		}
+		dir := ""
+		if len(cmd) == 2 {
+			dir = cmd[1]
+		}
+		c.CommandAVBL(dir)
+	// change local directory
+	case "lcd":
+		if len(cmd) > 2 {
+			fmt.Println("Usage: lcd [path]")
+			return
+		}
+		dir := ""
+		if len(cmd) == 2 {
+			dir = cmd[1]
+		}
+		c.CommandLCD(dir)
+	// print local working directory
+	case "lpwd":
+		if len(cmd) != 1 {
+			fmt.Println("Usage: lpwd")
+			return
+		}
+		c.CommandLPWD()
+	// local directory listing
+	case "lls":
+		if len(cmd) > 2 {
+			fmt.Println("Usage: lls [path]")
+			return
+		}
+		dir := ""
+		if len(cmd) == 2 {
+			dir = cmd[1]
+		}
+		c.CommandLLS(dir)
 	// use passive data connections
 	case "pasv", "passive":
 		if len(cmd) != 1 {
 			fmt.Println("Usage: passive")
 			return
 		}
-		fmt.Println("Switching to passive mode...")
-		c.dataConnType = dataConnTypePassive
+		c.setMode(cmd[0])
+	// detect whether passive or active data connections work
+	case "auto":
+		if len(cmd) != 1 {
+			fmt.Println("Usage: auto")
+			return
+		}
+		c.setMode(cmd[0])
 	// use active data connections
 	case "active":
 		if len(cmd) != 1 {
 			fmt.Println("Usage: active")
 			return
 		}
-		fmt.Println("Switching to active mode...")
-		c.dataConnType = dataConnTypeActive
+		c.setMode(cmd[0])
 	// turn on and off extended pasv/port commands
 	case "ext", "extended":
-		if len(cmd) != 2 {
+		setting := ""
+		if len(cmd) == 2 {
+			setting = strings.ToLower(cmd[1])
+		}
+		if setting != "on" && setting != "off" {
 			fmt.Println("Usage: extended <on|off>")
 			return
 		}
-		switch cmd[1] {
-		case "on":
-			fmt.Println("Extended configuration commands will be preferred.")
-			c.extended = true
-		case "off":
-			fmt.Println("Legacy configuration commands will be preferred.")
-			c.extended = false
-		default:
-			fmt.Println("Usage: extended <on|off>")
+		c.setMode(cmd[0] + "-" + setting)
+	// use binary (image) transfers
+	case "binary", "bin", "image":
+		if len(cmd) != 1 {
+			fmt.Println("Usage: binary")
+			return
+		}
+		c.setMode("binary")
+	// use ascii transfers
+	case "ascii":
+		if len(cmd) != 1 {
+			fmt.Println("Usage: ascii")
+			return
 		}
+		c.setMode("ascii")
+	// display or change the combined transfer configuration
+	case "mode":
+		// check every setting before applying any, so a bad one changes nothing
+		for _, m := range cmd[1:] {
+			if !modeSettings[strings.ToLower(m)] {
+				fmt.Println("Usage: mode [active|passive|auto] [extended|legacy] [ascii|binary] [stream|compressed]")
+				return
+			}
+		}
+		for _, m := range cmd[1:] {
+			c.setMode(strings.ToLower(m))
+		}
+		fmt.Println(c.modeString())
 	// display help message from server
 	case "help":
-		if len(cmd) != 1 {
-			fmt.Println("Usage: help")
+		switch len(cmd) {
+		case 1:
+			c.CommandHELP("")
+		case 2:
+			c.CommandHELP(strings.ToUpper(cmd[1]))
+		default:
+			fmt.Println("Usage: help [command]")
+		}
+	// display the client's commands or the usage of one
+	case "?":
+		if len(cmd) > 2 {
+			fmt.Println("Usage: ? [command]")
 			return
 		}
-		c.CommandHELP()
+		if len(cmd) == 2 {
+			printLocalHelp(cmd[1])
+			return
+		}
+		printLocalHelp("")
 	// exit client
 	case "exit", "quit":
 		if len(cmd) != 1 {
@@ -249,24 +818,136 @@ func (c *Client) executeCommand(command string) {
 	}
 }
 
+// modeSettings lists the transfer settings setMode recognizes
+var modeSettings = map[string]bool{
+	"pasv": true, "passive": true, "active": true, "auto": true,
+	"ext": true, "extended": true, "ext-on": true, "extended-on": true,
+	"legacy": true, "ext-off": true, "extended-off": true,
+	"binary": true, "bin": true, "image": true, "ascii": true,
+	"compressed": true, "zlib": true, "stream": true,
+}
+
+// setMode applies a single transfer setting by name, printing what was changed. It
+// returns false if the setting is not recognized.
+func (c *Client) setMode(m string) bool {
+	switch m {
+	case "pasv", "passive":
+		fmt.Println("Switching to passive mode...")
+		c.dataConnType = dataConnTypePassive
+	case "active", "auto":
+		if c.proxied {
+			fmt.Println("Active data connections can't be made through a proxy, staying in passive mode.")
+			break
+		}
+		if m == "active" {
+			fmt.Println("Switching to active mode...")
+			c.dataConnType = dataConnTypeActive
+			break
+		}
+		fmt.Println("Data connection mode will be detected on the next transfer...")
+		c.dataConnType = dataConnTypeAuto
+	case "ext", "extended", "ext-on", "extended-on":
+		fmt.Println("Extended configuration commands will be preferred.")
+		c.extended = true
+	case "legacy", "ext-off", "extended-off":
+		fmt.Println("Legacy configuration commands will be preferred.")
+		c.extended = false
+	case "binary", "bin", "image":
+		if err := c.CommandTYPE(transferTypeBinary); err != nil {
+			fmt.Printf("Failed to switch to binary mode: %v\n", err)
+		}
+	case "ascii":
+		if err := c.CommandTYPE(transferTypeASCII); err != nil {
+			fmt.Printf("Failed to switch to ascii mode: %v\n", err)
+		}
+	case "compressed", "zlib":
+		if err := c.CommandMODE(true); err != nil {
+			fmt.Printf("Failed to switch to compressed mode: %v\n", err)
+		}
+	case "stream":
+		if err := c.CommandMODE(false); err != nil {
+			fmt.Printf("Failed to switch to stream mode: %v\n", err)
+		}
+	default:
+		return false
+	}
+
+	return true
+}
+
+// modeString describes the current data connection and transfer type configuration
+func (c *Client) modeString() string {
+	conn := "active"
+	switch c.dataConnType {
+	case dataConnTypePassive:
+		conn = "passive"
+	case dataConnTypeAuto:
+		conn = "auto"
+	}
+
+	ext := "legacy"
+	if c.extended {
+		ext = "extended"
+	}
+
+	mode := "stream"
+	if c.compressed {
+		mode = "compressed"
+	}
+
+	return fmt.Sprintf("Mode: %s, %s, %s, %s", conn, ext, c.transferType, mode)
+}
+
 // openDataConn opens a data connection using the set connection type
-// and returns a dataConn interface type
+// and returns a dataConn interface type, compressing transfers in MODE Z
 func (c *Client) openDataConn() (clientDataConn, error) {
+	conn, err := c.openRawDataConn()
+	if err != nil || !c.compressed {
+		return conn, err
+	}
+
+	return clientZlibDataConn{conn}, nil
+}
+
+// openRawDataConn opens a data connection using the set connection type
+func (c *Client) openRawDataConn() (clientDataConn, error) {
 	switch c.dataConnType {
 	case dataConnTypeActive:
 		return c.initActiveDataConn()
 	case dataConnTypePassive:
 		return c.initPassiveDataConn()
+	case dataConnTypeAuto:
+		return c.initAutoDataConn()
 	default:
 		return nil, fmt.Errorf("unknown dataConnType: %d", c.dataConnType)
 	}
 }
 
+// initAutoDataConn tries a passive data connection, which works through most NATs,
+// and falls back to an active one if it cannot be established. Whichever works is
+// used for the rest of the session.
+func (c *Client) initAutoDataConn() (clientDataConn, error) {
+	conn, err := c.initPassiveDataConn()
+	if err == nil {
+		c.dataConnType = dataConnTypePassive
+		return conn, nil
+	}
+
+	fmt.Printf("Passive data connection failed (%v), trying active mode...\n", err)
+	active, err := c.initActiveDataConn()
+	if err != nil {
+		return nil, err
+	}
+
+	c.dataConnType = dataConnTypeActive
+	return active, nil
+}
+
 // initActiveDataConn opens an active data connection listener and issues
 // the required port command
 func (c *Client) initActiveDataConn() (*activeDataConn, error) {
 	// open data connection
-	conn, addr, err := newActiveDataConn()
+	conn, addr, err := newActiveDataConn(c.timeout, c.dataIdleTimeout)
 	if err != nil {
 		return nil, err
 	}
@@ -300,6 +981,10 @@ func (c *Client) issuePortCommand(host, port string) error {
 		return fmt.Errorf("unable to parse IP address: %v", host)
 	}
 
+	if c.longAddr {
+		return c.CommandLPRT(host, port)
+	}
+
 	// check v4/v6
 	if ip.To4() != nil {
 		if !c.extended {
@@ -314,7 +999,13 @@ func (c *Client) issuePortCommand(host, port string) error {
 func (c *Client) initPassiveDataConn() (*passiveDataConn, error) {
 	var addr string
 
-	if c.extended {
+	if c.longAddr {
+		var err error
+		addr, err = c.CommandLPSV()
+		if err != nil {
+			return nil, err
+		}
+	} else if c.extended {
 		msg, err := c.CommandEPSV()
 		if err != nil {
 			return nil, err
@@ -341,12 +1032,54 @@ func (c *Client) initPassiveDataConn() (*passiveDataConn, error) {
 		}
 
 		// parse pasv string
-		addr, err = hostPortToAddr(msg)
+		addr, err = parsePASVString(msg)
 		if err != nil {
 			return nil, err
 		}
 	}
-	return newPassiveDataConn(addr)
+	return newPassiveDataConn(c.dialer, addr, c.timeout, c.dataIdleTimeout)
+}
+
+// Features returns the capabilities advertised by the server
+func (c *Client) Features() *Features {
+	return c.features
+}
+
+// LastReply returns the most recent reply received from the server, or nil if
+// none has been received
+func (c *Client) LastReply() *Reply {
+	return c.control.lastReply
+}
+
+// Supports reports whether the server advertised the named feature
+func (c *Client) Supports(feature string) bool {
+	return c.features.Supports(feature)
+}
+
+// adaptToFeatures adjusts the client's settings to the features advertised by
+// the server. A server which doesn't advertise EPSV is assumed to support only
+// PASV and PORT, so the extended commands are not attempted over IPv4. PASV and
+// PORT can't carry IPv6 addresses, so over IPv6 LPSV and LPRT are used instead.
+func (c *Client) adaptToFeatures() {
+	if c.Supports("EPSV") {
+		return
+	}
+
+	host, _, err := net.SplitHostPort(c.remoteAddr)
+	if err != nil {
+		return
+	}
+
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		fmt.Println("The server does not advertise EPSV, LPSV and LPRT will be used over IPv6.")
+		c.longAddr = true
+		return
+	}
+
+	if c.extended {
+		fmt.Println("The server does not advertise EPSV, legacy configuration commands will be used.")
+	}
+	c.extended = false
 }
 
 // closeAndExit closes the connection to the server and exits
@@ -1,101 +1,261 @@
 package ftp
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net"
-	"os"
 	"time"
 )
 
-// timeout for data reads
+// default time allowed for a data connection to make progress
 const dataReadTimeout = 10 * time.Second
 
 // clientDataConn is an interface for a data connection
 type clientDataConn interface {
 	read() ([]byte, error)
+	readTo(w io.Writer) (int64, error)
+	writeFrom(r io.Reader) (int64, error)
+	close() error
 }
 
-// dataConnType represents a data connection type (active or passive)
+// dataConnType represents a data connection type (active, passive, or auto).
+// Auto tries passive first and falls back to active if it fails.
 type dataConnType int
 
 // enumeration for dataConnType
 const (
 	dataConnTypeActive dataConnType = iota
 	dataConnTypePassive
+	dataConnTypeAuto
 	dataConnTypeInvalid
 )
 
 // activeDataConn listens on the specified port and waits for the FTP server to
 // initiate a data connection
 type activeDataConn struct {
-	dataChan chan []byte
+	ln       net.Listener
+	connChan chan net.Conn
+	errChan  chan error
+	// time allowed for the server to connect, and to make progress once connected
+	connectTimeout, idleTimeout time.Duration
 }
 
 // newActiveDataConn initializes an active data connection by opening a listener on a
 // random port and returning it and its address
-func newActiveDataConn() (*activeDataConn, string, error) {
-	dc := new(activeDataConn)
+func newActiveDataConn(connectTimeout, idleTimeout time.Duration) (*activeDataConn, string, error) {
+	dc := &activeDataConn{
+		connectTimeout: connectTimeout,
+		idleTimeout:    idleTimeout,
+	}
 	ln, err := net.Listen("tcp", ":0")
 	if err != nil {
 		return nil, "", err
 	}
 
-	dataChan := make(chan []byte, 5)
-	dc.dataChan = dataChan
-	go dc.waitForConn(ln)
+	dc.ln = ln
+	dc.connChan = make(chan net.Conn, 1)
+	dc.errChan = make(chan error, 1)
+	go dc.waitForConn()
 	return dc, ln.Addr().String(), nil
 }
 
 // read reads a raw message from the active data connection
 func (d *activeDataConn) read() ([]byte, error) {
-	t := time.After(dataReadTimeout)
+	var buf bytes.Buffer
+	if _, err := d.readTo(&buf); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// conn waits for the server to connect within the connect timeout
+func (d *activeDataConn) conn() (net.Conn, error) {
+	if tl, ok := d.ln.(*net.TCPListener); ok {
+		tl.SetDeadline(time.Now().Add(d.connectTimeout))
+	}
+
 	select {
-	case msg := <-d.dataChan:
-		return msg, nil
-	case <-t:
-		return nil, fmt.Errorf("Error: read timeout exceeeded")
+	case conn := <-d.connChan:
+		return conn, nil
+	case err := <-d.errChan:
+		return nil, err
 	}
 }
 
-// waitForConn concurrently waits for the server to connect and send data.
-// the data is then passed to read via d's data channel
-func (d *activeDataConn) waitForConn(ln net.Listener) {
-	conn, err := ln.Accept()
+// readTo copies the data sent over the active data connection to w. The server
+// must connect within the connect timeout.
+func (d *activeDataConn) readTo(w io.Writer) (int64, error) {
+	conn, err := d.conn()
 	if err != nil {
-		fmt.Printf("A fatal error has occurred: %s\n", err)
-		os.Exit(1)
+		return 0, err
 	}
 	defer conn.Close()
 
-	msg, err := ioutil.ReadAll(conn)
+	n, err := copyWithIdleTimeout(w, conn, d.idleTimeout)
 	if err != nil {
-		fmt.Printf("Failed to read from active data connection: %v", err)
+		return n, fmt.Errorf("reading from active data connection: %w", err)
+	}
 
+	return n, nil
+}
+
+// writeFrom sends the contents of r over the active data connection, closing it
+// once r is exhausted. The server must connect within the connect timeout.
+func (d *activeDataConn) writeFrom(r io.Reader) (int64, error) {
+	conn, err := d.conn()
+	if err != nil {
+		return 0, err
 	}
+	defer conn.Close()
+
+	n, err := sendWithIdleTimeout(conn, r, d.idleTimeout)
+	if err != nil {
+		return n, fmt.Errorf("writing to active data connection: %w", err)
+	}
+
+	return n, nil
+}
 
-	d.dataChan <- msg
+// close releases the listener and any connection from the server that was
+// never read from or written to
+func (d *activeDataConn) close() error {
+	err := d.ln.Close()
+	if errors.Is(err, net.ErrClosed) {
+		err = nil
+	}
+
+	select {
+	case conn := <-d.connChan:
+		conn.Close()
+	default:
+	}
+	return err
+}
+
+// waitForConn concurrently waits for the server to connect. The connection is
+// then passed to readTo via d's connection channel
+func (d *activeDataConn) waitForConn() {
+	conn, err := d.ln.Accept()
+	d.ln.Close()
+	if err != nil {
+		d.errChan <- fmt.Errorf("waiting for active data connection: %v", err)
+		return
+	}
+
+	d.connChan <- conn
 }
 
 // passiveDataConn connects to the specified address and port on the FTP server
 // and waits for a data transmission
 type passiveDataConn struct {
 	conn net.Conn
+	// time allowed for the server to make progress once connected
+	idleTimeout time.Duration
 }
 
-// newPassiveDataConn connects to addr and returns the connection
-func newPassiveDataConn(addr string) (*passiveDataConn, error) {
-	conn, err := net.DialTimeout("tcp", addr, connTimeout)
+// newPassiveDataConn connects to addr with d and returns the connection
+func newPassiveDataConn(d dialer, addr string, connectTimeout, idleTimeout time.Duration) (*passiveDataConn, error) {
+	conn, err := d.dial(addr, connectTimeout)
 	if err != nil {
 		return nil, err
 	}
 
-	return &passiveDataConn{conn: conn}, nil
+	return &passiveDataConn{conn: conn, idleTimeout: idleTimeout}, nil
 }
 
 // read reads raw data from the pasive data connection
 func (d *passiveDataConn) read() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := d.readTo(&buf); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// readTo copies the data sent over the passive data connection to w
+func (d *passiveDataConn) readTo(w io.Writer) (int64, error) {
+	defer d.conn.Close()
+
+	n, err := copyWithIdleTimeout(w, d.conn, d.idleTimeout)
+	if err != nil {
+		return n, fmt.Errorf("reading from passive data connection: %w", err)
+	}
+
+	return n, nil
+}
+
+// writeFrom sends the contents of r over the passive data connection, closing it
+// once r is exhausted
+func (d *passiveDataConn) writeFrom(r io.Reader) (int64, error) {
 	defer d.conn.Close()
 
-	return ioutil.ReadAll(d.conn)
+	return sendWithIdleTimeout(d.conn, r, d.idleTimeout)
+}
+
+// close closes the passive data connection if it hasn't been already
+func (d *passiveDataConn) close() error {
+	err := d.conn.Close()
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// copyWithIdleTimeout copies from conn to w until EOF, failing if no data arrives
+// within idle of the previous read. The deadline is refreshed as data arrives, so
+// a transfer may take any amount of time as long as it doesn't stall.
+func copyWithIdleTimeout(w io.Writer, conn net.Conn, idle time.Duration) (int64, error) {
+	var total int64
+	chunk := make([]byte, 32*1024)
+	for {
+		conn.SetReadDeadline(time.Now().Add(idle))
+		n, err := conn.Read(chunk)
+		if n > 0 {
+			written, werr := w.Write(chunk[:n])
+			total += int64(written)
+			if werr != nil {
+				return total, werr
+			}
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return total, fmt.Errorf("%w, no data received for %v: %w", ErrTransferStalled, idle, err)
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// sendWithIdleTimeout copies from r to conn until EOF, failing if a write makes no
+// progress within idle.
+func sendWithIdleTimeout(conn net.Conn, r io.Reader, idle time.Duration) (int64, error) {
+	var total int64
+	chunk := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(chunk)
+		if n > 0 {
+			conn.SetWriteDeadline(time.Now().Add(idle))
+			written, werr := conn.Write(chunk[:n])
+			total += int64(written)
+			if ne, ok := werr.(net.Error); ok && ne.Timeout() {
+				return total, fmt.Errorf("%w, no data sent for %v: %w", ErrTransferStalled, idle, werr)
+			}
+			if werr != nil {
+				return total, werr
+			}
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
 }
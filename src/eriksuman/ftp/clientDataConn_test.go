@@ -0,0 +1,68 @@
+package ftp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestActiveDataConnConnectTimeout(t *testing.T) {
+	dc, _, err := newActiveDataConn(100*time.Millisecond, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the server never connects
+	start := time.Now()
+	if _, err := dc.readTo(&bytes.Buffer{}); err == nil {
+		t.Fatal("reading succeeded without a connection")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("gave up waiting for the server after %v, want about 100ms", elapsed)
+	}
+}
+
+func TestPassiveDataConnIdleTimeout(t *testing.T) {
+	client, server := tcpPair(t)
+
+	// the server sends the start of the data and then stalls
+	if _, err := server.Write([]byte("partial")); err != nil {
+		t.Fatal(err)
+	}
+
+	dc := &passiveDataConn{conn: client, idleTimeout: 100 * time.Millisecond}
+	var buf bytes.Buffer
+	_, err := dc.readTo(&buf)
+	var ne net.Error
+	if !errors.Is(err, ErrTransferStalled) || !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("got error %v, want the transfer to stall with a timeout", err)
+	}
+	if buf.String() != "partial" {
+		t.Errorf("received %q before the stall, want %q", buf.String(), "partial")
+	}
+}
+
+// zeroReader reads an endless stream of zero bytes
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestPassiveDataConnSendStalls(t *testing.T) {
+	client, _ := tcpPair(t)
+
+	// the server never reads, so the writes block once the buffers fill
+	dc := &passiveDataConn{conn: client, idleTimeout: 100 * time.Millisecond}
+	n, err := dc.writeFrom(io.LimitReader(zeroReader{}, 1<<30))
+	var ne net.Error
+	if !errors.Is(err, ErrTransferStalled) || !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("got error %v after sending %d bytes, want the transfer to stall with a timeout", err, n)
+	}
+}
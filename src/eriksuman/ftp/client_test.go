@@ -0,0 +1,553 @@
+package ftp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestClient connects a client to the server at addr and logs in with the test
+// server's credentials. Transfers are binary over passive data connections, and
+// local paths are relative to a temporary directory. Progress and prompts are
+// turned off so nothing waits on a terminal.
+func newTestClient(t *testing.T, addr string) *Client {
+	t.Helper()
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logFile := filepath.Join(t.TempDir(), "client.log")
+	cont, rply, localAddr, remoteAddr, err := newControlConn(directDialer{}, host, port, logFile, 5*time.Second, formatText, retryPolicy{}, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cont.Close() })
+	if rply.StatusCode != StatusReady {
+		t.Fatalf("got greeting %v", rply)
+	}
+
+	c := &Client{
+		control:         cont,
+		localAddr:       localAddr,
+		remoteAddr:      remoteAddr,
+		dialer:          directDialer{},
+		dataConnType:    dataConnTypePassive,
+		localDir:        t.TempDir(),
+		timeout:         5 * time.Second,
+		dataIdleTimeout: 5 * time.Second,
+		quiet:           true,
+		overwrite:       true,
+		in:              bufio.NewReader(strings.NewReader("")),
+		resumeRetries:   defaultResumeRetries,
+		params: sessionParams{
+			host:    host,
+			port:    port,
+			logFile: logFile,
+			format:  formatText,
+		},
+	}
+
+	if err := c.logInAs(credentials{user: TestUsername, password: TestPassword}); err != nil {
+		t.Fatal(err)
+	}
+	c.login = credentials{user: TestUsername, password: TestPassword}
+
+	if err := c.CommandTYPE(transferTypeBinary); err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+// startTestClient starts a server with NewTestServer serving a temporary
+// directory, and connects a client to it. It returns the client and the
+// directory.
+func startTestClient(t *testing.T) (*Client, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	addr, cleanup, err := NewTestServer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanup)
+
+	return newTestClient(t, addr), dir
+}
+
+// captureStdout returns what f prints to standard output
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	out := make(chan string)
+	go func() {
+		var buf bytes.Buffer
+		io.Copy(&buf, r)
+		out <- buf.String()
+	}()
+
+	f()
+	w.Close()
+	return <-out
+}
+
+// writeTestFile creates a file below dir, making any missing parent directories
+func writeTestFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+
+	p := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readTestFile returns the contents of a file below dir
+func readTestFile(t *testing.T, dir, name string) string {
+	t.Helper()
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestClientGetAndPut(t *testing.T) {
+	c, dir := startTestClient(t)
+	content := strings.Repeat("0123456789", 10000)
+	writeTestFile(t, dir, "remote.txt", content)
+
+	c.CommandGet("remote.txt", "", false)
+	if got := readTestFile(t, c.localDir, "remote.txt"); got != content {
+		t.Errorf("downloaded %d bytes, want the %d bytes of the remote file", len(got), len(content))
+	}
+
+	writeTestFile(t, c.localDir, "local.txt", "uploaded\n")
+	c.CommandPut("local.txt")
+	if got := readTestFile(t, dir, "local.txt"); got != "uploaded\n" {
+		t.Errorf("uploaded %q, want %q", got, "uploaded\n")
+	}
+}
+
+func TestClientListEntries(t *testing.T) {
+	c, dir := startTestClient(t)
+	writeTestFile(t, dir, "a.txt", "aaa")
+	writeTestFile(t, dir, "sub/b.txt", "bb")
+
+	entries, err := c.CommandListEntries("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]FileInfo)
+	for _, e := range entries {
+		got[e.Name] = e
+	}
+	if e, ok := got["a.txt"]; !ok || e.Size != 3 || e.IsDir() {
+		t.Errorf("got entry %+v for a.txt, want a 3 byte file", e)
+	}
+	if e, ok := got["sub"]; !ok || !e.IsDir() {
+		t.Errorf("got entry %+v for sub, want a directory", e)
+	}
+}
+
+// serverStatus returns the server's STAT reply for the client's session
+func serverStatus(t *testing.T, c *Client) string {
+	t.Helper()
+
+	rply, err := c.control.getReplyForCommand(newCommand(CommandSTAT, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rply.Message
+}
+
+func TestClientMode(t *testing.T) {
+	c, _ := startTestClient(t)
+
+	out := captureStdout(t, func() { c.executeCommand("mode") })
+	if want := "Mode: passive, legacy, binary, stream"; !strings.Contains(out, want) {
+		t.Errorf("mode printed %q, want %q", out, want)
+	}
+
+	out = captureStdout(t, func() { c.executeCommand("mode active extended ascii compressed") })
+	if want := "Mode: active, extended, ascii, compressed"; !strings.Contains(out, want) {
+		t.Errorf("mode printed %q, want %q", out, want)
+	}
+	if status := serverStatus(t, c); !strings.Contains(status, "Type: ASCII") || !strings.Contains(status, "Mode: ZLIB") {
+		t.Errorf("server status %q doesn't show the ascii type and compressed mode", status)
+	}
+
+	// the individual verbs change the same settings
+	out = captureStdout(t, func() {
+		c.executeCommand("passive")
+		c.executeCommand("binary")
+		c.executeCommand("mode stream legacy")
+	})
+	if want := "Mode: passive, legacy, binary, stream"; !strings.Contains(out, want) {
+		t.Errorf("mode printed %q, want %q", out, want)
+	}
+	if c.dataConnType != dataConnTypePassive || c.transferType != transferTypeBinary || c.compressed || c.extended {
+		t.Errorf("got %s after restoring the defaults", c.modeString())
+	}
+
+	out = captureStdout(t, func() { c.executeCommand("mode sideways") })
+	if !strings.Contains(out, "Usage: mode") {
+		t.Errorf("mode with an unknown setting printed %q, want its usage", out)
+	}
+
+	// a bad setting leaves the others unapplied
+	out = captureStdout(t, func() { c.executeCommand("mode active ascii bogus") })
+	if !strings.Contains(out, "Usage: mode") {
+		t.Errorf("mode with an unknown setting printed %q, want its usage", out)
+	}
+	if c.dataConnType != dataConnTypePassive || c.transferType != transferTypeBinary {
+		t.Errorf("got %s after a mode command with a bad setting", c.modeString())
+	}
+	if status := serverStatus(t, c); !strings.Contains(status, "Type: BINARY") {
+		t.Errorf("server status %q, want the type unchanged", status)
+	}
+
+	// every recognized setting can be applied
+	for m := range modeSettings {
+		captureStdout(t, func() {
+			if !c.setMode(m) {
+				t.Errorf("setMode(%q) doesn't recognize a mode setting", m)
+			}
+		})
+	}
+}
+
+func TestClientLocalCommands(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	c, _ := startTestClient(t)
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	writeTestFile(t, home, "Downloads/Report.PDF", "%PDF")
+
+	// arguments keep their case, only the command is case insensitive
+	out := captureStdout(t, func() { c.executeCommand("LCD ~/Downloads") })
+	if want := filepath.Join(home, "Downloads"); c.localDir != want {
+		t.Fatalf("lcd printed %q and changed to %s, want %s", out, c.localDir, want)
+	}
+
+	out = captureStdout(t, func() { c.executeCommand("lpwd") })
+	if !strings.Contains(out, c.localDir) {
+		t.Errorf("lpwd printed %q, want %s", out, c.localDir)
+	}
+
+	out = captureStdout(t, func() { c.executeCommand("lls") })
+	if !strings.Contains(out, "Report.PDF") {
+		t.Errorf("lls printed %q, want a listing including Report.PDF", out)
+	}
+
+	// transfers are relative to the local directory
+	c.executeCommand("put Report.PDF")
+	c.executeCommand("lcd ..")
+	c.executeCommand("get Report.PDF")
+	if got := readTestFile(t, home, "Report.PDF"); got != "%PDF" {
+		t.Errorf("downloaded %q, want %q", got, "%PDF")
+	}
+}
+
+func TestClientAVBL(t *testing.T) {
+	real := availableSpace
+	t.Cleanup(func() { availableSpace = real })
+	availableSpace = func(string) (uint64, error) { return 4096, nil }
+
+	c, _ := startTestClient(t)
+	if out := captureStdout(t, func() { c.CommandAVBL("") }); !strings.Contains(out, "213 4096") {
+		t.Errorf("avbl printed %q, want the stubbed 4096 bytes", out)
+	}
+}
+
+func TestClientPipelinedSizes(t *testing.T) {
+	c, dir := startTestClient(t)
+	files := []string{"a.txt", "b.txt", "missing.txt", "c.txt", "d.txt"}
+	want := map[string]int64{"a.txt": 1, "b.txt": 4000, "c.txt": 0, "d.txt": 123456}
+	for name, size := range want {
+		writeTestFile(t, dir, name, strings.Repeat("x", int(size)))
+	}
+
+	var sizes map[string]int64
+	var err error
+	out := captureStdout(t, func() { sizes, err = c.CommandSizes(files) })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each reply goes with the file it was sent for, even though the commands
+	// were all sent before any reply was read
+	if len(sizes) != len(want) {
+		t.Errorf("got sizes %v, want %v", sizes, want)
+	}
+	for name, size := range want {
+		if sizes[name] != size {
+			t.Errorf("got size %d for %s, want %d", sizes[name], name, size)
+		}
+	}
+	if !strings.Contains(out, "missing.txt:") {
+		t.Errorf("printed %q, want an error for missing.txt", out)
+	}
+
+	// the connection is still in step with the server afterwards
+	if status := serverStatus(t, c); !strings.Contains(status, "Type: BINARY") {
+		t.Errorf("STAT after the pipeline replied %q", status)
+	}
+}
+
+func TestClientAutoFallsBackToActive(t *testing.T) {
+	// the server advertises an address the client can't reach, as it would if
+	// its public IP were misconfigured
+	s := startTestServer(t, func(c *config) {
+		c.port = true
+		c.pasvPublicIP = "192.0.2.1"
+	})
+	writeTestFile(t, s.dir, "remote.txt", "fallback")
+
+	c := newTestClient(t, s.addr)
+	c.timeout = 300 * time.Millisecond
+	c.dataConnType = dataConnTypeAuto
+
+	out := captureStdout(t, func() { c.CommandGet("remote.txt", "", false) })
+	if !strings.Contains(out, "trying active mode") {
+		t.Errorf("printed %q, want the passive failure reported", out)
+	}
+	if got := readTestFile(t, c.localDir, "remote.txt"); got != "fallback" {
+		t.Errorf("downloaded %q, want %q", got, "fallback")
+	}
+
+	// active mode is used from then on without trying passive again
+	if c.dataConnType != dataConnTypeActive {
+		t.Errorf("got %s after falling back, want active", c.modeString())
+	}
+}
+
+func TestClientUTF8Names(t *testing.T) {
+	c, dir := startTestClient(t)
+	if err := c.CommandOPTS("UTF8 ON"); err != nil {
+		t.Fatal(err)
+	}
+
+	const name = "résumé 日本語.txt"
+	writeTestFile(t, dir, name, "unicode")
+
+	entries, err := c.CommandListEntries("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name != name {
+		t.Errorf("listed %+v, want the single entry %q", entries, name)
+	}
+
+	c.CommandGet(name, "", false)
+	if got := readTestFile(t, c.localDir, name); got != "unicode" {
+		t.Errorf("downloaded %q, want %q", got, "unicode")
+	}
+}
+
+func TestClientAdaptToFeatures(t *testing.T) {
+	withEPSV := parseFeatures("-Features:\n EPSV\n SIZE\n211 End")
+	withoutEPSV := parseFeatures("-Features:\n SIZE\n MDTM\n211 End")
+
+	for _, tt := range []struct {
+		name       string
+		features   *Features
+		remoteAddr string
+		want       bool
+		longAddr   bool
+		printed    string
+	}{
+		{"EPSV advertised", withEPSV, "192.0.2.1:21", true, false, ""},
+		{"no EPSV over IPv4", withoutEPSV, "192.0.2.1:21", false, false, "legacy configuration commands will be used"},
+		{"no EPSV over IPv6", withoutEPSV, "[2001:db8::1]:21", true, true, "LPSV and LPRT will be used"},
+	} {
+		c := &Client{features: tt.features, remoteAddr: tt.remoteAddr, extended: true}
+		out := captureStdout(t, c.adaptToFeatures)
+		if c.extended != tt.want {
+			t.Errorf("%s: extended is %v, want %v", tt.name, c.extended, tt.want)
+		}
+		if c.longAddr != tt.longAddr {
+			t.Errorf("%s: longAddr is %v, want %v", tt.name, c.longAddr, tt.longAddr)
+		}
+		if !strings.Contains(out, tt.printed) || (tt.printed == "" && out != "") {
+			t.Errorf("%s: printed %q, want %q", tt.name, out, tt.printed)
+		}
+	}
+}
+
+func TestClientKeepsArgumentCase(t *testing.T) {
+	c, dir := startTestClient(t)
+	writeTestFile(t, dir, "Remote.TXT", "mixed case")
+	if err := os.Mkdir(filepath.Join(c.localDir, "Sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	captureStdout(t, func() { c.executeCommand("GET Remote.TXT Sub/Local.TXT") })
+	if got := readTestFile(t, c.localDir, "Sub/Local.TXT"); got != "mixed case" {
+		t.Errorf("downloaded %q, want %q", got, "mixed case")
+	}
+	if _, err := os.Stat(filepath.Join(c.localDir, "sub")); err == nil {
+		t.Error("downloaded into a lower case copy of the local path")
+	}
+}
+
+func TestClientPWDWithQuotes(t *testing.T) {
+	c, dir := startTestClient(t)
+	if err := os.Mkdir(filepath.Join(dir, `say "hi"`), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	captureStdout(t, func() { c.CommandCD(`say "hi"`) })
+	got, err := c.CommandPWD()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := dir + `/say "hi"`; got != want {
+		t.Errorf("pwd returned %q, want %q", got, want)
+	}
+}
+
+func TestClientDownloadRange(t *testing.T) {
+	c, dir := startTestClient(t)
+	content := strings.Repeat("0123456789abcdef", 64<<10)
+	writeTestFile(t, dir, "big.bin", content)
+	size := int64(len(content))
+
+	ranges := []struct {
+		off, n int64
+	}{
+		{0, 10},
+		{100, 1000},
+		{size - 16, 16},  // ends exactly with the file
+		{size - 10, 100}, // runs past the end of the file
+	}
+	for _, r := range ranges {
+		// record the commands sent for this range
+		var sent bytes.Buffer
+		c.control.logger = nopWriteCloser{&sent}
+
+		var buf bytes.Buffer
+		captureStdout(t, func() {
+			if err := c.DownloadRange("big.bin", r.off, r.n, &buf); err != nil {
+				t.Fatalf("range %d+%d: %v", r.off, r.n, err)
+			}
+		})
+
+		end := r.off + r.n
+		if end >= size {
+			end = size
+			// the whole transfer was received, so there is nothing to abort
+			if strings.Contains(sent.String(), string(CommandABOR)) {
+				t.Errorf("range %d+%d reaches the end of the file but sent ABOR", r.off, r.n)
+			}
+		}
+		if got := buf.String(); got != content[r.off:end] {
+			t.Errorf("range %d+%d got %d bytes, want %d", r.off, r.n, len(got), end-r.off)
+		}
+
+		// no reply is left over for the next command to read
+		var got int64
+		var err error
+		captureStdout(t, func() { got, err = c.CommandSIZE("big.bin") })
+		if err != nil || got != size {
+			t.Fatalf("size after range %d+%d = %d, %v; want %d", r.off, r.n, got, err, size)
+		}
+	}
+}
+
+func TestClientLongAddrTransfers(t *testing.T) {
+	s := startTestServer(t, func(c *config) { c.port = true })
+	writeTestFile(t, s.dir, "remote.txt", "long address")
+
+	c := newTestClient(t, s.addr)
+	c.longAddr = true
+
+	for _, tt := range []struct {
+		mode dataConnType
+		want CommandCode
+	}{
+		{dataConnTypePassive, CommandLPSV},
+		{dataConnTypeActive, CommandLPRT},
+	} {
+		c.dataConnType = tt.mode
+		var sent bytes.Buffer
+		c.control.logger = nopWriteCloser{&sent}
+
+		var buf bytes.Buffer
+		captureStdout(t, func() {
+			if err := c.DownloadRange("remote.txt", 0, 100, &buf); err != nil {
+				t.Fatalf("%s: %v", tt.want, err)
+			}
+		})
+		if got := buf.String(); got != "long address" {
+			t.Errorf("%s: downloaded %q, want %q", tt.want, got, "long address")
+		}
+		if !strings.Contains(sent.String(), string(tt.want)) {
+			t.Errorf("sent %q, want %s used", sent.String(), tt.want)
+		}
+	}
+}
+
+func TestDial(t *testing.T) {
+	s := startTestServer(t, nil)
+	writeTestFile(t, s.dir, "remote.txt", "dialed")
+	host, port, err := net.SplitHostPort(s.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := filepath.Join(t.TempDir(), "client.log")
+
+	var c *Client
+	captureStdout(t, func() {
+		c, err = Dial(host, port, log, &ClientOptions{User: TestUsername, Password: TestPassword, Passive: true, Retries: 2})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the client is logged in and ready to transfer
+	var buf bytes.Buffer
+	captureStdout(t, func() { err = c.DownloadRange("remote.txt", 0, 100, &buf) })
+	if err != nil || buf.String() != "dialed" {
+		t.Errorf("downloaded %q, %v, want %q", buf.String(), err, "dialed")
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("closing the client: %v", err)
+	}
+
+	// bad credentials fail the dial rather than being prompted for again
+	captureStdout(t, func() {
+		c, err = Dial(host, port, log, &ClientOptions{User: TestUsername, Password: "wrong"})
+	})
+	if err == nil {
+		c.Close()
+		t.Error("dialing with the wrong password succeeded")
+	}
+}
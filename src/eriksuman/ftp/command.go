@@ -3,12 +3,17 @@ package ftp
 import (
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math"
 	"net"
 	"os"
 	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // CommandCode is the character code representing a command
@@ -18,6 +23,7 @@ type CommandCode string
 const (
 	CommandUSER CommandCode = "USER"
 	CommandPASS CommandCode = "PASS"
+	CommandACCT CommandCode = "ACCT"
 	CommandCWD  CommandCode = "CWD"
 	CommandCDUP CommandCode = "CDUP"
 	CommandQUIT CommandCode = "QUIT"
@@ -26,11 +32,44 @@ const (
 	CommandPORT CommandCode = "PORT"
 	CommandEPRT CommandCode = "EPRT"
 	CommandRETR CommandCode = "RETR"
+	CommandSTOR CommandCode = "STOR"
+	CommandAPPE CommandCode = "APPE"
+	CommandMKD  CommandCode = "MKD"
 	CommandPWD  CommandCode = "PWD"
 	CommandLIST CommandCode = "LIST"
+	CommandNLST CommandCode = "NLST"
 	CommandHELP CommandCode = "HELP"
+	CommandTYPE CommandCode = "TYPE"
+	CommandMODE CommandCode = "MODE"
+	CommandSTRU CommandCode = "STRU"
+	CommandFEAT CommandCode = "FEAT"
+	CommandOPTS CommandCode = "OPTS"
+	CommandAVBL CommandCode = "AVBL"
+	CommandSITE CommandCode = "SITE"
+	CommandSIZE CommandCode = "SIZE"
+	CommandMDTM CommandCode = "MDTM"
+	CommandMFMT CommandCode = "MFMT"
+	CommandSTAT CommandCode = "STAT"
+	CommandCLNT CommandCode = "CLNT"
+	CommandREIN CommandCode = "REIN"
+	CommandLPRT CommandCode = "LPRT"
+	CommandLPSV CommandCode = "LPSV"
+	CommandMLST CommandCode = "MLST"
+	CommandMLSD CommandCode = "MLSD"
+	CommandXCRC CommandCode = "XCRC"
+	CommandXMD5 CommandCode = "XMD5"
+	CommandHASH CommandCode = "HASH"
+	CommandREST CommandCode = "REST"
+	CommandABOR CommandCode = "ABOR"
 )
 
+// layout of the timestamps returned by MDTM
+const mdtmLayout = "20060102150405"
+
+// errRemoteExists is returned when the server refuses to create a directory,
+// usually because it already exists
+var errRemoteExists = errors.New("directory could not be created or already exists")
+
 // Command is a PDU containing a command to be sent to the server
 type Command struct {
 	Code     CommandCode
@@ -56,10 +95,102 @@ func (c Command) String() string {
 // StatusCode is the status code generated by a reply from the FTP server
 type StatusCode string
 
+// status codes defined by RFC 959 and its extensions
+const (
+	StatusRestartMarker            StatusCode = "110" // restart marker reply
+	StatusReadyMinute              StatusCode = "120" // service ready in a few minutes
+	StatusAlreadyOpen              StatusCode = "125" // data connection already open, transfer starting
+	StatusAboutToSend              StatusCode = "150" // file status okay, about to open data connection
+	StatusCommandOK                StatusCode = "200" // command okay
+	StatusCommandNotImplemented    StatusCode = "202" // command not implemented, superfluous at this site
+	StatusSystem                   StatusCode = "211" // system status, or system help reply
+	StatusDirectory                StatusCode = "212" // directory status
+	StatusFile                     StatusCode = "213" // file status
+	StatusHelp                     StatusCode = "214" // help message
+	StatusName                     StatusCode = "215" // name of the system type
+	StatusReady                    StatusCode = "220" // service ready for new user
+	StatusClosing                  StatusCode = "221" // service closing control connection
+	StatusDataConnectionOpen       StatusCode = "225" // data connection open, no transfer in progress
+	StatusClosingDataConnection    StatusCode = "226" // closing data connection, requested action successful
+	StatusPasvMode                 StatusCode = "227" // entering passive mode
+	StatusLongPasvMode             StatusCode = "228" // entering long passive mode
+	StatusExtendedPasvMode         StatusCode = "229" // entering extended passive mode
+	StatusLoggedIn                 StatusCode = "230" // user logged in
+	StatusRequestedFileActionOK    StatusCode = "250" // requested file action okay, completed
+	StatusPathCreated              StatusCode = "257" // pathname created
+	StatusUserOK                   StatusCode = "331" // user name okay, need password
+	StatusLoginNeedAccount         StatusCode = "332" // need account for login
+	StatusRequestFilePending       StatusCode = "350" // requested file action pending further information
+	StatusNotAvailable             StatusCode = "421" // service not available, closing control connection
+	StatusCanNotOpenDataConnection StatusCode = "425" // can't open data connection
+	StatusTransferAborted          StatusCode = "426" // connection closed, transfer aborted
+	StatusFileActionIgnored        StatusCode = "450" // requested file action not taken, file unavailable
+	StatusActionAborted            StatusCode = "451" // requested action aborted, local error in processing
+	StatusInsufficientStorageSpace StatusCode = "452" // requested action not taken, insufficient storage space
+	StatusBadCommand               StatusCode = "500" // syntax error, command unrecognized
+	StatusBadArguments             StatusCode = "501" // syntax error in parameters or arguments
+	StatusNotImplemented           StatusCode = "502" // command not implemented
+	StatusBadSequence              StatusCode = "503" // bad sequence of commands
+	StatusNotImplementedParameter  StatusCode = "504" // command not implemented for that parameter
+	StatusBadAddressFamily         StatusCode = "521" // address family not supported
+	StatusBadNetworkProtocol       StatusCode = "522" // network protocol not supported
+	StatusNotLoggedIn              StatusCode = "530" // not logged in
+	StatusStorNeedAccount          StatusCode = "532" // need account for storing files
+	StatusFileUnavailable          StatusCode = "550" // requested action not taken, file unavailable
+	StatusPageTypeUnknown          StatusCode = "551" // requested action aborted, page type unknown
+	StatusExceededStorage          StatusCode = "552" // requested file action aborted, exceeded storage allocation
+	StatusBadFileName              StatusCode = "553" // requested action not taken, file name not allowed
+	StatusInvalidRestart           StatusCode = "554" // requested action not taken, invalid REST parameter
+)
+
+// IsPreliminary reports whether the reply is a positive preliminary reply (1yz),
+// to be followed by another reply once the action completes
+func (s StatusCode) IsPreliminary() bool {
+	return s.class() == '1'
+}
+
+// IsPositive reports whether the reply is a positive completion reply (2yz)
+func (s StatusCode) IsPositive() bool {
+	return s.class() == '2'
+}
+
+// IsIntermediate reports whether the reply is a positive intermediate reply (3yz),
+// where the server needs another command to complete the action
+func (s StatusCode) IsIntermediate() bool {
+	return s.class() == '3'
+}
+
+// IsTransient reports whether the reply is a transient negative completion reply
+// (4yz), where the action may succeed if attempted again
+func (s StatusCode) IsTransient() bool {
+	return s.class() == '4'
+}
+
+// IsPermanent reports whether the reply is a permanent negative completion reply
+// (5yz), where the action should not be attempted again unchanged
+func (s StatusCode) IsPermanent() bool {
+	return s.class() == '5'
+}
+
+// IsError reports whether the reply is a transient or permanent negative reply
+func (s StatusCode) IsError() bool {
+	return s.IsTransient() || s.IsPermanent()
+}
+
+// class returns the first digit of the status code
+func (s StatusCode) class() byte {
+	if len(s) == 0 {
+		return 0
+	}
+	return s[0]
+}
+
 // Reply is the PDU for a reply to a command from an FTP server
 type Reply struct {
 	StatusCode StatusCode
 	Message    string
+	// all lines of a multi-line reply as received, empty otherwise
+	raw string
 }
 
 func newReply(s StatusCode, msg string) *Reply {
@@ -69,7 +200,19 @@ func newReply(s StatusCode, msg string) *Reply {
 	}
 }
 
+// String returns the reply as it appears on the control connection. Multi-line
+// replies received from a server are returned as received, and others end with
+// the status code and "End".
 func (r Reply) String() string {
+	if r.raw != "" {
+		return r.raw
+	}
+	return r.format("End")
+}
+
+// format returns the reply as sent on the control connection, ending a multi-line
+// reply with suffix
+func (r Reply) format(suffix string) string {
 	msg := strings.Trim(r.Message, "\n")
 	// check if message contains embedded newlines
 	if strings.Contains(msg, "\n") {
@@ -80,7 +223,7 @@ func (r Reply) String() string {
 		}
 
 		msg = strings.Join(a, "\r\n") + "\r\n"
-		return string(r.StatusCode) + "-\r\n" + msg + string(r.StatusCode) + " Erik's FTP Server"
+		return string(r.StatusCode) + "-\r\n" + msg + string(r.StatusCode) + " " + suffix
 	}
 
 	return fmt.Sprintf("%s %s", r.StatusCode, r.Message)
@@ -99,15 +242,15 @@ func (c *Client) CommandCD(path string) {
 	// check status code
 	fmt.Println(rply)
 	switch rply.StatusCode {
-	case "250":
+	case StatusRequestedFileActionOK:
 		// success, noop
-	case "500", "502", "550":
+	case StatusBadCommand, StatusNotImplemented, StatusFileUnavailable:
 		// software error
 		fmt.Println("Command failed.")
-	case "501":
+	case StatusBadArguments:
 		// user error
 		fmt.Println("Error in parameters.")
-	case "421":
+	case StatusNotAvailable:
 		// server closed connection
 		c.closeAndExit("Exiting.")
 	default:
@@ -126,15 +269,15 @@ func (c *Client) CommandCDUP() {
 	// check status code
 	fmt.Println(rply)
 	switch rply.StatusCode {
-	case "200", "250":
+	case StatusCommandOK, StatusRequestedFileActionOK:
 		//success, noop
-	case "500", "502", "550":
+	case StatusBadCommand, StatusNotImplemented, StatusFileUnavailable:
 		// software error
 		fmt.Println("Command failed.")
-	case "501":
+	case StatusBadArguments:
 		// user error
 		fmt.Println("Error in parameters.")
-	case "421":
+	case StatusNotAvailable:
 		// server closed connection
 		c.closeAndExit("Exiting.")
 	default:
@@ -142,30 +285,147 @@ func (c *Client) CommandCDUP() {
 	}
 }
 
-// CommandPWD requests the current directory from the server
-func (c *Client) CommandPWD() {
+// CommandPWD requests the current directory from the server and returns it, with
+// the quoting of the 257 reply removed
+func (c *Client) CommandPWD() (string, error) {
 	rply, err := c.control.getReplyForCommand(newCommand(CommandPWD, ""))
 	if err != nil {
-		fmt.Printf("An unexpected error occurred: %v\n", err)
+		return "", err
+	}
+
+	// check status code
+	switch rply.StatusCode {
+	case StatusPathCreated:
+		return parsePWDReply(rply.Message)
+	case StatusBadCommand, StatusBadArguments, StatusNotImplemented, StatusFileUnavailable:
+		return "", fmt.Errorf("pwd command failed: %w", newReplyError(rply))
+	case StatusNotAvailable:
+		// server closed connection
+		fmt.Println(rply)
+		c.closeAndExit("Exiting.")
+	default:
+		fmt.Println(rply)
+		c.closeAndExit("Unrecognized reply, exiting.")
+	}
+
+	return "", errors.New("unexpected error")
+}
+
+// CommandTYPE sets the representation type used for data transfers
+func (c *Client) CommandTYPE(t transferType) error {
+	var arg string
+	switch t {
+	case transferTypeASCII:
+		arg = "A"
+	case transferTypeBinary:
+		arg = "I"
+	default:
+		return fmt.Errorf("unknown transfer type: %d", t)
+	}
+
+	rply, err := c.control.getReplyForCommand(newCommand(CommandTYPE, arg))
+	if err != nil {
+		return err
 	}
 
 	// check status code
 	fmt.Println(rply)
 	switch rply.StatusCode {
-	case "257":
-		// success, noop
-	case "500", "502", "550":
+	case StatusCommandOK:
+		// okay, remember type
+		c.transferType = t
+		return nil
+	case StatusBadCommand, StatusBadArguments, StatusNotImplemented, StatusNotImplementedParameter, StatusNotLoggedIn:
 		// software error
-		fmt.Println("Command failed.")
-	case "501":
-		// user error
-		fmt.Println("Error in parameters.")
-	case "421":
+		return fmt.Errorf("type command failed: %w", newReplyError(rply))
+	case StatusNotAvailable:
+		// server closed connection
+		c.closeAndExit("Exiting.")
+	default:
+		c.closeAndExit("Unrecognized reply, exiting.")
+	}
+
+	return errors.New("unexpected error")
+}
+
+// CommandMODE sets the transfer mode, compressing transfers with zlib when
+// compressed is set and using a plain stream otherwise
+func (c *Client) CommandMODE(compressed bool) error {
+	arg := modeStream
+	if compressed {
+		arg = modeZlib
+	}
+
+	rply, err := c.control.getReplyForCommand(newCommand(CommandMODE, arg))
+	if err != nil {
+		return err
+	}
+
+	// check status code
+	fmt.Println(rply)
+	switch rply.StatusCode {
+	case StatusCommandOK:
+		// okay, remember mode
+		c.compressed = compressed
+		return nil
+	case StatusBadCommand, StatusBadArguments, StatusNotImplemented, StatusNotImplementedParameter, StatusNotLoggedIn:
+		// software error
+		return fmt.Errorf("mode command failed: %w", newReplyError(rply))
+	case StatusNotAvailable:
 		// server closed connection
 		c.closeAndExit("Exiting.")
 	default:
 		c.closeAndExit("Unrecognized reply, exiting.")
 	}
+
+	return errors.New("unexpected error")
+}
+
+// changeDir changes the remote directory to dir, returning an error rather than
+// printing if it fails
+func (c *Client) changeDir(dir string) error {
+	rply, err := c.control.getReplyForCommand(newCommand(CommandCWD, dir))
+	if err != nil {
+		return err
+	}
+
+	switch rply.StatusCode {
+	case StatusRequestedFileActionOK:
+		return nil
+	case StatusNotAvailable:
+		// server closed connection
+		fmt.Println(rply)
+		c.closeAndExit("Exiting.")
+	}
+
+	return fmt.Errorf("%s: %w", dir, newReplyError(rply))
+}
+
+// parsePWDReply extracts the directory name from the message of a 257 reply. The
+// name is enclosed in double quotes, with any quotes inside it doubled.
+func parsePWDReply(msg string) (string, error) {
+	strt := strings.IndexByte(msg, '"')
+	if strt == -1 {
+		return "", fmt.Errorf("invalid PWD reply: %s", strings.TrimSpace(msg))
+	}
+
+	var dir strings.Builder
+	for i := strt + 1; i < len(msg); i++ {
+		if msg[i] != '"' {
+			dir.WriteByte(msg[i])
+			continue
+		}
+
+		// a doubled quote is a literal quote, a single quote ends the name
+		if i+1 < len(msg) && msg[i+1] == '"' {
+			dir.WriteByte('"')
+			i++
+			continue
+		}
+		return dir.String(), nil
+	}
+
+	return "", fmt.Errorf("invalid PWD reply: %s", strings.TrimSpace(msg))
 }
 
 // CommandPORT tells the server to connect to host:port for data transmission
@@ -183,14 +443,14 @@ func (c *Client) CommandPORT(host, port string) error {
 
 	// check status code
 	switch rply.StatusCode {
-	case "200":
+	case StatusCommandOK:
 		// okay, return
 		return nil
-	case "500", "501", "530":
+	case StatusBadCommand, StatusBadArguments, StatusNotLoggedIn:
 		// software error
 		fmt.Println(rply)
-		return errors.New("port command failed")
-	case "421":
+		return fmt.Errorf("port command failed: %w", newReplyError(rply))
+	case StatusNotAvailable:
 		// server closed connection
 		fmt.Println(rply)
 		c.closeAndExit("Exiting.")
@@ -217,14 +477,49 @@ func (c *Client) CommandEPRT(host, port string) error {
 
 	// check status code
 	switch rply.StatusCode {
-	case "200":
+	case StatusCommandOK:
+		// okay, return
+		return nil
+	case StatusBadCommand, StatusBadArguments, StatusNotLoggedIn, StatusBadNetworkProtocol:
+		// software error
+		fmt.Println(rply)
+		return fmt.Errorf("eprt command failed: %w", newReplyError(rply))
+	case StatusNotAvailable:
+		// server closed connection
+		fmt.Println(rply)
+		c.closeAndExit("Exiting.")
+	default:
+		fmt.Println(rply)
+		c.closeAndExit("Unrecognized response. Exiting.")
+	}
+
+	return errors.New("unexpected error")
+}
+
+// CommandLPRT tells the server to make data connections to the given host and port
+// using the RFC 1639 long address format, which carries IPv4 and IPv6 addresses
+func (c *Client) CommandLPRT(host, port string) error {
+	// build argument for lprt command
+	lprtArg, err := getLongAddrString(host, port)
+	if err != nil {
+		return err
+	}
+
+	rply, err := c.control.getReplyForCommand(newCommand(CommandLPRT, lprtArg))
+	if err != nil {
+		return err
+	}
+
+	// check status code
+	switch rply.StatusCode {
+	case StatusCommandOK:
 		// okay, return
 		return nil
-	case "500", "501", "530", "522":
+	case StatusBadCommand, StatusBadArguments, StatusNotImplemented, StatusNotLoggedIn, StatusBadAddressFamily, StatusFileUnavailable:
 		// software error
 		fmt.Println(rply)
-		return errors.New("eprt command failed")
-	case "421":
+		return fmt.Errorf("lprt command failed: %w", newReplyError(rply))
+	case StatusNotAvailable:
 		// server closed connection
 		fmt.Println(rply)
 		c.closeAndExit("Exiting.")
@@ -236,6 +531,32 @@ func (c *Client) CommandEPRT(host, port string) error {
 	return errors.New("unexpected error")
 }
 
+// CommandLPSV tells the server to listen on a port for data connections, replying
+// with the RFC 1639 long address format. The address to connect to is returned.
+func (c *Client) CommandLPSV() (string, error) {
+	rply, err := c.control.getReplyForCommand(newCommand(CommandLPSV, ""))
+	if err != nil {
+		return "", err
+	}
+
+	// check status code
+	fmt.Println(rply)
+	switch rply.StatusCode {
+	case StatusLongPasvMode:
+		// okay, parse the address
+		return parseLPSVString(rply.Message)
+	case StatusCanNotOpenDataConnection, StatusBadCommand, StatusBadArguments, StatusNotImplemented, StatusNotLoggedIn, StatusFileUnavailable:
+		return "", fmt.Errorf("lpsv command failed: %w", newReplyError(rply))
+	case StatusNotAvailable:
+		// server closed connection
+		c.closeAndExit("Exiting.")
+	default:
+		c.closeAndExit("Unrecognized reply, exiting.")
+	}
+
+	return "", errors.New("unexpected error")
+}
+
 // CommandPASV tells the server to listen on a port for data connections. The message
 // returned by the server is returned to the caller
 func (c *Client) CommandPASV() (string, error) {
@@ -247,16 +568,12 @@ func (c *Client) CommandPASV() (string, error) {
 	// check status code
 	fmt.Println(rply)
 	switch rply.StatusCode {
-	case "227":
+	case StatusPasvMode:
 		// okay, return message
 		return rply.Message, nil
-	case "500", "502", "530":
-		// software error
-		return "", fmt.Errorf("command failed")
-	case "501":
-		// user error
-		return "", fmt.Errorf("error in parameters")
-	case "421":
+	case StatusCanNotOpenDataConnection, StatusBadCommand, StatusBadArguments, StatusNotImplemented, StatusNotLoggedIn, StatusFileUnavailable:
+		return "", fmt.Errorf("pasv command failed: %w", newReplyError(rply))
+	case StatusNotAvailable:
 		// server closed connection
 		c.closeAndExit("Exiting.")
 	default:
@@ -277,13 +594,13 @@ func (c *Client) CommandEPSV() (string, error) {
 	// check status code
 	fmt.Println(rply)
 	switch rply.StatusCode {
-	case "229":
+	case StatusExtendedPasvMode:
 		// okay, return message
 		return rply.Message, nil
-	case "500", "501", "530", "522":
+	case StatusBadCommand, StatusBadArguments, StatusNotLoggedIn, StatusBadNetworkProtocol, StatusFileUnavailable:
 		// software error
-		return "", errors.New("epsv command failed")
-	case "421":
+		return "", fmt.Errorf("epsv command failed: %w", newReplyError(rply))
+	case StatusNotAvailable:
 		// server closed connection
 		c.closeAndExit("Exiting.")
 	default:
@@ -311,7 +628,7 @@ func (c *Client) CommandLS(path string) {
 	// check status code
 	fmt.Println(rply)
 	switch rply.StatusCode {
-	case "125", "150":
+	case StatusAlreadyOpen, StatusAboutToSend:
 		// okay, read from data connection
 		msg, err := data.read()
 		if err != nil {
@@ -319,15 +636,15 @@ func (c *Client) CommandLS(path string) {
 			return
 		}
 		fmt.Print(string(msg))
-	case "450", "500", "502", "530":
+	case StatusFileActionIgnored, StatusBadCommand, StatusNotImplemented, StatusNotLoggedIn:
 		// software error
 		fmt.Println("Command failed.")
 		return
-	case "501":
+	case StatusBadArguments:
 		// user error
 		fmt.Println("Error in parameters.")
 		return
-	case "421":
+	case StatusNotAvailable:
 		// server closed connection
 		c.closeAndExit("Exiting.")
 	default:
@@ -344,9 +661,9 @@ func (c *Client) CommandLS(path string) {
 	// check status code
 	fmt.Println(rply)
 	switch rply.StatusCode {
-	case "226", "250":
+	case StatusClosingDataConnection, StatusRequestedFileActionOK:
 		// success, noop
-	case "425", "426", "451":
+	case StatusCanNotOpenDataConnection, StatusTransferAborted, StatusActionAborted:
 		// software error
 		fmt.Println("Command failed.")
 	default:
@@ -354,188 +671,1098 @@ func (c *Client) CommandLS(path string) {
 	}
 }
 
-// CommandGet retrieves file from the server using the RETR command. The file is
-// saved to the local current directory.
-func (c *Client) CommandGet(file string) {
+// CommandListEntries opens a data connection, requests a listing of path, and
+// parses it into entries. Errors are returned rather than printed so the entries
+// can be used programmatically.
+func (c *Client) CommandListEntries(path string) ([]FileInfo, error) {
 	data, err := c.openDataConn()
 	if err != nil {
-		fmt.Printf("An unexpected error occurred: %s", err)
-		return
+		return nil, err
 	}
 
-	rply, err := c.control.getReplyForCommand(newCommand(CommandRETR, file))
+	rply, err := c.control.getReplyForCommand(newCommand(CommandLIST, path))
 	if err != nil {
-		fmt.Printf("An unexpected error occurred: %v\n", err)
-		return
+		return nil, err
 	}
 
-	fmt.Println(rply)
-	var bytes []byte
+	// check status code
+	var list []byte
 	switch rply.StatusCode {
-	case "125", "150":
-		//success, read from data connection
-		bytes, err = data.read()
+	case StatusAlreadyOpen, StatusAboutToSend:
+		// okay, read from data connection
+		list, err = data.read()
 		if err != nil {
-			fmt.Printf("An unexpected error occurred: %s\n", err)
-			return
+			return nil, fmt.Errorf("reading from data connection: %v", err)
 		}
-	case "450", "550", "500", "502", "530":
-		//software error
-		fmt.Println("Command failed.")
-		return
-	case "501":
-		// user error
-		fmt.Println("Invalid parameters.")
-		return
-	case "421":
-		// server closed connection
-		c.closeAndExit("Exiting.")
 	default:
-		c.closeAndExit("Unrecognized reply, exiting.")
+		return nil, fmt.Errorf("list command failed: %w", newReplyError(rply))
 	}
 
-	// read a reply from the server
+	// read a reply from server
 	rply, err = c.control.readReply()
 	if err != nil {
-		fmt.Printf("An unexpected error occurred: %v\n", err)
-		return
+		return nil, err
 	}
 
-	// check status code
-	fmt.Println(rply)
 	switch rply.StatusCode {
-	case "226", "250":
-		// retr complete, continue
-	case "425", "426", "550":
-		// software error
-		fmt.Println("Command failed.")
-		return
+	case StatusClosingDataConnection, StatusRequestedFileActionOK:
+		// success, parse listing
+		return parseList(list)
 	default:
-		c.closeAndExit("Unrecognized reply, exiting.")
+		return nil, fmt.Errorf("list command failed: %w", newReplyError(rply))
 	}
+}
 
-	// write file
-	if err := ioutil.WriteFile(path.Base(file), bytes, 0644); err != nil {
-		fmt.Printf("Failed to write file: %v\n", err)
+// CommandGet retrieves file from the server using the RETR command. The file is
+// saved to the local path dest, or under its own name in dest if it is a directory.
+// If dest is empty the file is saved to the local current directory. An existing
+// local file is only replaced if force is set or the user agrees to it. Unless the
+// client is quiet, the progress of the transfer is printed as it is received.
+func (c *Client) CommandGet(file, dest string, force bool) {
+	dest = c.getDest(file, dest)
+	if !c.confirmOverwrite(dest, force) {
 		return
 	}
+
+	if err := c.retrieve(file, dest); err != nil {
+		fmt.Println(err)
+	}
 }
 
-// CommandHELP asks the server to return it's supported commands
-func (c *Client) CommandHELP() {
-	rply, err := c.control.getReplyForCommand(newCommand(CommandHELP, ""))
-	if err != nil {
-		fmt.Printf("An unexpected error occurred: %v\n", err)
-		return
+// confirmOverwrite reports whether a download may be written to dest. If a file
+// already exists there and neither force nor the overwrite option is set, the user
+// is asked, or the download is skipped when the input is not a terminal.
+func (c *Client) confirmOverwrite(dest string, force bool) bool {
+	if force || c.overwrite {
+		return true
 	}
 
-	// check status code
-	fmt.Println(rply)
-	switch rply.StatusCode {
-	case "211", "214":
-		// success, noop
-	case "500", "502":
-		// software error
-		fmt.Println("Command failed.")
-	case "501":
-		// user error
-		fmt.Println("Error in parameters.")
-	case "421":
-		// server closed connection
-		c.closeAndExit("Exiting.")
-	default:
-		c.closeAndExit("Unrecognized reply, exiting.")
+	if _, err := os.Lstat(dest); err != nil {
+		return true
 	}
-}
 
-// CommandExit issues a goodbye command to the server and exits the process
-func (c *Client) CommandExit() {
-	rply, err := c.control.getReplyForCommand(newCommand(CommandQUIT, ""))
+	if !isTerminal() {
+		fmt.Printf("Skipping %s: local file exists, use get -f to overwrite it\n", dest)
+		return false
+	}
+
+	fmt.Printf("Overwrite %s? [y/N] ", dest)
+	answer, err := c.in.ReadString('\n')
 	if err != nil {
-		fmt.Printf("An unexpected error occurred: %v\n", err)
-	} else {
-		fmt.Println(rply)
+		return false
 	}
 
-	os.Exit(0)
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	default:
+		fmt.Printf("Skipping %s\n", dest)
+		return false
+	}
 }
 
-// getPORTString transforms host and port into an argument string for the PORT command
-func getPORTString(host, port string) (string, error) {
-	hostBytes := strings.Split(host, ".")
-
-	// ensure host is in proper format
-	if len(hostBytes) != 4 {
-		return "", fmt.Errorf("Invalid address: %s:%s", host, port)
+// getDest returns the local path a remote file is downloaded to for the
+// destination given by the user
+func (c *Client) getDest(file, dest string) string {
+	if dest == "" {
+		return c.localPath(path.Base(file))
 	}
 
-	// make sure port is in range
-	var intPort uint16
-	fmt.Sscanf(port, "%d", &intPort)
-	if intPort > math.MaxUint16 {
-		return "", fmt.Errorf("Invalid port: %s:%s", host, port)
+	dest = c.localPath(dest)
+	if info, err := os.Stat(dest); err == nil && info.IsDir() {
+		return filepath.Join(dest, path.Base(file))
 	}
 
-	// calculate port bytes
-	portBytes := new([2]uint16)
-	portBytes[0] = intPort & 255
-	portBytes[1] = intPort >> 8
-
-	//convert to string
-	portStrs := new([2]string)
-	portStrs[0] = fmt.Sprintf("%d", portBytes[0])
-	portStrs[1] = fmt.Sprintf("%d", portBytes[1])
+	return dest
+}
 
-	// builld string
-	addrString := ""
-	for _, s := range hostBytes {
-		addrString += s + ","
+// retrieve downloads the remote file to the local path dest, split across several
+// connections if the client is set up for segmented downloads
+func (c *Client) retrieve(file, dest string) error {
+	// the size is needed to split the file, to report progress against, and to
+	// tell a download cut short from a complete one when resuming
+	total := int64(-1)
+	if !c.quiet || c.canResume() || (c.segments > 1 && c.Supports("SIZE")) {
+		if size, err := c.CommandSIZE(file); err == nil {
+			total = size
+		}
 	}
 
-	addrString += portStrs[1] + "," + portStrs[0]
-	return addrString, nil
-}
+	segmented, err := c.retrieveSegmented(file, dest, total)
+	if !segmented {
+		err = c.retrieveStream(file, dest, total)
+	}
+	if err != nil {
+		return err
+	}
 
-// getEPRTString transforms host and port into an argument string for the EPRT command
-func getEPRTString(host, port string) (string, error) {
-	// get ip type
-	ip := net.ParseIP(host)
-	if ip == nil {
-		return "", fmt.Errorf("unrecognized IP address: %s", host)
+	if c.preserveTimes {
+		c.preserveModTime(file, dest)
 	}
 
-	// determing protocol type
-	var proto string
-	if ip.To4() != nil {
-		proto = "1"
-	} else {
-		proto = "2"
-		// ftp servers seem to not like the IPv6 localhost address (::1)
-		if ip.IsLoopback() {
-			proto = "1"
-			host = "127.0.0.1"
+	// line endings are translated in ascii mode, so the checksums can't match
+	if c.verify && c.transferType == transferTypeBinary {
+		if err := c.verifyChecksum(file, dest); err != nil {
+			return err
 		}
+		fmt.Println("Checksum verified.")
 	}
 
-	// build string
-	return "|" + proto + "|" + host + "|" + port + "|", nil
+	return nil
 }
 
-// parsePASVString takes a return message from a PASV command and returns the
-// address to connect to.
-func parsePASVString(msg string) (string, error) {
-	// according to RFC, data is of the form (datadatadata)
-	// find the index of the '(' and ')'
-	strt := strings.IndexByte(msg, '(')
-	end := strings.IndexByte(msg, ')')
-	if strt == -1 || end == -1 {
-		return "", fmt.Errorf("Invalid PASV message: %s", msg)
+// retrieveStream downloads the remote file to the local path dest over a single
+// data connection, printing the server's replies and the progress of the transfer.
+// total is the size of the remote file, or -1 if it is unknown. If the client
+// resumes broken downloads, a transfer that fails part way through is continued
+// from where it stopped.
+func (c *Client) retrieveStream(file, dest string, total int64) error {
+	// remember where we are in case the connection has to be reopened
+	var dir string
+	if c.canResume() {
+		dir, _ = c.CommandPWD()
 	}
 
-	// split message on ',' character
-	return hostPortToAddr(msg[strt+1 : end])
-}
+	data, err := c.openDataConn()
+	if err != nil {
+		return fmt.Errorf("An unexpected error occurred: %v", err)
+	}
 
+	rply, err := c.control.getReplyForCommand(newCommand(CommandRETR, file))
+	if err != nil {
+		return fmt.Errorf("An unexpected error occurred: %v", err)
+	}
+
+	fmt.Println(rply)
+	var recvErr error
+	switch rply.StatusCode {
+	case StatusAlreadyOpen, StatusAboutToSend:
+		//success, read from data connection into file
+		recvErr = c.receiveFile(data, dest, total)
+		if recvErr == nil && c.canResume() {
+			recvErr = checkComplete(dest, total)
+		}
+	case StatusFileActionIgnored, StatusFileUnavailable, StatusBadCommand, StatusNotImplemented, StatusNotLoggedIn:
+		//software error
+		return fmt.Errorf("%s: %w", file, newReplyError(rply))
+	case StatusBadArguments:
+		// user error
+		return fmt.Errorf("%s: %w", file, newReplyError(rply))
+	case StatusNotAvailable:
+		// server closed connection
+		c.closeAndExit("Exiting.")
+	default:
+		c.closeAndExit("Unrecognized reply, exiting.")
+	}
+
+	// read a reply from the server
+	rply, err = c.control.readReply()
+	if err != nil {
+		err = fmt.Errorf("An unexpected error occurred: %v", err)
+		if c.canResume() {
+			return c.resumeRetrieve(file, dest, dir, total, err)
+		}
+		return err
+	}
+
+	// check status code
+	fmt.Println(rply)
+	switch rply.StatusCode {
+	case StatusClosingDataConnection, StatusRequestedFileActionOK:
+		// retr complete, continue
+	case StatusCanNotOpenDataConnection, StatusTransferAborted, StatusActionAborted, StatusFileUnavailable:
+		// software error, resume or discard partial file
+		err = fmt.Errorf("%s: %w", file, newReplyError(rply))
+		if c.canResume() && rply.StatusCode != StatusFileUnavailable {
+			return c.resumeRetrieve(file, dest, dir, total, err)
+		}
+		os.Remove(dest)
+		return err
+	default:
+		c.closeAndExit("Unrecognized reply, exiting.")
+	}
+
+	if recvErr != nil {
+		recvErr = fmt.Errorf("%s: %v", file, recvErr)
+		if c.canResume() {
+			return c.resumeRetrieve(file, dest, dir, total, recvErr)
+		}
+		return recvErr
+	}
+
+	return nil
+}
+
+// errRangeComplete stops a download once the requested range has been received
+var errRangeComplete = errors.New("range complete")
+
+// rangeWriter passes the first n bytes written to it on to w, failing with
+// errRangeComplete once bytes beyond them are written. A range that ends with
+// the file is therefore received without error.
+type rangeWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (r *rangeWriter) Write(p []byte) (int, error) {
+	past := int64(len(p)) > r.n
+	if past {
+		p = p[:r.n]
+	}
+
+	n, err := r.w.Write(p)
+	r.n -= int64(n)
+	if err == nil && past {
+		err = errRangeComplete
+	}
+	return n, err
+}
+
+// DownloadRange writes n bytes of the remote file starting at offset off to w. The
+// transfer is restarted at off with REST, and once n bytes have been received the
+// data connection is closed and the rest of the transfer aborted with ABOR. Fewer
+// bytes are written if the file ends first. Offsets count the bytes sent by the
+// server, so ranges can only be downloaded in binary mode.
+func (c *Client) DownloadRange(remote string, off, n int64, w io.Writer) error {
+	if c.transferType != transferTypeBinary {
+		return errors.New("byte ranges can only be downloaded in binary mode")
+	}
+	if off < 0 || n < 0 {
+		return fmt.Errorf("invalid range: %d bytes at offset %d", n, off)
+	}
+	if n == 0 {
+		return nil
+	}
+
+	data, err := c.openDataConn()
+	if err != nil {
+		return err
+	}
+	defer data.close()
+
+	// REST must come right before the transfer it applies to
+	if err := c.CommandREST(off); err != nil {
+		return err
+	}
+
+	rply, err := c.control.getReplyForCommand(newCommand(CommandRETR, remote))
+	if err != nil {
+		return err
+	}
+
+	var recvErr error
+	switch rply.StatusCode {
+	case StatusAlreadyOpen, StatusAboutToSend:
+		// success, read the range from the data connection
+		_, recvErr = data.readTo(&rangeWriter{w: w, n: n})
+	case StatusNotAvailable:
+		// server closed connection
+		fmt.Println(rply)
+		c.closeAndExit("Exiting.")
+	default:
+		return fmt.Errorf("%s: %w", remote, newReplyError(rply))
+	}
+
+	// the transfer fails on the server if we stopped reading before the end
+	stopped := errors.Is(recvErr, errRangeComplete)
+	rply, err = c.control.readReply()
+	if err != nil {
+		return err
+	}
+
+	aborted := false
+	switch rply.StatusCode {
+	case StatusClosingDataConnection, StatusRequestedFileActionOK:
+		// transfer complete
+	case StatusTransferAborted, StatusActionAborted:
+		if !stopped {
+			return fmt.Errorf("%s: %w", remote, newReplyError(rply))
+		}
+		aborted = true
+	case StatusNotAvailable:
+		// server closed connection
+		fmt.Println(rply)
+		c.closeAndExit("Exiting.")
+	default:
+		return fmt.Errorf("%s: %w", remote, newReplyError(rply))
+	}
+
+	if recvErr != nil && !stopped {
+		return fmt.Errorf("%s: %v", remote, recvErr)
+	}
+
+	// the server only needs ABOR if it failed the transfer we cut short; if it
+	// finished sending first, ABOR would leave an extra reply on the control
+	// connection
+	if aborted {
+		return c.CommandABOR()
+	}
+	return nil
+}
+
+// preserveModTime sets the modification time of the local file dest to that of
+// the remote file. Nothing is done if the server can't report the time.
+func (c *Client) preserveModTime(file, dest string) {
+	if c.features != nil && !c.features.MDTM {
+		return
+	}
+
+	t, err := c.CommandMDTM(file)
+	if err != nil {
+		return
+	}
+
+	if err := os.Chtimes(dest, t, t); err != nil {
+		fmt.Printf("%s: failed to set modification time: %v\n", dest, err)
+	}
+}
+
+// receiveFile reads from the data connection into the local file dest, printing
+// progress against total unless the client is quiet. If the file cannot be
+// written the data is still read so the server can complete the transfer.
+func (c *Client) receiveFile(data clientDataConn, dest string, total int64) error {
+	f, err := os.Create(dest)
+	if err != nil {
+		data.readTo(ioutil.Discard)
+		return fmt.Errorf("failed to write file: %v", err)
+	}
+	defer f.Close()
+
+	var w io.Writer = f
+	var pw *progressWriter
+	if !c.quiet {
+		pw = newProgressWriter(f, os.Stdout, total)
+		w = pw
+	}
+
+	// decode line endings in ascii mode
+	var cw *crlfWriter
+	if c.transferType == transferTypeASCII {
+		cw = &crlfWriter{w: w}
+		w = cw
+	}
+
+	_, err = data.readTo(w)
+	if err == nil && cw != nil {
+		err = cw.Flush()
+	}
+	if pw != nil {
+		pw.finish()
+	}
+	return err
+}
+
+// CommandPut uploads the local file to the server using the STOR command. The file
+// is stored under the same name in the remote current directory. Unless the client
+// is quiet, the progress of the transfer is printed as it is sent.
+func (c *Client) CommandPut(file string) {
+	if err := c.store(c.localPath(file), filepath.Base(file)); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// CommandAppend uploads the local file to the server using the APPE command,
+// appending it to the remote file, which is created if it doesn't exist
+func (c *Client) CommandAppend(local, remote string) {
+	if err := c.upload(CommandAPPE, c.localPath(local), remote); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// store uploads the local file src to the remote path file, replacing it, and
+// printing the server's replies and the progress of the transfer
+func (c *Client) store(src, file string) error {
+	return c.upload(CommandSTOR, src, file)
+}
+
+// upload sends the local file src to the remote path file with code, which is
+// either STOR or APPE
+func (c *Client) upload(code CommandCode, src, file string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("%s: %v", src, err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("%s: %v", src, err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s: not a regular file", src)
+	}
+
+	data, err := c.openDataConn()
+	if err != nil {
+		return fmt.Errorf("An unexpected error occurred: %v", err)
+	}
+
+	rply, err := c.control.getReplyForCommand(newCommand(code, file))
+	if err != nil {
+		return fmt.Errorf("An unexpected error occurred: %v", err)
+	}
+
+	fmt.Println(rply)
+	var sendErr error
+	switch rply.StatusCode {
+	case StatusAlreadyOpen, StatusAboutToSend:
+		//success, write file to data connection
+		sendErr = c.sendFile(data, f, info.Size())
+	case StatusFileActionIgnored, StatusInsufficientStorageSpace, StatusStorNeedAccount, StatusFileUnavailable, StatusBadFileName, StatusBadCommand, StatusNotImplemented, StatusNotLoggedIn:
+		//software error
+		return fmt.Errorf("%s: %w", file, newReplyError(rply))
+	case StatusBadArguments:
+		// user error
+		return fmt.Errorf("%s: %w", file, newReplyError(rply))
+	case StatusNotAvailable:
+		// server closed connection
+		c.closeAndExit("Exiting.")
+	default:
+		c.closeAndExit("Unrecognized reply, exiting.")
+	}
+
+	// read a reply from the server
+	rply, err = c.control.readReply()
+	if err != nil {
+		return fmt.Errorf("An unexpected error occurred: %v", err)
+	}
+
+	// check status code
+	fmt.Println(rply)
+	switch rply.StatusCode {
+	case StatusClosingDataConnection, StatusRequestedFileActionOK:
+		// upload complete, continue
+	case StatusCanNotOpenDataConnection, StatusTransferAborted, StatusActionAborted, StatusInsufficientStorageSpace, StatusPageTypeUnknown, StatusExceededStorage:
+		// software error
+		return fmt.Errorf("%s: %w", file, newReplyError(rply))
+	default:
+		c.closeAndExit("Unrecognized reply, exiting.")
+	}
+
+	if sendErr != nil {
+		return fmt.Errorf("%s: %v", file, sendErr)
+	}
+
+	// appending leaves the remote file with a newer time than the local one
+	if c.preserveTimes && code == CommandSTOR && (c.features == nil || c.features.Supports("MFMT")) {
+		if err := c.CommandMFMT(file, info.ModTime()); err != nil && c.features != nil {
+			fmt.Printf("%s: failed to set modification time: %v\n", file, err)
+		}
+	}
+
+	return nil
+}
+
+// sendFile writes r to the data connection, printing progress against total
+// unless the client is quiet
+func (c *Client) sendFile(data clientDataConn, r io.Reader, total int64) error {
+	// encode line endings in ascii mode
+	encode := func(r io.Reader) io.Reader { return r }
+	if c.transferType == transferTypeASCII {
+		encode = func(r io.Reader) io.Reader { return newCRLFReader(r) }
+	}
+
+	if c.quiet {
+		_, err := data.writeFrom(encode(r))
+		return err
+	}
+
+	pw := newProgressWriter(ioutil.Discard, os.Stdout, total)
+	_, err := data.writeFrom(encode(io.TeeReader(r, pw)))
+	pw.finish()
+	return err
+}
+
+// CommandMkdir creates a directory on the server using the MKD command
+func (c *Client) CommandMkdir(dir string) {
+	if err := c.makeDir(dir); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// makeDir creates the remote directory dir, printing the server's reply. A 550
+// reply is returned as errRemoteExists since servers use it when the directory
+// is already there.
+func (c *Client) makeDir(dir string) error {
+	rply, err := c.control.getReplyForCommand(newCommand(CommandMKD, dir))
+	if err != nil {
+		return fmt.Errorf("An unexpected error occurred: %v", err)
+	}
+
+	// check status code
+	fmt.Println(rply)
+	switch rply.StatusCode {
+	case StatusPathCreated:
+		// success, noop
+	case StatusFileUnavailable:
+		// the directory may already exist
+		return fmt.Errorf("%s: %w: %w", dir, errRemoteExists, newReplyError(rply))
+	case StatusBadCommand, StatusNotImplemented, StatusNotLoggedIn:
+		// software error
+		return fmt.Errorf("%s: %w", dir, newReplyError(rply))
+	case StatusBadArguments:
+		// user error
+		return fmt.Errorf("%s: %w", dir, newReplyError(rply))
+	case StatusNotAvailable:
+		// server closed connection
+		c.closeAndExit("Exiting.")
+	default:
+		c.closeAndExit("Unrecognized reply, exiting.")
+	}
+
+	return nil
+}
+
+// CommandFEAT asks the server for the extensions it supports and stores them on
+// the client. A server which does not implement FEAT supports no extensions.
+func (c *Client) CommandFEAT() (*Features, error) {
+	rply, err := c.control.getReplyForCommand(newCommand(CommandFEAT, ""))
+	if err != nil {
+		return nil, err
+	}
+
+	// check status code
+	switch rply.StatusCode {
+	case StatusSystem:
+		// okay, parse features
+		c.features = parseFeatures(rply.Message)
+	case StatusBadCommand, StatusNotImplemented:
+		// not implemented, no features
+		c.features = parseFeatures("")
+	default:
+		return nil, fmt.Errorf("feat command failed: %w", newReplyError(rply))
+	}
+
+	return c.features, nil
+}
+
+// CommandOPTS sets an option on the server, such as "UTF8 ON"
+func (c *Client) CommandOPTS(opt string) error {
+	rply, err := c.control.getReplyForCommand(newCommand(CommandOPTS, opt))
+	if err != nil {
+		return err
+	}
+
+	// check status code
+	switch rply.StatusCode {
+	case StatusCommandOK:
+		// okay
+		return nil
+	case StatusActionAborted, StatusBadCommand, StatusBadArguments, StatusNotImplemented, StatusNotImplementedParameter:
+		// not supported
+		return fmt.Errorf("opts %s failed: %w", opt, newReplyError(rply))
+	case StatusNotAvailable:
+		// server closed connection
+		c.closeAndExit("Exiting.")
+	default:
+		c.closeAndExit("Unrecognized reply, exiting.")
+	}
+
+	return errors.New("unexpected error")
+}
+
+// CommandAVBL asks the server how many bytes are available for uploads in dir, or
+// in the current directory if dir is empty
+func (c *Client) CommandAVBL(dir string) {
+	rply, err := c.control.getReplyForCommand(newCommand(CommandAVBL, dir))
+	if err != nil {
+		fmt.Printf("An unexpected error occurred: %v\n", err)
+		return
+	}
+
+	// check status code
+	fmt.Println(rply)
+	switch rply.StatusCode {
+	case StatusFile:
+		// success, noop
+	case StatusBadCommand, StatusNotImplemented, StatusNotLoggedIn, StatusFileUnavailable:
+		// software error
+		fmt.Println("Command failed.")
+	case StatusBadArguments:
+		// user error
+		fmt.Println("Error in parameters.")
+	case StatusNotAvailable:
+		// server closed connection
+		c.closeAndExit("Exiting.")
+	default:
+		c.closeAndExit("Unrecognized reply, exiting.")
+	}
+}
+
+// CommandSIZE asks the server for the size of file in bytes
+func (c *Client) CommandSIZE(file string) (int64, error) {
+	rply, err := c.control.getReplyForCommand(newCommand(CommandSIZE, file))
+	if err != nil {
+		return 0, err
+	}
+
+	return parseSIZEReply(rply)
+}
+
+// CommandSizes asks the server for the sizes of several files at once. The SIZE
+// commands are pipelined, so the round trip to the server is only made once.
+// Files whose size could not be determined are omitted from the result.
+func (c *Client) CommandSizes(files []string) (map[string]int64, error) {
+	cmds := make([]*Command, len(files))
+	for i, file := range files {
+		cmds[i] = newCommand(CommandSIZE, file)
+	}
+
+	replies, err := c.control.pipeline(cmds)
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := make(map[string]int64)
+	for i, rply := range replies {
+		size, err := parseSIZEReply(rply)
+		if err != nil {
+			fmt.Printf("%s: %v\n", files[i], err)
+			continue
+		}
+		sizes[files[i]] = size
+	}
+
+	return sizes, nil
+}
+
+// CommandMFMT sets the modification time of the remote file
+func (c *Client) CommandMFMT(file string, t time.Time) error {
+	rply, err := c.control.getReplyForCommand(newCommand(CommandMFMT, t.UTC().Format(mdtmLayout)+" "+file))
+	if err != nil {
+		return err
+	}
+
+	switch rply.StatusCode {
+	case StatusFile:
+		// okay, time set
+		return nil
+	case StatusNotAvailable:
+		// server closed connection
+		fmt.Println(rply)
+		c.closeAndExit("Exiting.")
+	}
+
+	return fmt.Errorf("mfmt command failed: %w", newReplyError(rply))
+}
+
+// parseSIZEReply returns the size from a reply to the SIZE command
+func parseSIZEReply(rply *Reply) (int64, error) {
+	switch rply.StatusCode {
+	case StatusFile:
+		// okay, parse size
+		var size int64
+		if _, err := fmt.Sscanf(strings.TrimSpace(rply.Message), "%d", &size); err != nil {
+			return 0, fmt.Errorf("invalid SIZE reply: %v", rply)
+		}
+		return size, nil
+	case StatusNotAvailable:
+		// server closed connection
+		return 0, fmt.Errorf("server closed connection: %w", newReplyError(rply))
+	default:
+		return 0, fmt.Errorf("size command failed: %w", newReplyError(rply))
+	}
+}
+
+// CommandMDTM asks the server for the modification time of file
+func (c *Client) CommandMDTM(file string) (time.Time, error) {
+	rply, err := c.control.getReplyForCommand(newCommand(CommandMDTM, file))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	switch rply.StatusCode {
+	case StatusFile:
+		// okay, parse time
+		// some servers append fractional seconds
+		stamp := strings.TrimSpace(rply.Message)
+		if ind := strings.IndexByte(stamp, '.'); ind != -1 {
+			stamp = stamp[:ind]
+		}
+		t, err := time.Parse(mdtmLayout, stamp)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid MDTM reply: %v", rply)
+		}
+		return t, nil
+	case StatusNotAvailable:
+		// server closed connection
+		fmt.Println(rply)
+		c.closeAndExit("Exiting.")
+	}
+
+	return time.Time{}, fmt.Errorf("mdtm command failed: %w", newReplyError(rply))
+}
+
+// CommandREST sets the offset the next transfer starts at
+func (c *Client) CommandREST(offset int64) error {
+	rply, err := c.control.getReplyForCommand(newCommand(CommandREST, strconv.FormatInt(offset, 10)))
+	if err != nil {
+		return err
+	}
+
+	switch rply.StatusCode {
+	case StatusRequestFilePending:
+		// okay, offset set
+		return nil
+	case StatusNotAvailable:
+		// server closed connection
+		fmt.Println(rply)
+		c.closeAndExit("Exiting.")
+	}
+
+	return fmt.Errorf("rest command failed: %w", newReplyError(rply))
+}
+
+// CommandABOR aborts the transfer in progress, or cleans up after one the client
+// stopped reading
+func (c *Client) CommandABOR() error {
+	rply, err := c.control.getReplyForCommand(newCommand(CommandABOR, ""))
+	if err != nil {
+		return err
+	}
+
+	switch rply.StatusCode {
+	case StatusDataConnectionOpen, StatusClosingDataConnection:
+		// okay, nothing left to transfer
+		return nil
+	case StatusNotAvailable:
+		// server closed connection
+		fmt.Println(rply)
+		c.closeAndExit("Exiting.")
+	}
+
+	return fmt.Errorf("abor command failed: %w", newReplyError(rply))
+}
+
+// CommandXCRC asks the server for the CRC32 checksum of file, in hexadecimal
+func (c *Client) CommandXCRC(file string) (string, error) {
+	return c.checksum(CommandXCRC, file)
+}
+
+// CommandXMD5 asks the server for the MD5 checksum of file, in hexadecimal
+func (c *Client) CommandXMD5(file string) (string, error) {
+	return c.checksum(CommandXMD5, file)
+}
+
+// CommandHASH asks the server for the checksum of file using the hash algorithm
+// selected with OPTS HASH. The name of the algorithm and the digest in
+// hexadecimal are returned.
+func (c *Client) CommandHASH(file string) (string, string, error) {
+	rply, err := c.control.getReplyForCommand(newCommand(CommandHASH, file))
+	if err != nil {
+		return "", "", err
+	}
+
+	switch rply.StatusCode {
+	case StatusFile:
+		// okay, the reply is the algorithm, byte range, digest and file name
+		fields := strings.Fields(rply.Message)
+		if len(fields) < 3 {
+			return "", "", fmt.Errorf("invalid HASH reply: %v", rply)
+		}
+		return fields[0], fields[2], nil
+	case StatusNotAvailable:
+		// server closed connection
+		fmt.Println(rply)
+		c.closeAndExit("Exiting.")
+	}
+
+	return "", "", fmt.Errorf("hash command failed: %w", newReplyError(rply))
+}
+
+// checksum issues one of the checksum commands for file and returns the digest
+func (c *Client) checksum(code CommandCode, file string) (string, error) {
+	rply, err := c.control.getReplyForCommand(newCommand(code, file))
+	if err != nil {
+		return "", err
+	}
+
+	switch rply.StatusCode {
+	case StatusRequestedFileActionOK:
+		// okay, the digest is the first word of the message
+		fields := strings.Fields(rply.Message)
+		if len(fields) == 0 {
+			return "", fmt.Errorf("invalid %s reply: %v", code, rply)
+		}
+		return fields[0], nil
+	case StatusNotAvailable:
+		// server closed connection
+		fmt.Println(rply)
+		c.closeAndExit("Exiting.")
+	}
+
+	return "", fmt.Errorf("%s command failed: %w", strings.ToLower(string(code)), newReplyError(rply))
+}
+
+// CommandLCD changes the local working directory to dir. If dir is empty, the
+// user's home directory is used.
+func (c *Client) CommandLCD(dir string) {
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			fmt.Printf("Failed to find home directory: %v\n", err)
+			return
+		}
+		dir = home
+	}
+
+	if err := os.Chdir(c.localPath(dir)); err != nil {
+		fmt.Printf("Failed to change local directory: %v\n", err)
+		return
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		fmt.Printf("Failed to get local directory: %v\n", err)
+		return
+	}
+	c.localDir = wd
+
+	fmt.Printf("Local directory now %s\n", c.localDir)
+}
+
+// CommandLPWD prints the local working directory
+func (c *Client) CommandLPWD() {
+	fmt.Printf("Local directory: %s\n", c.localDir)
+}
+
+// CommandLLS prints a listing of the given local directory, or the local
+// working directory if dir is empty
+func (c *Client) CommandLLS(dir string) {
+	entries, err := os.ReadDir(c.localPath(dir))
+	if err != nil {
+		fmt.Printf("Failed to list local directory: %v\n", err)
+		return
+	}
+
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		fmt.Printf("%s %10d %s %s\n", info.Mode(), info.Size(), info.ModTime().Format("Jan _2 15:04"), info.Name())
+	}
+}
+
+// localPath resolves p relative to the client's local working directory. A
+// leading ~ stands for the user's home directory, as it does in a shell.
+func (c *Client) localPath(p string) string {
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, p[1:])
+		}
+	}
+
+	if filepath.IsAbs(p) {
+		return p
+	}
+
+	return filepath.Join(c.localDir, p)
+}
+
+// clientName identifies the client to servers with the CLNT command
+const clientName = "goftp/1.0"
+
+// CommandCLNT identifies the client to the server. The reply is not printed, as
+// many servers don't implement the command.
+func (c *Client) CommandCLNT() error {
+	rply, err := c.control.getReplyForCommand(newCommand(CommandCLNT, clientName))
+	if err != nil {
+		return err
+	}
+
+	if rply.StatusCode == StatusNotAvailable {
+		// server closed connection
+		fmt.Println(rply)
+		c.closeAndExit("Exiting.")
+	}
+
+	return nil
+}
+
+// CommandHELP asks the server to return it's supported commands, or the syntax of
+// the named command if one is given
+func (c *Client) CommandHELP(command string) {
+	rply, err := c.control.getReplyForCommand(newCommand(CommandHELP, command))
+	if err != nil {
+		fmt.Printf("An unexpected error occurred: %v\n", err)
+		return
+	}
+
+	// check status code
+	fmt.Println(rply)
+	switch rply.StatusCode {
+	case StatusSystem, StatusHelp:
+		// success, noop
+	case StatusBadCommand, StatusNotImplemented, StatusNotImplementedParameter:
+		// software error
+		fmt.Println("Command failed.")
+	case StatusBadArguments:
+		// user error
+		fmt.Println("Error in parameters.")
+	case StatusNotAvailable:
+		// server closed connection
+		c.closeAndExit("Exiting.")
+	default:
+		c.closeAndExit("Unrecognized reply, exiting.")
+	}
+}
+
+// CommandReinit resets the session with the REIN command and logs in again. The
+// credentials are always asked for, so that another user can log in over the same
+// connection.
+func (c *Client) CommandReinit() {
+	rply, err := c.control.getReplyForCommand(newCommand(CommandREIN, ""))
+	if err != nil {
+		fmt.Printf("An unexpected error occurred: %v\n", err)
+		return
+	}
+
+	// check status code
+	fmt.Println(rply)
+	switch rply.StatusCode {
+	case StatusReady:
+		// success, noop
+	case StatusReadyMinute:
+		// server not ready, wait for 220
+		rply, err = c.control.readReply()
+		if err != nil {
+			fmt.Printf("An unexpected error occurred: %v\n", err)
+			return
+		}
+
+		fmt.Println(rply)
+		if rply.StatusCode != StatusReady {
+			fmt.Println("Reinitialization failed.")
+			return
+		}
+	case StatusBadCommand, StatusNotImplemented:
+		// software error
+		fmt.Println("Command failed.")
+		return
+	case StatusNotAvailable:
+		// server closed connection
+		c.closeAndExit("Exiting.")
+	default:
+		c.closeAndExit("Unrecognized reply, exiting.")
+	}
+
+	// the server has returned to its defaults
+	c.compressed = false
+
+	c.user, c.password, c.account = "", "", ""
+	if err := c.logIn(); err != nil {
+		c.closeAndExit(err.Error())
+	}
+
+	if err := c.CommandTYPE(transferTypeBinary); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// CommandDebug toggles printing the commands sent to the server and the raw
+// replies received, for diagnosing protocol problems
+func (c *Client) CommandDebug() {
+	c.control.debug = !c.control.debug
+	if c.control.debug {
+		fmt.Println("Debugging on.")
+	} else {
+		fmt.Println("Debugging off.")
+	}
+}
+
+// CommandExit issues a goodbye command to the server and exits the process
+func (c *Client) CommandExit() {
+	rply, err := c.control.getReplyForCommand(newCommand(CommandQUIT, ""))
+	if err != nil {
+		fmt.Printf("An unexpected error occurred: %v\n", err)
+	} else {
+		fmt.Println(rply)
+	}
+
+	os.Exit(0)
+}
+
+// getPORTString transforms host and port into an argument string for the PORT command
+func getPORTString(host, port string) (string, error) {
+	hostBytes := strings.Split(host, ".")
+
+	// ensure host is in proper format
+	if len(hostBytes) != 4 {
+		return "", fmt.Errorf("Invalid address: %s:%s", host, port)
+	}
+
+	// make sure port is in range
+	var intPort uint16
+	fmt.Sscanf(port, "%d", &intPort)
+	if intPort > math.MaxUint16 {
+		return "", fmt.Errorf("Invalid port: %s:%s", host, port)
+	}
+
+	// calculate port bytes
+	portBytes := new([2]uint16)
+	portBytes[0] = intPort & 255
+	portBytes[1] = intPort >> 8
+
+	//convert to string
+	portStrs := new([2]string)
+	portStrs[0] = fmt.Sprintf("%d", portBytes[0])
+	portStrs[1] = fmt.Sprintf("%d", portBytes[1])
+
+	// builld string
+	addrString := ""
+	for _, s := range hostBytes {
+		addrString += s + ","
+	}
+
+	addrString += portStrs[1] + "," + portStrs[0]
+	return addrString, nil
+}
+
+// getEPRTString transforms host and port into an argument string for the EPRT command
+func getEPRTString(host, port string) (string, error) {
+	// get ip type
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", fmt.Errorf("unrecognized IP address: %s", host)
+	}
+
+	// determing protocol type
+	var proto string
+	if ip.To4() != nil {
+		proto = "1"
+	} else {
+		proto = "2"
+		// ftp servers seem to not like the IPv6 localhost address (::1)
+		if ip.IsLoopback() {
+			proto = "1"
+			host = "127.0.0.1"
+		}
+	}
+
+	// build string
+	return "|" + proto + "|" + host + "|" + port + "|", nil
+}
+
+// pasvTupleRegex matches the h1,h2,h3,h4,p1,p2 address tuple of a PASV reply
+var pasvTupleRegex = regexp.MustCompile(`\d{1,3}\s*,\s*\d{1,3}\s*,\s*\d{1,3}\s*,\s*\d{1,3}\s*,\s*\d{1,3}\s*,\s*\d{1,3}`)
+
+// parsePASVString takes a return message from a PASV command and returns the
+// address to connect to. Servers vary in how they present the address, so the
+// first h1,h2,h3,h4,p1,p2 tuple anywhere in the message is used.
+func parsePASVString(msg string) (string, error) {
+	// according to RFC, data is of the form (datadatadata), but some servers
+	// omit the parentheses or include other parenthesized text
+	tuple := pasvTupleRegex.FindString(msg)
+	if tuple == "" {
+		return "", fmt.Errorf("Invalid PASV message, no address found: %s", strings.TrimSpace(msg))
+	}
+
+	return hostPortToAddr(strings.Replace(tuple, " ", "", -1))
+}
+
+// hostPortToAddr converts an h1,h2,h3,h4,p1,p2 tuple to a host:port address. Each
+// field must be a number from 0 to 255 and the port must not be 0.
 func hostPortToAddr(hostPort string) (string, error) {
 	// split message on ',' character
 	data := strings.Split(hostPort, ",")
@@ -543,34 +1770,136 @@ func hostPortToAddr(hostPort string) (string, error) {
 		return "", fmt.Errorf("invalid argument: %s", hostPort)
 	}
 
-	// build ip address
-	host := data[0] + "." + data[1] + "." + data[2] + "." + data[3]
+	// convert every field to a byte
+	var fields [6]int
+	for i, d := range data {
+		n, err := strconv.Atoi(d)
+		if err != nil || n < 0 || n > 255 {
+			return "", fmt.Errorf("invalid address field %q in %s", d, hostPort)
+		}
+		fields[i] = n
+	}
 
-	// convert port parameters to numeric values
-	portData := new([2]uint16)
-	fmt.Sscanf(data[4], "%d", &portData[0])
-	fmt.Sscanf(data[5], "%d", &portData[1])
+	// build ip address
+	host := fmt.Sprintf("%d.%d.%d.%d", fields[0], fields[1], fields[2], fields[3])
 
 	// calculate actual port
-	port := portData[0]*256 + portData[1]
-	if port > math.MaxUint16 {
+	port := fields[4]*256 + fields[5]
+	if port == 0 {
+		return "", fmt.Errorf("port out of range: %d", port)
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+// getLongAddrString encodes host and port in the RFC 1639 long address format used
+// by LPRT and LPSV: af,hal,h1,...,hN,pal,p1,p2, where af is 4 or 6 and hal is the
+// length of the address in bytes
+func getLongAddrString(host, port string) (string, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", fmt.Errorf("invalid ip address: %s", host)
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 1 || p > math.MaxUint16 {
+		return "", fmt.Errorf("invalid port: %s", port)
+	}
+
+	fields := []string{"6", "16"}
+	if ip4 := ip.To4(); ip4 != nil {
+		fields = []string{"4", "4"}
+		ip = ip4
+	}
+	for _, b := range ip {
+		fields = append(fields, strconv.Itoa(int(b)))
+	}
+	fields = append(fields, "2", strconv.Itoa(p>>8), strconv.Itoa(p&0xff))
+
+	return strings.Join(fields, ","), nil
+}
+
+// longAddrToAddr converts an RFC 1639 long address to a host:port address. Address
+// families other than IPv4 and IPv6 are rejected with errInvalidAddrFamily.
+func longAddrToAddr(longAddr string) (string, error) {
+	data := strings.Split(longAddr, ",")
+	var fields []int
+	for _, d := range data {
+		n, err := strconv.Atoi(strings.TrimSpace(d))
+		if err != nil || n < 0 || n > 255 {
+			return "", fmt.Errorf("invalid address field %q in %s", d, longAddr)
+		}
+		fields = append(fields, n)
+	}
+
+	if len(fields) < 2 {
+		return "", fmt.Errorf("invalid argument: %s", longAddr)
+	}
+	af, hal := fields[0], fields[1]
+	if !(af == 4 && hal == net.IPv4len) && !(af == 6 && hal == net.IPv6len) {
+		return "", errInvalidAddrFamily
+	}
+
+	// the address is followed by a two byte port
+	if len(fields) != 2+hal+3 || fields[2+hal] != 2 {
+		return "", fmt.Errorf("invalid argument: %s", longAddr)
+	}
+
+	ip := make(net.IP, hal)
+	for i := range ip {
+		ip[i] = byte(fields[2+i])
+	}
+	port := fields[3+hal]*256 + fields[4+hal]
+	if port == 0 {
 		return "", fmt.Errorf("port out of range: %d", port)
 	}
 
-	return net.JoinHostPort(host, fmt.Sprintf("%d", port)), nil
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port)), nil
+}
+
+// lpsvRegex matches the parenthesized long address of an LPSV reply
+var lpsvRegex = regexp.MustCompile(`\(([\d\s,]+)\)`)
+
+// parseLPSVString takes a message returned by an LPSV command and returns the
+// address to connect to
+func parseLPSVString(msg string) (string, error) {
+	match := lpsvRegex.FindStringSubmatch(msg)
+	if match == nil {
+		return "", fmt.Errorf("Invalid LPSV message, no address found: %s", strings.TrimSpace(msg))
+	}
+
+	return longAddrToAddr(match[1])
 }
 
+// epsvRegex matches the (<d><d><d>port<d>) address of an EPSV reply, with the
+// delimiter captured so that it can be checked, as RE2 has no backreferences
+var epsvRegex = regexp.MustCompile(`\(([!-~])([!-~])([!-~])([^()]*?)([!-~])\)`)
+
 // parseEPSVString takes a message returned by a EPSV command and returns
-// the port specified by the server
+// the port specified by the server. The whole message is searched, so the
+// address may be on any line of a multi-line reply.
 func parseEPSVString(msg string) (string, error) {
-	// according to the RFC, data is of the form (datadatadata)
-	// get index of '(' and ')'
-	strt := strings.IndexByte(msg, '(')
-	end := strings.IndexByte(msg, ')')
-	if strt == -1 || end == -1 {
-		return "", fmt.Errorf("Invalid EPSV message: %s", msg)
+	// according to the RFC, data is of the form (|||port|), where the server
+	// may choose any printable character in place of |
+	var portStr string
+	found := false
+	for _, match := range epsvRegex.FindAllStringSubmatch(msg, -1) {
+		d := match[1]
+		if match[2] == d && match[3] == d && match[5] == d && !strings.Contains(match[4], d) {
+			portStr = match[4]
+			found = true
+			break
+		}
+	}
+	if !found {
+		return "", fmt.Errorf("Invalid EPSV message: %s", strings.TrimSpace(msg))
+	}
+
+	// the port must be a plain decimal number in range
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > math.MaxUint16 || strconv.Itoa(port) != portStr {
+		return "", fmt.Errorf("Invalid EPSV message, bad port %q: %s", portStr, strings.TrimSpace(msg))
 	}
 
-	// trim off the '|'s surrounding port number
-	return strings.Trim(msg[strt+1:end], "|"), nil
+	return portStr, nil
 }
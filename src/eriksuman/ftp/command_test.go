@@ -0,0 +1,166 @@
+package ftp
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParsePASVString(t *testing.T) {
+	for _, tt := range []struct {
+		name, msg, want string
+	}{
+		{"rfc", "Entering Passive Mode (192,168,1,2,19,137).", "192.168.1.2:5001"},
+		{"vsftpd", "Entering Passive Mode (10,0,0,5,156,64).", "10.0.0.5:40000"},
+		{"iis", "Entering Passive Mode (127,0,0,1,4,1)", "127.0.0.1:1025"},
+		{"no parentheses", "Entering Passive Mode 192,168,1,2,19,137", "192.168.1.2:5001"},
+		{"spaces", "Entering Passive Mode (192, 168, 1, 2, 19, 137)", "192.168.1.2:5001"},
+		{"extra parenthesized text", "Entering Passive Mode (PASV) (192,168,1,2,19,137) (ok)", "192.168.1.2:5001"},
+		{"equals", "Entering Passive Mode =192,168,1,2,19,137", "192.168.1.2:5001"},
+	} {
+		got, err := parsePASVString(tt.msg)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: parsePASVString(%q) = %q, %v, want %q", tt.name, tt.msg, got, err, tt.want)
+		}
+	}
+
+	for _, msg := range []string{
+		"Entering Passive Mode.",
+		"Entering Passive Mode (192,168,1,2,19).",
+		"Entering Passive Mode (192,168,1,256,19,137).",
+		"Entering Passive Mode (192,168,1,2,0,0).",
+	} {
+		if got, err := parsePASVString(msg); err == nil {
+			t.Errorf("parsePASVString(%q) = %q, want an error", msg, got)
+		}
+	}
+}
+
+func TestParseMalformedPassiveReplies(t *testing.T) {
+	for _, tt := range []struct {
+		name, msg, want string
+	}{
+		{"port out of range", "Entering Extended Passive Mode (|||70000|)", `bad port "70000"`},
+		{"port zero", "Entering Extended Passive Mode (|||0|)", `bad port "0"`},
+		{"non-numeric port", "Entering Extended Passive Mode (|||6a46|)", `bad port "6a46"`},
+		{"signed port", "Entering Extended Passive Mode (|||+6446|)", `bad port "+6446"`},
+		{"empty port", "Entering Extended Passive Mode (||||)", `bad port ""`},
+		{"mixed delimiters", "Entering Extended Passive Mode (||!6446|)", "Invalid EPSV message"},
+		{"no port", "Entering Extended Passive Mode", "Invalid EPSV message"},
+	} {
+		port, err := parseEPSVString(tt.msg)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: parseEPSVString(%q) = %q, %v, want an error containing %q", tt.name, tt.msg, port, err, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		name, msg, want string
+	}{
+		{"port field out of range", "Entering Passive Mode (127,0,0,1,256,1)", `invalid address field "256"`},
+		{"host field out of range", "Entering Passive Mode (127,0,0,999,4,1)", `invalid address field "999"`},
+		{"port zero", "Entering Passive Mode (127,0,0,1,0,0)", "port out of range"},
+		{"no address", "Entering Passive Mode", "no address found"},
+	} {
+		addr, err := parsePASVString(tt.msg)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: parsePASVString(%q) = %q, %v, want an error containing %q", tt.name, tt.msg, addr, err, tt.want)
+		}
+	}
+}
+
+func TestParseEPSVDelimiters(t *testing.T) {
+	for _, msg := range []string{
+		"Entering Extended Passive Mode (|||6446|)",
+		"Entering Extended Passive Mode (!!!6446!)",
+		"Entering Extended Passive Mode (###6446#)",
+		"Entering Extended Passive Mode (%%%6446%).",
+		"Entering Extended Passive Mode (ok) (!!!6446!)",
+	} {
+		if port, err := parseEPSVString(msg); err != nil || port != "6446" {
+			t.Errorf("parseEPSVString(%q) = %q, %v, want 6446", msg, port, err)
+		}
+	}
+
+	// the port can't contain the delimiter, and every delimiter must match
+	for _, msg := range []string{
+		"Entering Extended Passive Mode (!!!64!6!)",
+		"Entering Extended Passive Mode (###6446!)",
+		"Entering Extended Passive Mode (!#!6446!)",
+	} {
+		if port, err := parseEPSVString(msg); err == nil {
+			t.Errorf("parseEPSVString(%q) = %q, want an error", msg, port)
+		}
+	}
+}
+
+func TestParsePWDReply(t *testing.T) {
+	for _, tt := range []struct{ msg, want string }{
+		{`"/home/user" is the current directory.`, "/home/user"},
+		{`"/home/say ""hi""" is the current directory.`, `/home/say "hi"`},
+		{`"/""" created.`, `/"`},
+		{`Current directory is "/tmp".`, "/tmp"},
+		{`"/" is current`, "/"},
+	} {
+		if got, err := parsePWDReply(tt.msg); err != nil || got != tt.want {
+			t.Errorf("parsePWDReply(%q) = %q, %v, want %q", tt.msg, got, err, tt.want)
+		}
+	}
+
+	for _, msg := range []string{"/home/user is the current directory.", `"/home/user`, `"/say ""hi""`} {
+		if got, err := parsePWDReply(msg); err == nil {
+			t.Errorf("parsePWDReply(%q) = %q, want an error", msg, got)
+		}
+	}
+}
+
+func TestLongAddr(t *testing.T) {
+	for _, tt := range []struct {
+		name, host, port, longAddr string
+	}{
+		{"ipv4", "192.168.1.2", "5001", "4,4,192,168,1,2,2,19,137"},
+		{"ipv6", "2001:db8::1", "40000", "6,16,32,1,13,184,0,0,0,0,0,0,0,0,0,0,0,1,2,156,64"},
+	} {
+		got, err := getLongAddrString(tt.host, tt.port)
+		if err != nil || got != tt.longAddr {
+			t.Errorf("%s: getLongAddrString(%q, %q) = %q, %v, want %q", tt.name, tt.host, tt.port, got, err, tt.longAddr)
+		}
+
+		addr, err := longAddrToAddr(tt.longAddr)
+		if want := net.JoinHostPort(tt.host, tt.port); err != nil || addr != want {
+			t.Errorf("%s: longAddrToAddr(%q) = %q, %v, want %q", tt.name, tt.longAddr, addr, err, want)
+		}
+	}
+
+	for _, tt := range []struct {
+		name, longAddr string
+	}{
+		{"ipv4 with the ipv6 length", "4,16,192,168,1,2,2,19,137"},
+		{"ipv6 with the ipv4 length", "6,4,32,1,13,184,0,0,0,0,0,0,0,0,0,0,0,1,2,156,64"},
+		{"unknown family", "5,4,192,168,1,2,2,19,137"},
+		{"port length 1", "4,4,192,168,1,2,1,19"},
+		{"port length 3", "4,4,192,168,1,2,3,0,19,137"},
+		{"port 0", "4,4,192,168,1,2,2,0,0"},
+		{"short address", "4,4,192,168,2,19,137"},
+		{"field out of range", "4,4,192,168,1,256,2,19,137"},
+		{"not a number", "4,4,192,168,1,x,2,19,137"},
+		{"empty", ""},
+	} {
+		if got, err := longAddrToAddr(tt.longAddr); err == nil {
+			t.Errorf("%s: longAddrToAddr(%q) = %q, want an error", tt.name, tt.longAddr, got)
+		}
+	}
+
+	for _, tt := range []struct {
+		host, port string
+	}{
+		{"not an ip", "21"},
+		{"192.168.1.2", "0"},
+		{"192.168.1.2", "65536"},
+		{"2001:db8::1", "port"},
+	} {
+		if got, err := getLongAddrString(tt.host, tt.port); err == nil {
+			t.Errorf("getLongAddrString(%q, %q) = %q, want an error", tt.host, tt.port, got)
+		}
+	}
+}
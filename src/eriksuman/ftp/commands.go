@@ -0,0 +1,157 @@
+package ftp
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// commandSpec describes a command the server implements. The registry of specs is
+// the only place commands are listed; the command tables, HELP and FEAT are all
+// built from it.
+type commandSpec struct {
+	code CommandCode
+	// method handling the command once the user has logged in
+	handle func(h *handler, arg string)
+	// the command may be used before logging in
+	anonymous bool
+	// syntax given by HELP with the command as its argument
+	syntax string
+	// extension advertised in reply to FEAT, if any. It is a function as some
+	// features list settings of the session.
+	feature func(h *handler) string
+}
+
+// commandRegistry lists the commands the server implements, in the order HELP
+// lists them
+var commandRegistry []commandSpec
+
+// commandSpecs indexes commandRegistry by command code
+var commandSpecs map[CommandCode]commandSpec
+
+// the registry refers to HandleHELP and HandleFEAT, which use it, so it must be
+// filled in when the package is initialized rather than declared with its value
+func init() {
+	commandRegistry = []commandSpec{
+		{code: CommandUSER, handle: (*handler).HandleUSER, anonymous: true, syntax: "USER <username>"},
+		{code: CommandPASS, handle: (*handler).HandlePASS, anonymous: true, syntax: "PASS <password>"},
+		{code: CommandACCT, handle: (*handler).HandleACCT, anonymous: true, syntax: "ACCT <account>"},
+		{code: CommandCWD, handle: (*handler).HandleCWD, syntax: "CWD <directory>"},
+		{code: CommandCDUP, handle: (*handler).HandleCDUP, syntax: "CDUP (change to the parent directory)"},
+		{code: CommandPWD, handle: (*handler).HandlePWD, syntax: "PWD (print the working directory)"},
+		{code: CommandPASV, handle: (*handler).HandlePASV, syntax: "PASV (enter passive mode)"},
+		{code: CommandEPSV, handle: (*handler).HandleEPSV, syntax: "EPSV [<protocol> | ALL]", feature: staticFeature("EPSV")},
+		{code: CommandLPSV, handle: (*handler).HandleLPSV, syntax: "LPSV (enter long passive mode)", feature: staticFeature("LPSV")},
+		{code: CommandPORT, handle: (*handler).HandlePORT, syntax: "PORT <h1,h2,h3,h4,p1,p2>"},
+		{code: CommandEPRT, handle: (*handler).HandleEPRT, syntax: "EPRT |<protocol>|<address>|<port>|", feature: staticFeature("EPRT")},
+		{code: CommandLPRT, handle: (*handler).HandleLPRT, syntax: "LPRT <af,hal,h1,...,hN,pal,p1,p2>", feature: staticFeature("LPRT")},
+		{code: CommandTYPE, handle: (*handler).HandleTYPE, syntax: "TYPE <A | I>"},
+		{code: CommandMODE, handle: (*handler).HandleMODE, syntax: "MODE <S | Z>", feature: staticFeature("MODE Z")},
+		{code: CommandSTRU, handle: (*handler).HandleSTRU, syntax: "STRU <F>"},
+		{code: CommandREST, handle: (*handler).HandleREST, syntax: "REST <offset>", feature: staticFeature("REST STREAM")},
+		{code: CommandRETR, handle: (*handler).HandleRETR, syntax: "RETR <filename>"},
+		{code: CommandSTOR, handle: (*handler).HandleSTOR, syntax: "STOR <filename>"},
+		{code: CommandAPPE, handle: (*handler).HandleAPPE, syntax: "APPE <filename>"},
+		{code: CommandABOR, handle: (*handler).HandleABOR, syntax: "ABOR (abort the previous transfer)"},
+		{code: CommandMKD, handle: (*handler).HandleMKD, syntax: "MKD <directory>"},
+		{code: CommandLIST, handle: (*handler).HandleLIST, syntax: "LIST [<path>]"},
+		{code: CommandNLST, handle: (*handler).HandleNLST, syntax: "NLST [<path>]"},
+		{code: CommandMLST, handle: (*handler).HandleMLST, syntax: "MLST [<path>]", feature: func(h *handler) string { return mlstFeature(h.mlstFacts) }},
+		{code: CommandMLSD, handle: (*handler).HandleMLSD, syntax: "MLSD [<directory>]"},
+		{code: CommandSIZE, handle: (*handler).HandleSIZE, syntax: "SIZE <filename>", feature: staticFeature("SIZE")},
+		{code: CommandMDTM, handle: (*handler).HandleMDTM, syntax: "MDTM <filename>", feature: staticFeature("MDTM")},
+		{code: CommandMFMT, handle: (*handler).HandleMFMT, syntax: "MFMT <YYYYMMDDHHMMSS> <filename>", feature: staticFeature("MFMT")},
+		{code: CommandXCRC, handle: (*handler).HandleXCRC, syntax: "XCRC <filename>", feature: staticFeature("XCRC")},
+		{code: CommandXMD5, handle: (*handler).HandleXMD5, syntax: "XMD5 <filename>", feature: staticFeature("XMD5")},
+		{code: CommandHASH, handle: (*handler).HandleHASH, syntax: "HASH <filename>", feature: func(h *handler) string { return hashFeature(h.hashAlgorithm) }},
+		{code: CommandFEAT, handle: (*handler).HandleFEAT, anonymous: true, syntax: "FEAT (list the supported extensions)"},
+		{code: CommandOPTS, handle: (*handler).HandleOPTS, anonymous: true, syntax: "OPTS <UTF8 ON | MLST <fact>;... | HASH [<algorithm>]>", feature: staticFeature("UTF8")},
+		{code: CommandAVBL, handle: (*handler).HandleAVBL, syntax: "AVBL [<path>]", feature: staticFeature("AVBL")},
+		{code: CommandSITE, handle: (*handler).HandleSITE, syntax: "SITE <command> [<arguments>]"},
+		{code: CommandSTAT, handle: (*handler).HandleSTAT, anonymous: true, syntax: "STAT (print the session status)"},
+		{code: CommandCLNT, handle: (*handler).HandleCLNT, anonymous: true, syntax: "CLNT <client name>", feature: staticFeature("CLNT")},
+		{code: CommandHELP, handle: (*handler).HandleHELP, anonymous: true, syntax: "HELP [<command>]"},
+		{code: CommandREIN, handle: (*handler).HandleREIN, anonymous: true, syntax: "REIN (reset the session)"},
+		{code: CommandQUIT, handle: (*handler).HandleQUIT, anonymous: true, syntax: "QUIT (close the connection)"},
+	}
+
+	commandSpecs = make(map[CommandCode]commandSpec, len(commandRegistry))
+	for _, spec := range commandRegistry {
+		commandSpecs[spec.code] = spec
+	}
+}
+
+// staticFeature returns a feature function for an extension advertised the same
+// way in every session
+func staticFeature(feature string) func(h *handler) string {
+	return func(h *handler) string { return feature }
+}
+
+// SupportedCommands returns the codes of the commands the server implements, in
+// the order HELP lists them
+func SupportedCommands() []CommandCode {
+	codes := make([]CommandCode, len(commandRegistry))
+	for i, spec := range commandRegistry {
+		codes[i] = spec.code
+	}
+	return codes
+}
+
+// helpColumns is the number of commands on each line of the HELP reply
+const helpColumns = 5
+
+// helpMessage lists the supported commands for HELP without an argument
+func helpMessage() string {
+	var b strings.Builder
+	b.WriteString("The following commands are recogized:")
+	for i, spec := range commandRegistry {
+		if i%helpColumns == 0 {
+			b.WriteByte('\n')
+		}
+		if i%helpColumns == helpColumns-1 || i == len(commandRegistry)-1 {
+			b.WriteString(string(spec.code))
+		} else {
+			fmt.Fprintf(&b, "%-7s", spec.code)
+		}
+	}
+	return b.String()
+}
+
+// features returns the extensions advertised in reply to FEAT, in alphabetical
+// order
+func (h *handler) features() []string {
+	var features []string
+	for _, spec := range commandRegistry {
+		if spec.feature != nil {
+			features = append(features, spec.feature(h))
+		}
+	}
+
+	sort.Strings(features)
+	return features
+}
+
+// initCommandTable initializes the command table to the not logged in state allowing only login and
+// help commands. All other commands result in an error reply
+func (h *handler) initCommandTable() {
+	for _, spec := range commandRegistry {
+		if spec.anonymous {
+			h.commands[spec.code] = h.bind(spec)
+		} else {
+			h.commands[spec.code] = h.writeError530NotLoggedIn
+		}
+	}
+}
+
+// initCommandTableLoggedIn initializes the command table to the logged in state giving the
+// user full functionality.
+func (h *handler) initCommandTableLoggedIn() {
+	for _, spec := range commandRegistry {
+		h.commands[spec.code] = h.bind(spec)
+	}
+}
+
+// bind returns the handleFunc running the command described by spec on h
+func (h *handler) bind(spec commandSpec) handleFunc {
+	return func(arg string) { spec.handle(h, arg) }
+}
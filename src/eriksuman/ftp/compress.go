@@ -0,0 +1,118 @@
+package ftp
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+)
+
+// compress returns data compressed as a zlib stream for MODE Z transfers
+func compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decompressTo decompresses the zlib stream produced by read into w, returning the
+// number of decompressed bytes written. The stream is decompressed as it is read.
+func decompressTo(w io.Writer, read func(io.Writer) (int64, error)) (int64, error) {
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		_, err := read(pw)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+
+	zr, err := zlib.NewReader(pr)
+	if err != nil {
+		pr.CloseWithError(err)
+		<-done
+		return 0, err
+	}
+
+	n, err := io.Copy(w, zr)
+	// stop the transfer if w failed, otherwise drain anything after the end of
+	// the stream so the transfer completes
+	if err != nil {
+		pr.CloseWithError(err)
+	}
+	io.Copy(ioutil.Discard, pr)
+	if readErr := <-done; readErr != nil {
+		return n, readErr
+	}
+	return n, err
+}
+
+// compressFrom compresses r into a zlib stream which is passed to write,
+// returning the number of uncompressed bytes read from r
+func compressFrom(r io.Reader, write func(io.Reader) (int64, error)) (int64, error) {
+	pr, pw := io.Pipe()
+	var n int64
+	done := make(chan error, 1)
+	go func() {
+		zw := zlib.NewWriter(pw)
+		var err error
+		n, err = io.Copy(zw, r)
+		if closeErr := zw.Close(); err == nil {
+			err = closeErr
+		}
+		pw.CloseWithError(err)
+		done <- err
+	}()
+
+	_, err := write(pr)
+	// unblock the compressor if the write stopped early
+	pr.CloseWithError(io.ErrClosedPipe)
+	if compressErr := <-done; err == nil && compressErr != io.ErrClosedPipe {
+		err = compressErr
+	}
+	return n, err
+}
+
+// serverZlibDataConn compresses the data sent over a server data connection and
+// decompresses the data received, for MODE Z
+type serverZlibDataConn struct {
+	serverDataConn
+}
+
+func (z serverZlibDataConn) write(data []byte) error {
+	data, err := compress(data)
+	if err != nil {
+		return err
+	}
+
+	return z.serverDataConn.write(data)
+}
+
+func (z serverZlibDataConn) read(w io.Writer) (int64, error) {
+	return decompressTo(w, z.serverDataConn.read)
+}
+
+// clientZlibDataConn compresses the data sent over a client data connection and
+// decompresses the data received, for MODE Z
+type clientZlibDataConn struct {
+	clientDataConn
+}
+
+func (z clientZlibDataConn) read() ([]byte, error) {
+	var buf bytes.Buffer
+	_, err := z.readTo(&buf)
+	return buf.Bytes(), err
+}
+
+func (z clientZlibDataConn) readTo(w io.Writer) (int64, error) {
+	return decompressTo(w, z.clientDataConn.readTo)
+}
+
+func (z clientZlibDataConn) writeFrom(r io.Reader) (int64, error) {
+	return compressFrom(r, z.clientDataConn.writeFrom)
+}
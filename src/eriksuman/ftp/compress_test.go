@@ -0,0 +1,113 @@
+package ftp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	data := []byte(strings.Repeat("compressible data ", 10000))
+
+	z, err := compress(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(z) >= len(data) {
+		t.Errorf("compressed %d bytes to %d", len(data), len(z))
+	}
+
+	var out bytes.Buffer
+	n, err := decompressTo(&out, func(w io.Writer) (int64, error) {
+		n, err := w.Write(z)
+		return int64(n), err
+	})
+	if err != nil || n != int64(len(data)) || !bytes.Equal(out.Bytes(), data) {
+		t.Errorf("decompressed %d bytes, %v, want the %d compressed", n, err, len(data))
+	}
+
+	// compressFrom streams the same encoding
+	var stream bytes.Buffer
+	n, err = compressFrom(bytes.NewReader(data), func(r io.Reader) (int64, error) {
+		return io.Copy(&stream, r)
+	})
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("compressFrom read %d bytes, %v, want %d", n, err, len(data))
+	}
+	out.Reset()
+	if _, err := decompressTo(&out, func(w io.Writer) (int64, error) { return io.Copy(w, &stream) }); err != nil || !bytes.Equal(out.Bytes(), data) {
+		t.Errorf("streamed compression didn't round trip: %v", err)
+	}
+}
+
+func TestDecompressCorrupt(t *testing.T) {
+	z, err := compress([]byte("some data to corrupt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, data := range map[string][]byte{
+		"not zlib":  []byte("plain text"),
+		"truncated": z[:len(z)/2],
+	} {
+		_, err := decompressTo(ioutil.Discard, func(w io.Writer) (int64, error) {
+			n, err := w.Write(data)
+			return int64(n), err
+		})
+		if err == nil {
+			t.Errorf("%s: decompressed without an error", name)
+		}
+	}
+}
+
+func TestServerModeZ(t *testing.T) {
+	s := startTestServer(t, nil)
+	content := strings.Repeat("zlib ", 5000)
+	writeTestFile(t, s.dir, "file.txt", content)
+
+	c := dialTestServer(t, s.addr)
+	c.login()
+	c.cmd("MODE Z", StatusCommandOK)
+
+	// the data connection carries a zlib stream in both directions
+	var got bytes.Buffer
+	sent := c.retrieve("RETR file.txt")
+	if _, err := decompressTo(&got, func(w io.Writer) (int64, error) { return io.Copy(w, strings.NewReader(sent)) }); err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != content || len(sent) >= len(content) {
+		t.Errorf("RETR in MODE Z sent %d bytes decompressing to %d, want a compressed %d", len(sent), got.Len(), len(content))
+	}
+
+	z, err := compress([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.store("STOR up.txt", string(z))
+	if got := readTestFile(t, s.dir, "up.txt"); got != content {
+		t.Errorf("STOR in MODE Z stored %d bytes, want the %d compressed", len(got), len(content))
+	}
+}
+
+func TestClientCompressedTransfers(t *testing.T) {
+	c, dir := startTestClient(t)
+	captureStdout(t, func() { c.executeCommand("mode compressed") })
+	if !c.compressed {
+		t.Fatal("mode compressed didn't turn on compression")
+	}
+
+	content := strings.Repeat("0123456789", 10000)
+	writeTestFile(t, dir, "remote.txt", content)
+	c.CommandGet("remote.txt", "", false)
+	if got := readTestFile(t, c.localDir, "remote.txt"); got != content {
+		t.Errorf("downloaded %d bytes, want the %d of the remote file", len(got), len(content))
+	}
+
+	writeTestFile(t, c.localDir, "local.txt", content)
+	c.CommandPut("local.txt")
+	if got := readTestFile(t, dir, "local.txt"); got != content {
+		t.Errorf("uploaded %d bytes, want the %d of the local file", len(got), len(content))
+	}
+}
@@ -3,18 +3,105 @@ package ftp
 import (
 	"bufio"
 	"fmt"
+	"net"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var configPath = "ftpserver.config"
 
+// default name the server introduces itself with
+const defaultServerName = "Erik's FTP Server"
+
 type config struct {
 	logDir string
 	nLogFiles int
+	// entries below this level are not logged
+	logLevel logLevel
+	// size in bytes at which the log file is rolled, 0 for no limit
+	maxLogSize int64
+	logFormat logFormat
 	usersFile string
 	port bool
 	pasv bool
+	// public IPv4 address advertised in PASV replies while listening locally,
+	// empty to use the address the client connected to
+	pasvPublicIP string
+	// range of ports passive listeners are opened on, 0 for any port
+	pasvMinPort, pasvMaxPort int
+	dataConnectTimeout time.Duration
+	dataIdleTimeout time.Duration
+	// time a session may go without sending a command before it is closed
+	idleTimeout time.Duration
+	// representation type sessions start with, typeASCII or typeBinary
+	transferType string
+	// time allowed for the client to accept a reply on the control connection
+	controlWriteTimeout time.Duration
+	// interval between TCP keepalive probes on control connections, 0 to
+	// disable them
+	keepAlive time.Duration
+	maxConns int
+	maxConnsPerIP int
+	connRetryDelay time.Duration
+	// time active sessions are given to finish their transfers on shutdown
+	// before their connections are closed
+	shutdownTimeout time.Duration
+	maxTransferRate int64
+	// name the server introduces itself with, used for the welcome message and
+	// reply suffix unless they are set themselves
+	serverName string
+	// message of the 220 reply greeting new connections
+	welcome string
+	// text of the last line of multi-line replies
+	replySuffix string
+	// alternative command names mapped to the commands they stand for
+	aliases map[CommandCode]CommandCode
+	// permissions of files created by STOR and APPE and directories created
+	// by MKD, before the umask is applied
+	fileMode, dirMode os.FileMode
+	// directory sessions start in and are confined to, empty for the working
+	// directory of the process
+	rootDir string
+	// process umask applied at startup, -1 leaves it unchanged. Files and
+	// directories the server creates are masked by it, so it can only remove
+	// permissions from any explicitly configured modes.
+	umask int
+}
+
+// defaultConfig returns the configuration used for settings missing from the
+// config file
+func defaultConfig() *config {
+	return &config {
+		logDir: "/var/spool/logfiles",
+		nLogFiles: 5,
+		logLevel: levelDebug,
+		pasv: true,
+		transferType: typeBinary,
+		dataConnectTimeout: connTimeout,
+		dataIdleTimeout: 30 * time.Second,
+		idleTimeout: 2 * time.Minute,
+		controlWriteTimeout: 30 * time.Second,
+		keepAlive: defaultKeepAlive,
+		connRetryDelay: 30 * time.Second,
+		shutdownTimeout: 30 * time.Second,
+		umask: -1,
+		fileMode: 0644,
+		dirMode: 0755,
+		serverName: defaultServerName,
+	}
+}
+
+// setNameDefaults derives the welcome message and reply suffix from the server
+// name where they weren't set explicitly
+func (c *config) setNameDefaults() {
+	if c.welcome == "" {
+		c.welcome = "Welcome to " + c.serverName
+	}
+	if c.replySuffix == "" {
+		c.replySuffix = c.serverName
+	}
 }
 
 func loadConfig(path string) (*config, error) {
@@ -24,11 +111,7 @@ func loadConfig(path string) (*config, error) {
 	}
 
 	s := bufio.NewScanner(f)
-	c := &config {
-		logDir: "/var/spool/logfiles",
-		nLogFiles: 5,
-		pasv: true,
-	}
+	c := defaultConfig()
 	for s.Scan() {
 		line := s.Text()
 		if line[0] == '#' {
@@ -50,6 +133,26 @@ func loadConfig(path string) (*config, error) {
 				c.nLogFiles = 5
 				continue
 			}
+		case "max_log_size":
+			if _, err := fmt.Sscanf(setting[1], "%d", &c.maxLogSize); err != nil || c.maxLogSize < 0 {
+				fmt.Printf("config.go: invalid max_log_size %s\n", setting[1])
+				c.maxLogSize = 0
+				continue
+			}
+		case "log_format":
+			format, err := parseLogFormat(setting[1])
+			if err != nil {
+				fmt.Printf("config.go: %v\n", err)
+				continue
+			}
+			c.logFormat = format
+		case "log_level":
+			level, err := parseLogLevel(setting[1])
+			if err != nil {
+				fmt.Printf("config.go: %v\n", err)
+				continue
+			}
+			c.logLevel = level
 		case "usernamefile":
 			c.usersFile = setting[1]
 		case "port_mode":
@@ -66,6 +169,144 @@ func loadConfig(path string) (*config, error) {
 				continue
 			}
 			c.pasv = b
+		case "default_transfer_type":
+			switch strings.ToLower(setting[1]) {
+			case "ascii":
+				c.transferType = typeASCII
+			case "binary":
+				c.transferType = typeBinary
+			default:
+				fmt.Printf("config.go: default_transfer_type must be ascii or binary, got %s\n", setting[1])
+			}
+		case "pasv_public_ip", "pasv_address":
+			ip := net.ParseIP(setting[1])
+			if ip == nil || ip.To4() == nil {
+				fmt.Printf("config.go: %s must be an IPv4 address, got %s\n", setting[0], setting[1])
+				continue
+			}
+			c.pasvPublicIP = ip.To4().String()
+		case "server_name":
+			c.serverName = setting[1]
+		case "welcome_message":
+			c.welcome = setting[1]
+		case "welcome_file":
+			banner, err := os.ReadFile(setting[1])
+			if err != nil {
+				fmt.Printf("config.go: reading welcome_file: %v\n", err)
+				continue
+			}
+			c.welcome = strings.TrimRight(strings.ReplaceAll(string(banner), "\r\n", "\n"), "\n")
+		case "reply_suffix":
+			c.replySuffix = setting[1]
+		case "aliases":
+			aliases, err := parseAliases(setting[1])
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			c.aliases = aliases
+		case "pasv_min_port":
+			port, err := parsePort(setting[1])
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			c.pasvMinPort = port
+		case "pasv_max_port":
+			port, err := parsePort(setting[1])
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			c.pasvMaxPort = port
+		case "max_connections":
+			if _, err := fmt.Sscanf(setting[1], "%d", &c.maxConns); err != nil || c.maxConns < 0 {
+				fmt.Printf("config.go: invalid max_connections %s\n", setting[1])
+				c.maxConns = 0
+				continue
+			}
+		case "max_connections_per_ip":
+			if _, err := fmt.Sscanf(setting[1], "%d", &c.maxConnsPerIP); err != nil || c.maxConnsPerIP < 0 {
+				fmt.Printf("config.go: invalid max_connections_per_ip %s\n", setting[1])
+				c.maxConnsPerIP = 0
+				continue
+			}
+		case "connection_retry_delay":
+			d, err := parseSeconds(setting[1])
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			c.connRetryDelay = d
+		case "shutdown_timeout":
+			d, err := parseSeconds(setting[1])
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			c.shutdownTimeout = d
+		case "max_transfer_rate":
+			if _, err := fmt.Sscanf(setting[1], "%d", &c.maxTransferRate); err != nil || c.maxTransferRate < 0 {
+				fmt.Printf("config.go: invalid max_transfer_rate %s\n", setting[1])
+				c.maxTransferRate = 0
+				continue
+			}
+		case "file_mode":
+			mode, err := parseOctalMode(setting[1])
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			c.fileMode = os.FileMode(mode)
+		case "dir_mode":
+			mode, err := parseOctalMode(setting[1])
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			c.dirMode = os.FileMode(mode)
+		case "umask":
+			mask, err := parseOctalMode(setting[1])
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			c.umask = mask
+		case "data_connect_timeout":
+			d, err := parseSeconds(setting[1])
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			c.dataConnectTimeout = d
+		case "idle_timeout":
+			d, err := parseSeconds(setting[1])
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			c.idleTimeout = d
+		case "control_write_timeout":
+			d, err := parseSeconds(setting[1])
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			c.controlWriteTimeout = d
+		case "keepalive_interval":
+			var n int
+			if _, err := fmt.Sscanf(setting[1], "%d", &n); err != nil || n < 0 {
+				fmt.Printf("config.go: invalid keepalive interval %s\n", setting[1])
+				continue
+			}
+			c.keepAlive = time.Duration(n) * time.Second
+		case "data_idle_timeout":
+			d, err := parseSeconds(setting[1])
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			c.dataIdleTimeout = d
 		default:
 			fmt.Printf("config.go: unrecognized setting %s\n", line)
 		}
@@ -75,9 +316,37 @@ func loadConfig(path string) (*config, error) {
 		return nil, err
 	}
 
+	c.setNameDefaults()
+
+	// a partial or inverted range is ignored
+	if (c.pasvMinPort == 0) != (c.pasvMaxPort == 0) || c.pasvMinPort > c.pasvMaxPort {
+		fmt.Printf("config.go: invalid passive port range %d-%d\n", c.pasvMinPort, c.pasvMaxPort)
+		c.pasvMinPort, c.pasvMaxPort = 0, 0
+	}
+
 	return c, nil
 }
 
+// parseOctalMode parses an octal permission value such as 022 or 0755
+func parseOctalMode(s string) (int, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("config.go: invalid octal mode %s", s)
+	}
+
+	return int(mode), nil
+}
+
+// parseSeconds parses a positive whole number of seconds into a duration
+func parseSeconds(s string) (time.Duration, error) {
+	var n int
+	if _, err := fmt.Sscanf(s, "%d", &n); err != nil || n <= 0 {
+		return 0, fmt.Errorf("config.go: invalid number of seconds %s", s)
+	}
+
+	return time.Duration(n) * time.Second, nil
+}
+
 func parseBool(b string) (bool, error) {
 	switch strings.ToUpper(b) {
 	case "YES":
@@ -87,4 +356,39 @@ func parseBool(b string) (bool, error) {
 	default:
 		return false, fmt.Errorf("config.go: unrecognized boolean value %s", b)
 	}
-}
\ No newline at end of file
+}
+
+// parseAliases parses a comma separated list of ALIAS:COMMAND pairs. Each target
+// must be a command the server implements, and an alias can't replace one.
+func parseAliases(s string) (map[CommandCode]CommandCode, error) {
+	aliases := make(map[CommandCode]CommandCode)
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.Split(strings.TrimSpace(pair), ":")
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("config.go: invalid alias %s", pair)
+		}
+
+		alias := CommandCode(strings.ToUpper(parts[0]))
+		target := CommandCode(strings.ToUpper(parts[1]))
+		if _, ok := commandSpecs[target]; !ok {
+			return nil, fmt.Errorf("config.go: alias %s for unknown command %s", alias, target)
+		}
+		if _, ok := commandSpecs[alias]; ok {
+			return nil, fmt.Errorf("config.go: alias %s replaces an existing command", alias)
+		}
+
+		aliases[alias] = target
+	}
+
+	return aliases, nil
+}
+
+// parsePort parses a TCP port number from 1 to 65535
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("config.go: invalid port %s", s)
+	}
+
+	return port, nil
+}
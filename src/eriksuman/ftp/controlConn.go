@@ -14,17 +14,39 @@ import (
 // timeout period for establishing a connection
 const connTimeout = 5 * time.Second
 
+// default delay before the first retry of a failed connection attempt
+const defaultRetryBackoff = time.Second
+
+// retryPolicy controls how failed connection attempts are retried. The delay
+// between attempts starts at backoff and doubles after each retry.
+type retryPolicy struct {
+	retries int
+	backoff time.Duration
+}
+
 // controlConn is the connection over which FTP commands are sent and replies
 // are received
 type controlConn struct {
 	conn   io.ReadWriteCloser
+	reader *bufio.Reader
 	logger io.WriteCloser
+	// format of log entries, and the address of the server recorded in them.
+	// Until connected, the address being dialed is recorded.
+	format logFormat
+	remote string
+	// the most recent reply read from the server
+	lastReply *Reply
+	// echo the raw protocol traffic to stdout
+	debug bool
 }
 
 // newControlConn opens a TCP connection to the given host and port, opens the log file,
-// and reads the status of the response
-func newControlConn(host, port, logFile string) (*controlConn, *Reply, string, string, error) {
-	pc := new(controlConn)
+// and reads the status of the response. Each connection attempt is abandoned after timeout,
+// and failed attempts are retried according to retry. TCP keepalive probes are sent on the
+// connection every keepAlive, or not at all if it is zero or less. Connections are made
+// with d, which may go through a proxy.
+func newControlConn(d dialer, host, port, logFile string, timeout time.Duration, format logFormat, retry retryPolicy, keepAlive time.Duration) (*controlConn, *Reply, string, string, error) {
+	pc := &controlConn{format: format, remote: net.JoinHostPort(host, port)}
 	// all messges that pass through the control connection are logged
 	file, err := os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 	if err != nil {
@@ -35,17 +57,39 @@ func newControlConn(host, port, logFile string) (*controlConn, *Reply, string, s
 	pc.logMessage(fmt.Sprintf("Connecting to %s:%s", host, port))
 
 	// connect to specified server with timeout
-	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), connTimeout)
+	conn, err := pc.dial(d, net.JoinHostPort(host, port), timeout, retry)
 	if err != nil {
+		file.Close()
 		return nil, nil, "", "", err
 	}
+	if err := setKeepAlive(conn, keepAlive); err != nil {
+		pc.logMessage(fmt.Sprintf("Failed to enable keepalive: %v", err))
+	}
 	pc.conn = conn
+	pc.reader = bufio.NewReader(conn)
+	pc.remote = conn.RemoteAddr().String()
 
 	// read the reply from the server, return it
 	rply, err := pc.readReply()
 	return pc, rply, conn.LocalAddr().String(), conn.RemoteAddr().String(), err
 }
 
+// dial connects to addr with d, retrying failed attempts with an increasing delay
+func (c *controlConn) dial(d dialer, addr string, timeout time.Duration, retry retryPolicy) (net.Conn, error) {
+	backoff := retry.backoff
+	for attempt := 0; ; attempt++ {
+		conn, err := d.dial(addr, timeout)
+		if err == nil || attempt >= retry.retries {
+			return conn, err
+		}
+
+		c.logMessage(fmt.Sprintf("Connection failed: %v, retrying in %v", err, backoff))
+		fmt.Printf("Connection failed: %v, retrying in %v\n", err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
 // Close closes the protocol connection and the log file
 func (c *controlConn) Close() error {
 	if err := c.conn.Close(); err != nil {
@@ -65,19 +109,75 @@ func (c *controlConn) getReplyForCommand(cmd *Command) (*Reply, error) {
 	return c.readReply()
 }
 
+// pipelinable lists the commands which may be sent without waiting for the reply
+// to the previous command. They must not change session state or use the data
+// connection, so the replies can be matched to them by order alone.
+var pipelinable = map[CommandCode]bool{
+	CommandSIZE: true,
+	CommandMDTM: true,
+}
+
+// pipeline writes all of cmds before reading any replies, then returns the replies
+// in the order the commands were issued. Only pipelinable commands are allowed.
+func (c *controlConn) pipeline(cmds []*Command) ([]*Reply, error) {
+	for _, cmd := range cmds {
+		if !pipelinable[cmd.Code] {
+			return nil, fmt.Errorf("command %s cannot be pipelined", cmd.Code)
+		}
+	}
+
+	// write commands concurrently so a server which stops reading until its
+	// replies are read cannot deadlock with us
+	errChan := make(chan error, 1)
+	go func() {
+		for _, cmd := range cmds {
+			if err := c.writeCommand(cmd); err != nil {
+				errChan <- err
+				return
+			}
+		}
+		errChan <- nil
+	}()
+
+	replies := make([]*Reply, 0, len(cmds))
+	for range cmds {
+		rply, err := c.readReply()
+		if err != nil {
+			return nil, err
+		}
+		replies = append(replies, rply)
+	}
+
+	if err := <-errChan; err != nil {
+		return nil, err
+	}
+
+	return replies, nil
+}
+
 // logMessage appends a timestamp and logs msg
 func (c *controlConn) logMessage(msg string) {
-	fmt.Fprintf(c.logger, "%s: %s\n", time.Now().Format(time.StampMicro), msg)
+	fmt.Fprintln(c.logger, newLogEntry(levelInfo, "", c.remote, msg).format(c.format))
 }
 
 // logSend appends a timestamp and logs a sent message
 func (c *controlConn) logSend(msg string) {
-	fmt.Fprintf(c.logger, "%s: Sent %s\n", time.Now().Format(time.StampMicro), msg)
+	fmt.Fprintln(c.logger, newLogEntry(levelDebug, directionSend, c.remote, msg).format(c.format))
+	if c.debug {
+		// hide passwords from anyone watching the screen
+		if strings.HasPrefix(msg, string(CommandPASS)+" ") {
+			msg = string(CommandPASS) + " XXXX"
+		}
+		fmt.Printf("---> %s\n", msg)
+	}
 }
 
 // logReceive appends a timestamp and logs a received message
 func (c *controlConn) logReceive(msg string) {
-	fmt.Fprintf(c.logger, "%s: Received %s\n", time.Now().Format(time.StampMicro), msg[:len(msg)-2])
+	fmt.Fprintln(c.logger, newLogEntry(levelDebug, directionReceive, c.remote, msg[:len(msg)-2]).format(c.format))
+	if c.debug {
+		fmt.Printf("<--- %q\n", msg)
+	}
 }
 
 // readReply waits for, reads, and parses a message from the ftp server.
@@ -96,7 +196,7 @@ func (c *controlConn) readReply() (*Reply, error) {
 	}
 
 	// read from connection
-	reader := bufio.NewReader(c.conn)
+	reader := c.reader
 	line, err := reader.ReadString('\n')
 	if err != nil {
 		return nil, err
@@ -110,6 +210,7 @@ func (c *controlConn) readReply() (*Reply, error) {
 			StatusCode: StatusCode(line[:ind]),
 			Message:    line[ind+1 : len(line)-1],
 		}
+		c.lastReply = rply
 		return rply, nil
 	// if multi-line message, continue reading until a single line string
 	// is matched indicating the end of the message
@@ -127,6 +228,8 @@ func (c *controlConn) readReply() (*Reply, error) {
 			line += nextLine
 			if singleLineRegex.MatchString(nextLine) && nextLine[:3] == status {
 				rply.Message = line[ind : len(line)-1]
+				rply.raw = strings.TrimRight(strings.ReplaceAll(line, "\r\n", "\n"), "\n")
+				c.lastReply = rply
 				return rply, nil
 			}
 		}
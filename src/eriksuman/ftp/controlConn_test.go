@@ -0,0 +1,98 @@
+package ftp
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nopWriteCloser discards the control connection's log
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// readTestReply parses raw as a reply read from a server
+func readTestReply(t *testing.T, raw string) *Reply {
+	t.Helper()
+
+	c := &controlConn{
+		reader: bufio.NewReader(strings.NewReader(raw)),
+		logger: nopWriteCloser{ioutil.Discard},
+	}
+	rply, err := c.readReply()
+	if err != nil {
+		t.Fatalf("reading %q: %v", raw, err)
+	}
+	return rply
+}
+
+func TestMultiLinePassiveReplies(t *testing.T) {
+	rply := readTestReply(t, "227-Entering Passive Mode.\r\n"+
+		"227-The server is behind NAT (see below)\r\n"+
+		"227 Data connection at (192,168,1,2,19,137).\r\n")
+	if rply.StatusCode != StatusPasvMode {
+		t.Errorf("got status %s, want %s", rply.StatusCode, StatusPasvMode)
+	}
+	if addr, err := parsePASVString(rply.Message); err != nil || addr != "192.168.1.2:5001" {
+		t.Errorf("parsePASVString(%q) = %q, %v, want 192.168.1.2:5001", rply.Message, addr, err)
+	}
+
+	rply = readTestReply(t, "229-Entering Extended Passive Mode.\r\n"+
+		" The port follows (after this line)\r\n"+
+		"229 (|||6446|)\r\n")
+	if port, err := parseEPSVString(rply.Message); err != nil || port != "6446" {
+		t.Errorf("parseEPSVString(%q) = %q, %v, want 6446", rply.Message, port, err)
+	}
+}
+
+// flakyDialer fails its first failures attempts, then connects directly
+type flakyDialer struct {
+	failures, attempts int
+}
+
+func (d *flakyDialer) dial(addr string, timeout time.Duration) (net.Conn, error) {
+	d.attempts++
+	if d.attempts <= d.failures {
+		return nil, errors.New("connection refused")
+	}
+	return directDialer{}.dial(addr, timeout)
+}
+
+func TestControlConnDialRetries(t *testing.T) {
+	s := startTestServer(t, nil)
+
+	for _, tt := range []struct {
+		failures, retries int
+		wantAttempts      int
+		wantErr           bool
+	}{
+		{0, 0, 1, false},
+		{2, 3, 3, false},
+		{3, 3, 4, false},
+		{4, 3, 4, true},
+		{1, 0, 1, true},
+	} {
+		d := &flakyDialer{failures: tt.failures}
+		c := &controlConn{logger: nopWriteCloser{ioutil.Discard}}
+		retry := retryPolicy{retries: tt.retries, backoff: time.Millisecond}
+
+		var conn net.Conn
+		var err error
+		captureStdout(t, func() { conn, err = c.dial(d, s.addr, time.Second, retry) })
+		if conn != nil {
+			conn.Close()
+		}
+
+		if d.attempts != tt.wantAttempts {
+			t.Errorf("%d failures with %d retries: made %d attempts, want %d", tt.failures, tt.retries, d.attempts, tt.wantAttempts)
+		}
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%d failures with %d retries: got error %v", tt.failures, tt.retries, err)
+		}
+	}
+}
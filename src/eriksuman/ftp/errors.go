@@ -0,0 +1,49 @@
+package ftp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrNotLoggedIn is matched by errors.Is when the server refused a command
+// because the session is not logged in
+var ErrNotLoggedIn = errors.New("not logged in")
+
+// ErrFileNotFound is matched by errors.Is when the server refused a command
+// because the file was unavailable. Servers use the same reply when the file
+// exists but can't be accessed.
+var ErrFileNotFound = errors.New("file not found")
+
+// ErrTransferStalled is matched by errors.Is when a transfer was abandoned
+// because no data moved over the data connection within the idle timeout
+var ErrTransferStalled = errors.New("transfer stalled")
+
+// ReplyError is returned by the client when the server replies to a command
+// with a failure. Use errors.As to inspect the status code.
+type ReplyError struct {
+	StatusCode StatusCode
+	Message    string
+}
+
+func newReplyError(r *Reply) error {
+	return &ReplyError{
+		StatusCode: r.StatusCode,
+		Message:    strings.TrimSpace(r.Message),
+	}
+}
+
+func (e *ReplyError) Error() string {
+	return fmt.Sprintf("%s %s", e.StatusCode, e.Message)
+}
+
+// Is reports whether the reply matches one of the sentinel errors
+func (e *ReplyError) Is(target error) bool {
+	switch target {
+	case ErrNotLoggedIn:
+		return e.StatusCode == StatusNotLoggedIn || e.StatusCode == StatusStorNeedAccount
+	case ErrFileNotFound:
+		return e.StatusCode == StatusFileUnavailable
+	}
+	return false
+}
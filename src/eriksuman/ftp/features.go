@@ -0,0 +1,83 @@
+package ftp
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Features holds the capabilities a server advertised in reply to FEAT
+type Features struct {
+	EPSV, EPRT, MLSD, REST, UTF8, SIZE, MDTM, AVBL bool
+	// HashAlgorithms lists the algorithms supported by the HASH command. The
+	// currently selected algorithm is marked with a trailing '*'.
+	HashAlgorithms []string
+	// all advertised features, keyed by name, with their parameters
+	params map[string]string
+}
+
+// replyLineRegex matches the status code that starts the first and last lines
+// of a multi-line reply
+var replyLineRegex = regexp.MustCompile(`^\d{3}[ -]`)
+
+// parseFeatures parses the message of a 211 reply to FEAT. Each feature is on
+// its own line, consisting of a name optionally followed by parameters.
+func parseFeatures(msg string) *Features {
+	f := &Features{params: make(map[string]string)}
+	for _, line := range strings.Split(msg, "\n") {
+		line = strings.TrimSpace(line)
+		// skip the reply status lines and headings such as "Features:"
+		if line == "" || line == "-" || replyLineRegex.MatchString(line) || strings.HasSuffix(line, ":") {
+			continue
+		}
+
+		name, params := line, ""
+		if ind := strings.IndexByte(line, ' '); ind != -1 {
+			name, params = line[:ind], strings.TrimSpace(line[ind+1:])
+		}
+		name = strings.ToUpper(name)
+		f.params[name] = params
+
+		switch name {
+		case "EPSV":
+			f.EPSV = true
+		case "EPRT":
+			f.EPRT = true
+		case "MLSD", "MLST":
+			f.MLSD = true
+		case "REST":
+			f.REST = true
+		case "UTF8":
+			f.UTF8 = true
+		case "SIZE":
+			f.SIZE = true
+		case "MDTM":
+			f.MDTM = true
+		case "AVBL":
+			f.AVBL = true
+		case "HASH":
+			f.HashAlgorithms = strings.Split(strings.TrimSuffix(params, ";"), ";")
+		}
+	}
+
+	return f
+}
+
+// Supports reports whether the named feature was advertised
+func (f *Features) Supports(feature string) bool {
+	if f == nil {
+		return false
+	}
+
+	_, ok := f.params[strings.ToUpper(feature)]
+	return ok
+}
+
+// Params returns the parameters advertised with the named feature, such as
+// "STREAM" for "REST STREAM"
+func (f *Features) Params(feature string) string {
+	if f == nil {
+		return ""
+	}
+
+	return f.params[strings.ToUpper(feature)]
+}
@@ -0,0 +1,53 @@
+package ftp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseFeatures(t *testing.T) {
+	rply := readTestReply(t, "211-Features:\r\n"+
+		" EPRT\r\n"+
+		" EPSV\r\n"+
+		" MDTM\r\n"+
+		" MLST type*;size*;modify*;\r\n"+
+		" REST STREAM\r\n"+
+		" SIZE\r\n"+
+		" utf8\r\n"+
+		" HASH SHA-256*;SHA-1;MD5;\r\n"+
+		"211 End\r\n")
+	f := parseFeatures(rply.Message)
+
+	if !f.EPRT || !f.EPSV || !f.MDTM || !f.MLSD || !f.REST || !f.SIZE || !f.UTF8 {
+		t.Errorf("got %+v, want every advertised feature set", f)
+	}
+	if f.AVBL {
+		t.Error("AVBL set, but it wasn't advertised")
+	}
+	if got := strings.Join(f.HashAlgorithms, ","); got != "SHA-256*,SHA-1,MD5" {
+		t.Errorf("got hash algorithms %s, want SHA-256*,SHA-1,MD5", got)
+	}
+
+	for _, feature := range []string{"MLST", "rest", "UTF8", "Hash"} {
+		if !f.Supports(feature) {
+			t.Errorf("Supports(%q) = false, want true", feature)
+		}
+	}
+	for _, feature := range []string{"Features:", "End", "LPSV", "211"} {
+		if f.Supports(feature) {
+			t.Errorf("Supports(%q) = true, want false", feature)
+		}
+	}
+	if got := f.Params("REST"); got != "STREAM" {
+		t.Errorf("Params(REST) = %q, want STREAM", got)
+	}
+	if got := f.Params("mlst"); got != "type*;size*;modify*;" {
+		t.Errorf("Params(mlst) = %q, want type*;size*;modify*;", got)
+	}
+
+	// a client that never sent FEAT supports nothing
+	var none *Features
+	if none.Supports("EPSV") || none.Params("REST") != "" {
+		t.Error("nil Features reported a feature")
+	}
+}
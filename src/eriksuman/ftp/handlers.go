@@ -1,55 +1,131 @@
 package ftp
 
 import (
+	"crypto/md5"
 	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io/ioutil"
 	"net"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
+	"unicode"
 )
 
 // common errors
 var errInvalidAddrFamily = errors.New("unrecognized address family identifer")
+var errPasvUnreachable = errors.New("no reachable passive address")
 
 // HandleUSER handles commands setting the username
 func (h *handler) HandleUSER(username string) {
 	//check args
-	if username == "" {
+	if username == "" || !validCredential(username) {
 		h.writeError501Args()
 		return
 	} else if username == h.username && h.isLoggedIn {
-		h.writeReply(newReply("230", "User already logged in."))
+		h.writeReply(newReply(StatusLoggedIn, "User already logged in."))
 		return
 	}
 
 	h.username = username
+	h.needAccount = false
 
-	h.writeReply(newReply("331", fmt.Sprintf("Username %v accepted, please provide the password.", username)))
+	h.writeReply(newReply(StatusUserOK, fmt.Sprintf("Username %v accepted, please provide the password.", username)))
 }
 
 // HandlePASS takes a password and checks to see if it is valid for the current user
 func (h *handler) HandlePASS(password string) {
 	if h.username == "" {
-		h.writeReply(newReply("503", "Log in with USER first."))
+		h.writeReply(newReply(StatusBadSequence, "Log in with USER first."))
+		return
+	}
+
+	if !validCredential(password) {
+		h.writeError501Args()
 		return
 	}
 
 	// check if user exists and password is vaild.
-	pass, exists := h.users[h.username]
-	if !exists || password != pass {
-		h.writeReply(newReply("530", "Login incorrect."))
+	user, exists := h.users[h.username]
+	if !exists || password != user.password {
+		h.writeReply(newReply(StatusNotLoggedIn, "Login incorrect."))
+		h.username = ""
+		return
+	}
+
+	// some users must also supply an account
+	if user.account != "" {
+		h.needAccount = true
+		h.writeReply(newReply(StatusLoginNeedAccount, "Need account for login."))
+		return
+	}
+
+	h.logIn()
+}
+
+// longest username or password accepted
+const maxCredentialLength = 256
+
+// validCredential reports whether a username or password is of an acceptable
+// length and free of control characters, which could corrupt the replies and
+// logs it is written to
+func validCredential(s string) bool {
+	if len(s) > maxCredentialLength {
+		return false
+	}
+
+	for _, r := range s {
+		if unicode.IsControl(r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// HandleACCT takes an account and completes the login of a user that requires one
+func (h *handler) HandleACCT(account string) {
+	if account == "" {
+		h.writeError501Args()
+		return
+	}
+
+	if h.isLoggedIn {
+		h.writeReply(newReply(StatusCommandNotImplemented, "Account not needed, already logged in."))
+		return
+	}
+
+	if !h.needAccount {
+		h.writeReply(newReply(StatusBadSequence, "Log in with USER and PASS first."))
+		return
+	}
+
+	// check the account matches the user's
+	if account != h.users[h.username].account {
+		h.writeReply(newReply(StatusNotLoggedIn, "Login incorrect."))
 		h.username = ""
+		h.needAccount = false
 		return
 	}
 
+	h.needAccount = false
+	h.logIn()
+}
+
+// logIn marks the current user as logged in and gives them full functionality
+func (h *handler) logIn() {
 	h.logMessage(fmt.Sprintf("User %s logged in.", h.username))
 	h.initCommandTableLoggedIn()
 	h.isLoggedIn = true
 
-	h.writeReply(newReply("230", "Login successful."))
+	h.writeReply(newReply(StatusLoggedIn, "Login successful."))
 }
 
 // HandlePWD prints the current directory name on the control connection
@@ -59,34 +135,107 @@ func (h *handler) HandlePWD(arg string) {
 		return
 	}
 
-	h.writeReply(newReply("257", fmt.Sprintf("\"%s\" is the current directory.", h.dir)))
+	h.writeReply(newReply(StatusPathCreated, fmt.Sprintf("%s is the current directory.", quotePath(h.dir))))
+}
+
+// quotePath encloses a path in double quotes for a 257 reply, doubling any quotes
+// in it as required by RFC 959
+func quotePath(p string) string {
+	return "\"" + strings.ReplaceAll(p, "\"", "\"\"") + "\""
+}
+
+// errOutsideRoot is returned for paths which lead out of the session's root
+var errOutsideRoot = errors.New("path is outside the session root")
+
+// resolvePath converts arg, which is absolute or relative to dir, to a clean
+// absolute path. Paths which lead out of the directory the session started in
+// are rejected with errOutsideRoot, so neither ".." nor a symlink can be used to
+// reach the rest of the filesystem. An empty arg resolves to dir.
+func (h *handler) resolvePath(dir, arg string) (string, error) {
+	p := path.Clean(dir)
+	if arg != "" {
+		if path.IsAbs(arg) {
+			p = path.Clean(arg)
+		} else {
+			p = path.Join(dir, arg)
+		}
+	}
+
+	if !h.withinRoot(p) {
+		return "", fmt.Errorf("%w: %s", errOutsideRoot, arg)
+	}
+
+	return p, nil
+}
+
+// withinRoot reports whether p is inside the directory the session started in,
+// both as written and once any symlinks in it are followed
+func (h *handler) withinRoot(p string) bool {
+	if !isAncestor(h.startDir, p) {
+		return false
+	}
+
+	real, err := evalExisting(p)
+	if err != nil {
+		return false
+	}
+	root, err := filepath.EvalSymlinks(h.startDir)
+	if err != nil {
+		root = h.startDir
+	}
+
+	return isAncestor(root, real)
+}
+
+// evalExisting follows the symlinks in the longest part of p that exists, and
+// appends the rest of p, which is yet to be created, unchanged. A symlink to a
+// missing file is an error, as where it leads can't be checked.
+func evalExisting(p string) (string, error) {
+	var rest []string
+	for cur := p; ; cur = filepath.Dir(cur) {
+		if _, err := os.Lstat(cur); err == nil {
+			real, err := filepath.EvalSymlinks(cur)
+			if err != nil {
+				return "", err
+			}
+			return filepath.Join(append([]string{real}, rest...)...), nil
+		}
+
+		if filepath.Dir(cur) == cur {
+			return p, nil
+		}
+		rest = append([]string{filepath.Base(cur)}, rest...)
+	}
 }
 
 // HandleCWD changes the current directory to dir
 func (h *handler) HandleCWD(dir string) {
 	// convert to absolute path
-	p := dir
-	if !path.IsAbs(dir) {
-		p = path.Join(h.dir, dir)
+	p, err := h.resolvePath(h.dir, dir)
+	if err != nil {
+		h.logError(err)
+		h.writeReply(newReply(StatusFileUnavailable, "Directory change failed."))
+		return
 	}
 
-	// ensure path is valid
-	info, err := os.Lstat(p)
+	// ensure path is valid, following a link to a directory, which resolvePath
+	// has checked stays within the root
+	info, err := os.Stat(p)
 	if err != nil {
 		h.logError(err)
-		h.writeReply(newReply("550", "Directory change failed."))
+		h.writeReply(newReply(StatusFileUnavailable, "Directory change failed."))
 		return
 	}
 
 	// ensure path is directory
 	if !info.IsDir() {
-		h.writeReply(newReply("550", fmt.Sprintf("%s: Not a directory.", dir)))
+		h.writeReply(newReply(StatusFileUnavailable, fmt.Sprintf("%s: Not a directory.", dir)))
 		return
 	}
 
 	h.dir = p
 
-	h.writeReply(newReply("250", "Directory change successful."))
+	h.writeReply(newReply(StatusRequestedFileActionOK, "Directory change successful."))
 }
 
 // HandleCDUP changes to the parent directory
@@ -102,7 +251,12 @@ func (h *handler) HandleCDUP(arg string) {
 // HandlePORT handles port commands
 func (h *handler) HandlePORT(args string) {
 	if !h.config.port {
-		h.writeReply(newReply("550", "PORT mode not available."))
+		h.writeReply(newReply(StatusFileUnavailable, "PORT mode not available."))
+		return
+	}
+
+	if h.epsvAll {
+		h.writeError501EPSVAll()
 		return
 	}
 
@@ -116,13 +270,18 @@ func (h *handler) HandlePORT(args string) {
 
 	// set up active connection
 	h.initActiveDataConn(addr)
-	h.writeReply(newReply("200", "PORT command accepted."))
+	h.writeReply(newReply(StatusCommandOK, "PORT command accepted."))
 }
 
 // HandleEPRT handles eprt commands
 func (h *handler) HandleEPRT(args string) {
 	if !h.config.port {
-		h.writeReply(newReply("550", "EPRT mode not available"))
+		h.writeReply(newReply(StatusFileUnavailable, "EPRT mode not available"))
+		return
+	}
+
+	if h.epsvAll {
+		h.writeError501EPSVAll()
 		return
 	}
 
@@ -131,7 +290,38 @@ func (h *handler) HandleEPRT(args string) {
 	if err != nil {
 		h.logError(err)
 		if err == errInvalidAddrFamily {
-			h.writeReply(newReply("522", "Unrecognized address family identifier."))
+			h.writeReply(newReply(StatusBadNetworkProtocol, "Unrecognized address family identifier."))
+			return
+		}
+
+		h.writeError501Args()
+		return
+	}
+
+	// set up active data conn
+	h.initActiveDataConn(addr)
+	h.writeReply(newReply(StatusCommandOK, "EPRT command accepted."))
+}
+
+// HandleLPRT handles lprt commands, which give the address for active data
+// connections in the RFC 1639 long format
+func (h *handler) HandleLPRT(args string) {
+	if !h.config.port {
+		h.writeReply(newReply(StatusFileUnavailable, "LPRT mode not available."))
+		return
+	}
+
+	if h.epsvAll {
+		h.writeError501EPSVAll()
+		return
+	}
+
+	// convert arg to addr
+	addr, err := longAddrToAddr(args)
+	if err != nil {
+		h.logError(err)
+		if err == errInvalidAddrFamily {
+			h.writeReply(newReply(StatusBadAddressFamily, "Supported address families are (4, 6)."))
 			return
 		}
 
@@ -141,13 +331,18 @@ func (h *handler) HandleEPRT(args string) {
 
 	// set up active data conn
 	h.initActiveDataConn(addr)
-	h.writeReply(newReply("200", "EPRT command accepted."))
+	h.writeReply(newReply(StatusCommandOK, "LPRT command accepted."))
 }
 
 // HandlePASV handles pasv commands
 func (h *handler) HandlePASV(arg string) {
 	if !h.config.pasv {
-		h.writeReply(newReply("550", "PASV mode not available"))
+		h.writeReply(newReply(StatusFileUnavailable, "PASV mode not available"))
+		return
+	}
+
+	if h.epsvAll {
+		h.writeError501EPSVAll()
 		return
 	}
 
@@ -156,50 +351,182 @@ func (h *handler) HandlePASV(arg string) {
 		return
 	}
 
+	// find an address the client can reach before listening
+	host, err := h.pasvHost()
+	if err != nil {
+		h.logError(err)
+		if errors.Is(err, errPasvUnreachable) {
+			h.writeReply(newReply(StatusCanNotOpenDataConnection, "Can't advertise a reachable passive address; "+
+				"set pasv_public_ip in the server config or use EPSV."))
+			return
+		}
+		h.writeReply(newReply(StatusNotAvailable, "PASV failed, use EPSV."))
+		return
+	}
+
 	// set up passive connection
 	addr, err := h.initPassiveDataConn()
+	if err != nil {
+		h.logError(err)
+		h.writePassiveError(err)
+		return
+	}
+
+	// get port
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		h.logError(err)
+		h.writeError421Server()
+		return
+	}
+
+	// make proper reply message
+	msg, err := getPORTString(host, port)
 	if err != nil {
 		h.logError(err)
 		h.writeError421Server()
 		return
 	}
 
-	// get host and port
-	host, port, err := net.SplitHostPort(addr)
+	h.writeReply(newReply(StatusPasvMode, fmt.Sprintf("Entering Passive Mode (%s).", msg)))
+}
+
+// HandleLPSV handles lpsv commands, replying with the address of the passive
+// listener in the RFC 1639 long format. Unlike PASV, the address may be IPv6.
+func (h *handler) HandleLPSV(arg string) {
+	if !h.config.pasv {
+		h.writeReply(newReply(StatusFileUnavailable, "LPSV mode not available"))
+		return
+	}
+
+	if h.epsvAll {
+		h.writeError501EPSVAll()
+		return
+	}
+
+	if arg != "" {
+		h.writeError501Args()
+		return
+	}
+
+	// IPv4 addresses are advertised as they are for PASV
+	host, _, err := net.SplitHostPort(h.conn.LocalAddr().String())
 	if err != nil {
 		h.logError(err)
 		h.writeError421Server()
 		return
 	}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		if host, err = h.pasvHost(); err != nil {
+			h.logError(err)
+			if errors.Is(err, errPasvUnreachable) {
+				h.writeReply(newReply(StatusCanNotOpenDataConnection, "Can't advertise a reachable passive address; "+
+					"set pasv_public_ip in the server config or use EPSV."))
+				return
+			}
+			h.writeReply(newReply(StatusNotAvailable, "LPSV failed, use EPSV."))
+			return
+		}
+	}
 
-	ip := net.ParseIP(addr)
+	// set up passive connection
+	addr, err := h.initPassiveDataConn()
+	if err != nil {
+		h.logError(err)
+		h.writePassiveError(err)
+		return
+	}
 
-	// port can only be used with IPv4 addresses
-	if ip.To4() == nil {
-		h.writeReply(newReply("421", "PASV failed, use EPSV."))
+	// get port
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		h.logError(err)
+		h.writeError421Server()
 		return
 	}
 
 	// make proper reply message
-	msg, err := getPORTString(host, port)
+	msg, err := getLongAddrString(host, port)
 	if err != nil {
 		h.logError(err)
 		h.writeError421Server()
 		return
 	}
 
-	h.writeReply(newReply("227", fmt.Sprintf("Entering Passive Mode (%s).", msg)))
+	h.writeReply(newReply(StatusLongPasvMode, fmt.Sprintf("Entering Long Passive Mode (%s).", msg)))
+}
+
+// writePassiveError writes the reply for a passive listener that couldn't be
+// opened
+func (h *handler) writePassiveError(err error) {
+	if errors.Is(err, errNoPasvPort) {
+		h.writeReply(newReply(StatusNotAvailable, "No passive ports available, try again later."))
+		return
+	}
+
+	h.writeError421Server()
+}
+
+// pasvHost returns the IPv4 address to advertise in a PASV reply. Unless one is
+// configured, the address the client connected to is used. That address is
+// rejected with errPasvUnreachable when it is private or unspecified but the
+// client is not on a private network, as the client is then most likely behind
+// NAT or a proxy and can't connect to it.
+func (h *handler) pasvHost() (string, error) {
+	if h.config.pasvPublicIP != "" {
+		return h.config.pasvPublicIP, nil
+	}
+
+	local, _, err := net.SplitHostPort(h.conn.LocalAddr().String())
+	if err != nil {
+		return "", err
+	}
+	remote, _, err := net.SplitHostPort(h.conn.RemoteAddr().String())
+	if err != nil {
+		return "", err
+	}
+
+	// PASV can only carry IPv4 addresses
+	localIP, remoteIP := net.ParseIP(local), net.ParseIP(remote)
+	if localIP == nil || localIP.To4() == nil {
+		return "", fmt.Errorf("PASV requested on non IPv4 address %s", local)
+	}
+
+	if isInternalIP(localIP) && !isInternalIP(remoteIP) {
+		return "", fmt.Errorf("%w: %s is not reachable from %s", errPasvUnreachable, local, remote)
+	}
+
+	return localIP.To4().String(), nil
+}
+
+// isInternalIP reports whether ip is unspecified, loopback or private, and so
+// can't be reached from the internet
+func isInternalIP(ip net.IP) bool {
+	return ip == nil || ip.IsUnspecified() || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast()
 }
 
 // HandleEPSV handles epsv commands
 func (h *handler) HandleEPSV(arg string) {
 	if !h.config.pasv {
-		h.writeReply(newReply("550", "PASV mode not available"))
+		h.writeReply(newReply(StatusFileUnavailable, "PASV mode not available"))
 		return
 	}
 
-	if arg != "" {
-		h.writeError501Args()
+	// EPSV ALL restricts the rest of the session to EPSV
+	if strings.ToUpper(arg) == "ALL" {
+		h.epsvAll = true
+		h.writeReply(newReply(StatusCommandOK, "EPSV ALL ok."))
+		return
+	}
+
+	// the listener is reached at the server's address on the control connection,
+	// so only that address's network protocol can be offered
+	if proto := netProtocol(h.conn.LocalAddr()); arg != "" && arg != proto {
+		if arg != "1" && arg != "2" {
+			h.writeError501Args()
+			return
+		}
+		h.writeReply(newReply(StatusBadNetworkProtocol, fmt.Sprintf("Network protocol not supported, use (%s).", proto)))
 		return
 	}
 
@@ -207,7 +534,7 @@ func (h *handler) HandleEPSV(arg string) {
 	addr, err := h.initPassiveDataConn()
 	if err != nil {
 		h.logError(err)
-		h.writeReply(newReply("421", "EPSV command failed."))
+		h.writePassiveError(err)
 		return
 	}
 
@@ -215,125 +542,959 @@ func (h *handler) HandleEPSV(arg string) {
 	_, port, err := net.SplitHostPort(addr)
 	if err != nil {
 		h.logError(err)
-		h.writeReply(newReply("421", "EPSV command failed."))
+		h.writeReply(newReply(StatusNotAvailable, "EPSV command failed."))
 		return
 	}
 
-	h.writeReply(newReply("229", fmt.Sprintf("Entering Extended Passive Mode (|||%s|).", port)))
+	h.writeReply(newReply(StatusExtendedPasvMode, fmt.Sprintf("Entering Extended Passive Mode (|||%s|).", port)))
 }
 
 // HandleLIST writes the given directory listing to the data connection
-func (h *handler) HandleLIST(dir string) {
+func (h *handler) HandleLIST(arg string) {
+	if err := h.startTransfer(); err != nil {
+		h.writeTransferError(err)
+		return
+	}
+	defer h.closeDataConn()
+
+	dir, all := parseListArgs(arg)
+
 	// make sure path is absolute
-	var p string
-	if dir == "" {
-		p = h.dir
-	} else {
-		if path.IsAbs(dir) {
-			p = dir
-		} else {
-			p = path.Join(h.dir, dir)
-		}
+	p, err := h.resolvePath(h.dir, dir)
+	if err != nil {
+		h.logError(err)
+		h.writeReply(newReply(StatusFileUnavailable, "Directory listing failed."))
+		return
+	}
+
+	// list the entries matching a wildcard pattern
+	if hasGlobMeta(dir) {
+		h.listGlob(dir, p, all)
+		return
 	}
 
 	// make sure directory exists
 	f, err := os.Lstat(p)
 	if err != nil {
 		h.logError(err)
-		h.writeReply(newReply("550", "Directory listing failed."))
+		h.writeReply(newReply(StatusFileUnavailable, "Directory listing failed."))
 		return
 	}
 
 	// make sure it is a directory
 	if !f.IsDir() {
-		h.writeReply(newReply("550", fmt.Sprintf("%s: not a directory", dir)))
+		h.writeReply(newReply(StatusFileUnavailable, fmt.Sprintf("%s: not a directory", dir)))
 		return
 	}
 
 	// execute ls command to get directory listing
-	list, err := exec.Command("ls", "-l", p).Output()
+	flags := "-l"
+	if all {
+		flags = "-la"
+	}
+	list, err := exec.Command("ls", flags, "--", p).Output()
 	if err != nil {
 		h.logError(err)
-		h.writeReply(newReply("550", "Directory listing failed."))
+		h.writeReply(newReply(StatusFileUnavailable, "Directory listing failed."))
 		return
 	}
 
-	// replace bare newlines with <CRLF>
-	data := strings.Replace(string(list), "\n", "\r\n", -1)
+	h.sendListing(list)
+}
 
-	h.writeReply(newReply("150", "Here comes the directory listing."))
+// hasGlobMeta reports whether a path contains wildcard characters
+func hasGlobMeta(p string) bool {
+	return strings.ContainsAny(p, "*?[")
+}
 
-	// write listing to data connection
-	if err := h.dataConn.write([]byte(data)); err != nil {
+// listGlob sends the long listing of the entries matching pattern, whose
+// absolute form is p. Matching directories are listed themselves rather than
+// their contents, and hidden files only match a pattern starting with a dot
+// unless all is set. No matches is an empty listing rather than an error.
+func (h *handler) listGlob(pattern, p string, all bool) {
+	matches, err := filepath.Glob(p)
+	if err != nil {
 		h.logError(err)
-		h.writeReply(newReply("451", "Failed to open data connection."))
+		h.writeReply(newReply(StatusBadArguments, "Invalid pattern."))
+		return
+	}
+
+	var names []string
+	for _, m := range matches {
+		if !h.withinRoot(m) {
+			continue
+		}
+		if !all && strings.HasPrefix(path.Base(m), ".") && !strings.HasPrefix(path.Base(p), ".") {
+			continue
+		}
+
+		// relative patterns list names relative to the current directory
+		if !path.IsAbs(pattern) {
+			if rel, err := filepath.Rel(h.dir, m); err == nil {
+				m = rel
+			}
+		}
+		names = append(names, m)
+	}
+
+	var list []byte
+	if len(names) > 0 {
+		cmd := exec.Command("ls", append([]string{"-ld", "--"}, names...)...)
+		cmd.Dir = h.dir
+		if list, err = cmd.Output(); err != nil {
+			h.logError(err)
+			h.writeReply(newReply(StatusFileUnavailable, "Directory listing failed."))
+			return
+		}
+	}
+
+	h.sendListing(list)
+}
+
+// sendListing sends the output of ls over the data connection
+func (h *handler) sendListing(list []byte) {
+	// listings are always sent as ASCII
+	data := toASCII(list, h.eol)
+
+	h.writeReply(newReply(StatusAboutToSend, "Here comes the directory listing."))
+
+	// write listing to data connection
+	if err := h.data().write(data); err != nil {
+		h.writeTransferError(err)
 		return
 	}
 
-	h.writeReply(newReply("226", "Listing successfully transfered."))
+	h.writeReply(newReply(StatusClosingDataConnection, "Listing successfully transfered."))
 }
 
-// HandleRETR writes the given file to the data connection
-func (h *handler) HandleRETR(file string) {
-	// make sure path is absolute
-	if !path.IsAbs(file) {
-		file = path.Join(h.dir, file)
+// parseListArgs separates the leading options many clients send with LIST and
+// NLST from the path. Only -a, which includes hidden files, has any effect, other
+// options are ignored.
+func parseListArgs(arg string) (dir string, all bool) {
+	dir = strings.TrimSpace(arg)
+	for strings.HasPrefix(dir, "-") {
+		opt := dir
+		if ind := strings.IndexByte(dir, ' '); ind != -1 {
+			opt = dir[:ind]
+		}
+		if opt == "-" {
+			break
+		}
+
+		all = all || strings.ContainsRune(opt, 'a')
+		dir = strings.TrimSpace(dir[len(opt):])
 	}
 
-	// make sure file exists
-	f, err := os.Lstat(file)
-	if err != nil {
-		h.writeError550FileAction()
+	return dir, all
+}
+
+// HandleNLST writes a list of names to the data connection, one per line ending
+// in CRLF as required by RFC 959. With no argument the bare names in the current
+// directory are listed, a directory argument lists its entries qualified by the
+// argument, and a file argument lists only that file.
+func (h *handler) HandleNLST(arg string) {
+	if err := h.startTransfer(); err != nil {
+		h.writeTransferError(err)
 		return
 	}
+	defer h.closeDataConn()
 
-	// make sure its a file
-	if !f.Mode().IsRegular() {
-		h.writeError550FileAction()
+	dir, all := parseListArgs(arg)
+
+	// make sure path is absolute
+	p, err := h.resolvePath(h.dir, dir)
+	if err != nil {
+		h.logError(err)
+		h.writeReply(newReply(StatusFileUnavailable, "Directory listing failed."))
 		return
 	}
 
-	// read file
-	data, err := ioutil.ReadFile(file)
+	// make sure the path exists
+	f, err := os.Stat(p)
 	if err != nil {
 		h.logError(err)
-		h.writeError550FileAction()
+		h.writeReply(newReply(StatusFileUnavailable, "Directory listing failed."))
 		return
 	}
 
-	// replace bare newlines with <CRLF>
-	data = []byte(strings.Replace(string(data), "\n", "\r\n", -1))
+	var names []string
+	if f.IsDir() {
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			h.logError(err)
+			h.writeReply(newReply(StatusFileUnavailable, "Directory listing failed."))
+			return
+		}
+
+		for _, e := range entries {
+			// hidden files are left out unless -a is given, as they are by LIST
+			if !all && strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
 
-	h.writeReply(newReply("150", "Here comes the file."))
+			if dir == "" {
+				names = append(names, e.Name())
+			} else {
+				names = append(names, path.Join(dir, e.Name()))
+			}
+		}
+	} else {
+		names = append(names, dir)
+	}
 
-	// write to data connection
-	if err = h.dataConn.write(data); err != nil {
-		h.logError(err)
-		h.writeReply(newReply("451", "Error occurred in transfer."))
+	var data []byte
+	for _, name := range names {
+		data = append(data, name+eolCRLF...)
+	}
+
+	h.writeReply(newReply(StatusAboutToSend, "Here comes the directory listing."))
+
+	// write listing to data connection
+	if err := h.data().write(data); err != nil {
+		h.writeTransferError(err)
 		return
 	}
 
-	h.writeReply(newReply("226", "File transfered successfully."))
+	h.writeReply(newReply(StatusClosingDataConnection, "Listing successfully transfered."))
 }
 
-// CommandHELP writes a multi line help message
-func (h *handler) HandleHELP(arg string) {
-	if arg != "" {
-		h.writeError501Args()
+// HandleMLST writes the facts about a single file, or the current directory if no
+// path is given, over the control connection as described in RFC 3659
+func (h *handler) HandleMLST(arg string) {
+	p, err := h.resolvePath(h.dir, arg)
+	if err != nil {
+		h.logError(err)
+		h.writeError550FileAction()
 		return
 	}
 
-	msg := "The following commands are recogized:\n" +
-		"USER   PASS   CWD    CDUP   PWD\n" +
-		"PASV   EPSV   PORT   EPRT   RETR\n" +
-		"LIST   HELP   QUIT"
+	info, err := os.Stat(p)
+	if err != nil {
+		h.writeError550FileAction()
+		return
+	}
 
-	h.writeReply(newReply("214", msg))
+	// the entry must be on its own line starting with a single space
+	entry := mlstEntry(info, p, "", h.mlstFacts)
+	h.writeRawReply(fmt.Sprintf("%s-Listing %s\r\n %s\r\n%s End", StatusRequestedFileActionOK, p, entry, StatusRequestedFileActionOK))
 }
 
-// HandleQUIT closes the connecction and writes a goodbye message
-func (h *handler) HandleQUIT(arg string) {
-	h.writeReply(newReply("221", "Goodbye."))
+// HandleMLSD writes the facts about each entry of a directory, including hidden
+// ones, to the data connection as described in RFC 3659
+func (h *handler) HandleMLSD(arg string) {
+	if err := h.startTransfer(); err != nil {
+		h.writeTransferError(err)
+		return
+	}
+	defer h.closeDataConn()
+
+	// make sure path is absolute
+	p, err := h.resolvePath(h.dir, arg)
+	if err != nil {
+		h.logError(err)
+		h.writeReply(newReply(StatusFileUnavailable, "Directory listing failed."))
+		return
+	}
+
+	// make sure it is a directory
+	info, err := os.Stat(p)
+	if err != nil {
+		h.logError(err)
+		h.writeReply(newReply(StatusFileUnavailable, "Directory listing failed."))
+		return
+	}
+	if !info.IsDir() {
+		h.writeReply(newReply(StatusFileUnavailable, fmt.Sprintf("%s: not a directory", arg)))
+		return
+	}
+
+	entries, err := os.ReadDir(p)
+	if err != nil {
+		h.logError(err)
+		h.writeReply(newReply(StatusFileUnavailable, "Directory listing failed."))
+		return
+	}
+
+	// the listed directory comes first, followed by its entries
+	data := []byte(mlstEntry(info, p, "cdir", h.mlstFacts) + eolCRLF)
+	for _, e := range entries {
+		// follow symbolic links, leaving out any that are broken
+		info, err := os.Stat(path.Join(p, e.Name()))
+		if err != nil {
+			continue
+		}
+		data = append(data, mlstEntry(info, e.Name(), "", h.mlstFacts)+eolCRLF...)
+	}
+
+	h.writeReply(newReply(StatusAboutToSend, "Here comes the directory listing."))
+
+	// write listing to data connection
+	if err := h.data().write(data); err != nil {
+		h.writeTransferError(err)
+		return
+	}
+
+	h.writeReply(newReply(StatusClosingDataConnection, "Listing successfully transfered."))
+}
+
+// HandleREST sets the offset the following RETR starts sending the file from
+func (h *handler) HandleREST(arg string) {
+	offset, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || offset < 0 {
+		h.writeError501Args()
+		return
+	}
+
+	h.restOffset = offset
+	h.writeReply(newReply(StatusRequestFilePending, fmt.Sprintf("Restarting at %d. Send RETR to initiate transfer.", offset)))
+}
+
+// HandleABOR aborts the previous transfer. Transfers complete before the next
+// command is read, so there is never one in progress; any data connection left
+// set up is closed.
+func (h *handler) HandleABOR(arg string) {
+	h.closeDataConn()
+	h.writeReply(newReply(StatusClosingDataConnection, "No transfer to abort."))
+}
+
+// HandleRETR writes the given file to the data connection
+func (h *handler) HandleRETR(file string) {
+	if err := h.startTransfer(); err != nil {
+		h.writeTransferError(err)
+		return
+	}
+	defer h.closeDataConn()
+
+	// make sure path is absolute
+	file, err := h.resolvePath(h.dir, file)
+	if err != nil {
+		h.logError(err)
+		h.writeError550FileAction()
+		return
+	}
+
+	// make sure file exists
+	f, err := os.Lstat(file)
+	if err != nil {
+		h.writeError550FileAction()
+		return
+	}
+
+	// make sure its a file
+	if !f.Mode().IsRegular() {
+		h.writeError550FileAction()
+		return
+	}
+
+	// read file
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		h.logError(err)
+		h.writeError550FileAction()
+		return
+	}
+
+	// translate line endings in ascii mode
+	if h.transferType == typeASCII {
+		data = toASCII(data, h.eol)
+	}
+
+	// start where REST asked, counting the bytes as they are sent
+	if h.restOffset > int64(len(data)) {
+		h.writeReply(newReply(StatusInvalidRestart, fmt.Sprintf("Restart offset %d is past the end of the file.", h.restOffset)))
+		return
+	}
+	data = data[h.restOffset:]
+
+	h.writeReply(newReply(StatusAboutToSend, "Here comes the file."))
+
+	// write to data connection
+	if err = h.data().write(data); err != nil {
+		h.writeTransferError(err)
+		return
+	}
+
+	h.writeReply(newReply(StatusClosingDataConnection, "File transfered successfully."))
+}
+
+// HandleSTOR reads a file from the data connection and stores it at the given path,
+// replacing any existing file
+func (h *handler) HandleSTOR(file string) {
+	h.receiveFile(file, os.O_TRUNC)
+}
+
+// HandleAPPE reads a file from the data connection and appends it to the file at
+// the given path, creating the file if it doesn't exist
+func (h *handler) HandleAPPE(file string) {
+	h.receiveFile(file, os.O_APPEND)
+}
+
+// receiveFile reads a file from the data connection into the file at the given
+// path, opened for writing with the extra flag, which either truncates or
+// appends to an existing file
+func (h *handler) receiveFile(file string, flag int) {
+	if err := h.startTransfer(); err != nil {
+		h.writeTransferError(err)
+		return
+	}
+	defer h.closeDataConn()
+
+	if h.restOffset != 0 {
+		h.writeReply(newReply(StatusNotImplementedParameter, "REST is only supported for RETR."))
+		return
+	}
+
+	if file == "" {
+		h.writeError501Args()
+		return
+	}
+
+	// make sure path is absolute
+	file, err := h.resolvePath(h.dir, file)
+	if err != nil {
+		h.logError(err)
+		h.writeError550FileAction()
+		return
+	}
+
+	// refuse to write to anything other than a regular file
+	if info, err := os.Lstat(file); err == nil && !info.Mode().IsRegular() {
+		h.writeError550FileAction()
+		return
+	}
+
+	// fail before the transfer starts if the file can't be created
+	parent := path.Dir(file)
+	if info, err := os.Stat(parent); err != nil || !info.IsDir() {
+		h.writeReply(newReply(StatusFileUnavailable, "Directory does not exist."))
+		return
+	}
+	if err := checkWritable(parent); err != nil {
+		h.logError(err)
+		h.writeReply(newReply(StatusFileUnavailable, "Permission denied."))
+		return
+	}
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|flag, h.config.fileMode)
+	if err != nil {
+		h.logError(err)
+		if isInvalidName(err) {
+			h.writeError553FileName()
+		} else {
+			h.writeError550FileAction()
+		}
+		return
+	}
+	defer f.Close()
+
+	h.writeReply(newReply(StatusAboutToSend, "Ok to send data."))
+
+	// translate line endings in ascii mode
+	if h.transferType == typeASCII {
+		_, err = h.data().read(&lfWriter{w: f, eol: h.eol})
+	} else {
+		_, err = h.data().read(f)
+	}
+
+	if err != nil {
+		h.writeTransferError(err)
+		return
+	}
+
+	h.writeReply(newReply(StatusClosingDataConnection, "File received successfully."))
+}
+
+// isInvalidName reports whether err means the file name itself was rejected,
+// rather than the file being missing or inaccessible
+func isInvalidName(err error) bool {
+	return errors.Is(err, syscall.ENAMETOOLONG) || errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.EILSEQ)
+}
+
+// HandleMKD creates the given directory
+func (h *handler) HandleMKD(dir string) {
+	if dir == "" {
+		h.writeError501Args()
+		return
+	}
+
+	// make sure path is absolute
+	dir, err := h.resolvePath(h.dir, dir)
+	if err != nil {
+		h.logError(err)
+		h.writeError550FileAction()
+		return
+	}
+
+	if err := os.Mkdir(dir, h.config.dirMode); err != nil {
+		h.logError(err)
+		h.writeError550FileAction()
+		return
+	}
+
+	h.writeReply(newReply(StatusPathCreated, fmt.Sprintf("%s created.", quotePath(dir))))
+}
+
+// HandleTYPE sets the representation type used for transfers. Sessions start with
+// the type set by default_transfer_type, binary unless configured otherwise, and
+// return to it on REIN. Line endings are only translated in ASCII mode, except
+// for listings, which are always sent as ASCII.
+func (h *handler) HandleTYPE(arg string) {
+	switch strings.ToUpper(arg) {
+	case "A", "A N":
+		h.transferType = typeASCII
+		h.writeReply(newReply(StatusCommandOK, "Switching to ASCII mode."))
+	case "I", "L 8":
+		h.transferType = typeBinary
+		h.writeReply(newReply(StatusCommandOK, "Switching to Binary mode."))
+	case "":
+		h.writeError501Args()
+	default:
+		h.writeReply(newReply(StatusNotImplementedParameter, fmt.Sprintf("TYPE %s not implemented.", arg)))
+	}
+}
+
+// HandleMODE sets the transfer mode. Stream mode and zlib compressed streams are
+// supported.
+func (h *handler) HandleMODE(arg string) {
+	switch strings.ToUpper(arg) {
+	case modeStream:
+		h.transferMode = modeStream
+		h.writeReply(newReply(StatusCommandOK, "Mode set to S."))
+	case modeZlib:
+		h.transferMode = modeZlib
+		h.writeReply(newReply(StatusCommandOK, "Mode set to Z."))
+	case "":
+		h.writeError501Args()
+	default:
+		h.writeReply(newReply(StatusNotImplementedParameter, fmt.Sprintf("MODE %s not implemented.", arg)))
+	}
+}
+
+// HandleSTRU sets the file structure. Only the file structure is supported, the
+// record and page structures are refused.
+func (h *handler) HandleSTRU(arg string) {
+	switch strings.ToUpper(arg) {
+	case struFile:
+		h.structure = struFile
+		h.writeReply(newReply(StatusCommandOK, "Structure set to F."))
+	case "":
+		h.writeError501Args()
+	default:
+		h.writeReply(newReply(StatusNotImplementedParameter, fmt.Sprintf("STRU %s not implemented.", arg)))
+	}
+}
+
+// startTransfer checks that a data connection was set up for the transfer about to
+// begin, returning errDataConnNotSetUp if not. The connection is only good for one
+// transfer, so the caller closes it once the transfer is over.
+func (h *handler) startTransfer() error {
+	if h.dataConn == nil {
+		return errDataConnNotSetUp
+	}
+
+	return nil
+}
+
+// data returns the data connection, compressing transfers in MODE Z. The bytes
+// transferred are counted in the session's statistics.
+func (h *handler) data() serverDataConn {
+	conn := h.dataConn
+	if h.transferMode == modeZlib {
+		conn = serverZlibDataConn{conn}
+	}
+
+	return countingDataConn{conn, &h.stats}
+}
+
+// HandleSTAT writes the status of the session, including the negotiated transfer
+// settings
+func (h *handler) HandleSTAT(arg string) {
+	if arg != "" {
+		h.writeReply(newReply(StatusNotImplementedParameter, "STAT with an argument not implemented."))
+		return
+	}
+
+	user := "Not logged in"
+	if h.isLoggedIn {
+		user = "Logged in as " + h.username
+	}
+
+	typ := "ASCII"
+	if h.transferType == typeBinary {
+		typ = "BINARY"
+	}
+
+	mode := h.transferMode
+	switch mode {
+	case modeStream:
+		mode = "STREAM"
+	case modeZlib:
+		mode = "ZLIB"
+	}
+
+	structure := h.structure
+	if structure == struFile {
+		structure = "FILE"
+	}
+
+	dataConn := "No data connection"
+	switch dc := h.dataConn.(type) {
+	case *serverActiveDataConn:
+		dataConn = "Active data connection to " + dc.address
+	case *serverPassiveDataConn:
+		dataConn = fmt.Sprintf("Passive data connection listening on %v", dc.ln.Addr())
+	}
+
+	msg := fmt.Sprintf("Server status:\nConnected to %v\n%s\nType: %s\nMode: %s\nStructure: %s\n%s\nEnd of status",
+		h.conn.RemoteAddr(), user, typ, mode, structure, dataConn)
+	h.writeReply(newReply(StatusSystem, msg))
+}
+
+// HandleSITE executes site specific commands
+func (h *handler) HandleSITE(arg string) {
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		h.writeError501Args()
+		return
+	}
+
+	switch strings.ToUpper(fields[0]) {
+	case "EOL":
+		h.handleSiteEOL(fields[1:])
+	default:
+		h.writeReply(newReply(StatusNotImplementedParameter, fmt.Sprintf("SITE %s not implemented.", fields[0])))
+	}
+}
+
+// handleSiteEOL sets the line ending used for ASCII transfers
+func (h *handler) handleSiteEOL(args []string) {
+	if len(args) != 1 {
+		h.writeError501Args()
+		return
+	}
+
+	eol, ok := parseEOL(args[0])
+	if !ok {
+		h.writeError501Args()
+		return
+	}
+
+	h.eol = eol
+	h.writeReply(newReply(StatusCommandOK, fmt.Sprintf("ASCII line endings set to %s.", strings.ToUpper(args[0]))))
+}
+
+// CommandHELP writes a multi line help message, or the syntax of the command
+// given as an argument
+func (h *handler) HandleHELP(arg string) {
+	if arg != "" {
+		code := CommandCode(strings.ToUpper(arg))
+		if target, ok := h.config.aliases[code]; ok {
+			code = target
+		}
+
+		spec, ok := commandSpecs[code]
+		if !ok {
+			h.writeReply(newReply(StatusNotImplemented, fmt.Sprintf("Unknown command %s.", strings.ToUpper(arg))))
+			return
+		}
+
+		h.writeReply(newReply(StatusHelp, "Syntax: "+spec.syntax))
+		return
+	}
+
+	h.writeReply(newReply(StatusHelp, helpMessage()))
+}
+
+// HandleFEAT writes the list of supported extensions
+func (h *handler) HandleFEAT(arg string) {
+	if arg != "" {
+		h.writeError501Args()
+		return
+	}
+
+	h.writeReply(newReply(StatusSystem, "Extensions supported:\n"+strings.Join(h.features(), "\n")))
+}
+
+// HandleOPTS sets options for other commands: UTF8, which can only be turned on
+// as paths are always treated as UTF-8, the facts reported by MLST and MLSD, and
+// the algorithm used by HASH.
+func (h *handler) HandleOPTS(arg string) {
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		h.writeError501Args()
+		return
+	}
+
+	switch strings.ToUpper(fields[0]) {
+	case "UTF8":
+		if len(fields) != 2 {
+			h.writeError501Args()
+			return
+		}
+		if strings.ToUpper(fields[1]) != "ON" {
+			h.writeReply(newReply(StatusNotImplementedParameter, "UTF8 cannot be turned off."))
+			return
+		}
+		h.writeReply(newReply(StatusCommandOK, "Always in UTF8 mode."))
+	case "MLST":
+		h.handleOptsMLST(fields[1:])
+	case "HASH":
+		h.handleOptsHASH(fields[1:])
+	default:
+		h.writeReply(newReply(StatusBadArguments, fmt.Sprintf("Option %s not recognized.", fields[0])))
+	}
+}
+
+// handleOptsMLST selects the facts reported by MLST and MLSD. Facts the server
+// doesn't support are ignored, and the reply lists those that were selected.
+func (h *handler) handleOptsMLST(args []string) {
+	if len(args) > 1 {
+		h.writeError501Args()
+		return
+	}
+
+	var arg string
+	if len(args) == 1 {
+		arg = args[0]
+	}
+
+	h.mlstFacts = parseMLSTFacts(arg)
+
+	var selected string
+	for _, fact := range h.mlstFacts {
+		selected += fact + ";"
+	}
+	h.writeReply(newReply(StatusCommandOK, "MLST OPTS "+selected))
+}
+
+// handleOptsHASH selects the algorithm used by HASH, or with no argument reports
+// the one currently selected
+func (h *handler) handleOptsHASH(args []string) {
+	switch len(args) {
+	case 0:
+		// report the current algorithm
+	case 1:
+		if newHashAlgorithm(args[0]) == nil {
+			h.writeReply(newReply(StatusNotImplementedParameter, fmt.Sprintf("Unknown algorithm %s.", args[0])))
+			return
+		}
+		h.hashAlgorithm = strings.ToUpper(args[0])
+	default:
+		h.writeError501Args()
+		return
+	}
+
+	h.writeReply(newReply(StatusCommandOK, h.hashAlgorithm))
+}
+
+// availableSpace reports the space AVBL replies with. It is a variable so tests
+// can substitute a known figure for that of the real filesystem.
+var availableSpace = freeSpace
+
+// HandleAVBL writes the number of bytes available for uploads in the given
+// directory, or the current directory if none is given
+func (h *handler) HandleAVBL(dir string) {
+	p, err := h.resolvePath(h.dir, dir)
+	if err != nil {
+		h.logError(err)
+		h.writeError550FileAction()
+		return
+	}
+
+	// make sure directory exists
+	info, err := os.Stat(p)
+	if err != nil {
+		h.logError(err)
+		h.writeError550FileAction()
+		return
+	}
+
+	if !info.IsDir() {
+		h.writeReply(newReply(StatusFileUnavailable, fmt.Sprintf("%s: not a directory", dir)))
+		return
+	}
+
+	avail, err := availableSpace(p)
+	if err != nil {
+		h.logError(err)
+		h.writeError550FileAction()
+		return
+	}
+
+	h.writeReply(newReply(StatusFile, fmt.Sprintf("%d", avail)))
+}
+
+// HandleSIZE writes the size of the given file in bytes
+func (h *handler) HandleSIZE(file string) {
+	info, ok := h.statRegularFile(file)
+	if !ok {
+		return
+	}
+
+	h.writeReply(newReply(StatusFile, fmt.Sprintf("%d", info.Size())))
+}
+
+// HandleMDTM writes the modification time of the given file in UTC
+func (h *handler) HandleMDTM(file string) {
+	info, ok := h.statRegularFile(file)
+	if !ok {
+		return
+	}
+
+	h.writeReply(newReply(StatusFile, info.ModTime().UTC().Format(mdtmLayout)))
+}
+
+// HandleMFMT sets the modification time of a file to the UTC time given in the
+// same form as the replies to MDTM
+func (h *handler) HandleMFMT(arg string) {
+	fields := strings.SplitN(arg, " ", 2)
+	if len(fields) != 2 || len(fields[0]) != len(mdtmLayout) {
+		h.writeError501Args()
+		return
+	}
+
+	t, err := time.Parse(mdtmLayout, fields[0])
+	if err != nil {
+		h.writeError501Args()
+		return
+	}
+
+	if _, ok := h.statRegularFile(fields[1]); !ok {
+		return
+	}
+
+	file, err := h.resolvePath(h.dir, fields[1])
+	if err == nil {
+		err = os.Chtimes(file, t, t)
+	}
+	if err != nil {
+		h.logError(err)
+		h.writeError550FileAction()
+		return
+	}
+
+	h.writeReply(newReply(StatusFile, fmt.Sprintf("Modify=%s; %s", fields[0], fields[1])))
+}
+
+// HandleXCRC writes the CRC32 checksum of a file in hexadecimal
+func (h *handler) HandleXCRC(file string) {
+	h.writeChecksum(file, crc32.NewIEEE())
+}
+
+// HandleXMD5 writes the MD5 checksum of a file in hexadecimal
+func (h *handler) HandleXMD5(file string) {
+	h.writeChecksum(file, md5.New())
+}
+
+// HandleHASH writes the checksum of a file using the algorithm selected with OPTS
+// HASH, along with the byte range it covers, as described in the HASH draft
+func (h *handler) HandleHASH(file string) {
+	info, ok := h.statRegularFile(file)
+	if !ok {
+		return
+	}
+
+	p, err := h.resolvePath(h.dir, file)
+	if err != nil {
+		h.logError(err)
+		h.writeError550FileAction()
+		return
+	}
+
+	sum, err := fileChecksum(p, newHashAlgorithm(h.hashAlgorithm))
+	if err != nil {
+		h.logError(err)
+		h.writeError550FileAction()
+		return
+	}
+
+	h.writeReply(newReply(StatusFile, fmt.Sprintf("%s 0-%d %s %s", h.hashAlgorithm, info.Size(), sum, file)))
+}
+
+// writeChecksum streams file through digest and writes the result
+func (h *handler) writeChecksum(file string, digest hash.Hash) {
+	if _, ok := h.statRegularFile(file); !ok {
+		return
+	}
+
+	p, err := h.resolvePath(h.dir, file)
+	if err != nil {
+		h.logError(err)
+		h.writeError550FileAction()
+		return
+	}
+
+	sum, err := fileChecksum(p, digest)
+	if err != nil {
+		h.logError(err)
+		h.writeError550FileAction()
+		return
+	}
+
+	h.writeReply(newReply(StatusRequestedFileActionOK, sum))
+}
+
+// statRegularFile returns information about file, replying 550 and returning false
+// if it does not exist or is not a regular file
+func (h *handler) statRegularFile(file string) (os.FileInfo, bool) {
+	if file == "" {
+		h.writeError501Args()
+		return nil, false
+	}
+
+	file, err := h.resolvePath(h.dir, file)
+	if err != nil {
+		h.logError(err)
+		h.writeError550FileAction()
+		return nil, false
+	}
+
+	info, err := os.Stat(file)
+	if err != nil || !info.Mode().IsRegular() {
+		h.writeError550FileAction()
+		return nil, false
+	}
+
+	return info, true
+}
+
+// HandleCLNT records the name of the client software for the log
+func (h *handler) HandleCLNT(arg string) {
+	if arg == "" {
+		h.writeError501Args()
+		return
+	}
+
+	h.clientName = arg
+	h.logMessage(fmt.Sprintf("Client identified as %s", arg))
+	h.writeReply(newReply(StatusCommandOK, "Noted."))
+}
+
+// HandleREIN returns the session to the state it was in when the client
+// connected, logging the user out while keeping the control connection open
+func (h *handler) HandleREIN(arg string) {
+	if h.username != "" {
+		h.logMessage(fmt.Sprintf("User %s logged out.", h.username))
+	}
+	h.resetSession()
+	h.writeReply(newReply(StatusReady, "Service ready for new user."))
+}
+
+// HandleQUIT closes the connecction and writes a goodbye message. Transfers run to
+// completion within the command loop, so any transfer has been flushed by the time
+// QUIT is read; the data connection is released before saying goodbye.
+func (h *handler) HandleQUIT(arg string) {
+	h.closeDataConn()
+	h.writeReply(newReply(StatusClosing, "Goodbye."))
+}
+
+// netProtocol returns the RFC 2428 network protocol number of addr, 1 for IPv4
+// and 2 for IPv6
+func netProtocol(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok && tcp.IP.To4() == nil {
+		return "2"
+	}
+	return "1"
 }
 
 // parseEPRTArg creates an address out of an eprt command argument
@@ -0,0 +1,84 @@
+package ftp
+
+import (
+	"fmt"
+	"strings"
+)
+
+// commandHelp describes a client command for the local help
+type commandHelp struct {
+	name, usage, description string
+}
+
+// clientCommands lists the commands understood by the client in the order they
+// are shown by the local help
+var clientCommands = []commandHelp{
+	{"cd", "cd <path>", "change the remote directory"},
+	{"cdup", "cdup", "change to the parent of the remote directory"},
+	{"pwd", "pwd", "print the remote directory"},
+	{"ls", "ls [path]", "list a remote directory"},
+	{"get", "get [-r [-n]] [-f] <filename> [local path]", "download a file, or a directory tree with -r, -n to only list it, -f to overwrite local files"},
+	{"put", "put [-r [-n]] <filename>", "upload a file, or a directory tree with -r, -n to only list it"},
+	{"mget", "mget <pattern> [pattern ...]", "download the remote files matching the patterns"},
+	{"mput", "mput <pattern> [pattern ...]", "upload the local files matching the patterns"},
+	{"prompt", "prompt", "toggle asking before each file of mget and mput"},
+	{"reinit", "reinit", "reset the session and log in again, possibly as another user"},
+	{"debug", "debug", "toggle printing the commands and raw replies exchanged with the server"},
+	{"append", "append <local file> [remote file]", "append a local file to a remote file"},
+	{"du", "du [-d] [directory]", "total the size of a remote directory tree, -d for each directory"},
+	{"mkdir", "mkdir <directory>", "create a remote directory"},
+	{"size", "size <filename> [filename ...]", "print the size of remote files"},
+	{"modtime", "modtime <filename>", "print the modification time of a remote file"},
+	{"hash", "hash <filename>", "print the checksum of a remote file using the server's HASH command"},
+	{"verify", "verify <remote file> [local file]", "compare the checksums of a remote file and a local copy"},
+	{"avbl", "avbl [path]", "print the space available on the server"},
+	{"lcd", "lcd [path]", "change the local directory"},
+	{"lpwd", "lpwd", "print the local directory"},
+	{"lls", "lls [path]", "list a local directory"},
+	{"passive", "passive", "use passive data connections"},
+	{"auto", "auto", "use passive data connections, falling back to active"},
+	{"active", "active", "use active data connections"},
+	{"extended", "extended <on|off>", "prefer EPSV/EPRT over PASV/PORT"},
+	{"binary", "binary", "use binary transfers"},
+	{"ascii", "ascii", "use ascii transfers"},
+	{"mode", "mode [active|passive|auto] [extended|legacy] [ascii|binary] [stream|compressed]", "display or change the transfer configuration"},
+	{"help", "help [command]", "display the commands supported by the server, or the syntax of one"},
+	{"?", "? [command]", "display the client commands, or the usage of one"},
+	{"exit", "exit", "close the connection and exit"},
+}
+
+// commandAliases maps alternative command names to those in clientCommands
+var commandAliases = map[string]string{
+	"pasv":  "passive",
+	"ext":   "extended",
+	"bin":   "binary",
+	"image": "binary",
+	"quit":  "exit",
+}
+
+// printLocalHelp prints the usage of the named client command, or of every
+// command if name is empty
+func printLocalHelp(name string) {
+	if name == "" {
+		fmt.Println("Commands:")
+		for _, c := range clientCommands {
+			fmt.Printf("  %-10s %s\n", c.name, c.description)
+		}
+		fmt.Println("Use \"? <command>\" for the usage of a command.")
+		return
+	}
+
+	name = strings.ToLower(name)
+	if alias, ok := commandAliases[name]; ok {
+		name = alias
+	}
+
+	for _, c := range clientCommands {
+		if c.name == name {
+			fmt.Printf("Usage: %s\n  %s\n", c.usage, c.description)
+			return
+		}
+	}
+
+	fmt.Printf("Unknown command %s.\n", name)
+}
@@ -0,0 +1,29 @@
+package ftp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLocalHelp(t *testing.T) {
+	c, _ := startTestClient(t)
+
+	out := captureStdout(t, func() { c.executeCommand("?") })
+	for _, cmd := range clientCommands {
+		if !strings.Contains(out, "  "+cmd.name+" ") {
+			t.Errorf("? doesn't list %s:\n%s", cmd.name, out)
+		}
+	}
+
+	for _, tt := range []struct{ cmd, want string }{
+		{"? get", "Usage: get [-r [-n]] [-f] <filename> [local path]"},
+		{"? GET", "Usage: get "},
+		{"? quit", "Usage: exit"},
+		{"? bogus", "Unknown command bogus."},
+		{"? get put", "Usage: ? [command]"},
+	} {
+		if out := captureStdout(t, func() { c.executeCommand(tt.cmd) }); !strings.Contains(out, tt.want) {
+			t.Errorf("%s printed %q, want %q", tt.cmd, out, tt.want)
+		}
+	}
+}
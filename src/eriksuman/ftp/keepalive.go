@@ -0,0 +1,31 @@
+package ftp
+
+import (
+	"net"
+	"time"
+)
+
+// default interval between TCP keepalive probes on control connections
+const defaultKeepAlive = 15 * time.Second
+
+// setKeepAlive enables TCP keepalive probes on conn every period, so idle
+// control connections aren't dropped by NAT devices and firewalls. A period of
+// zero or less disables them. Connections other than TCP are left unchanged.
+func setKeepAlive(conn net.Conn, period time.Duration) error {
+	if pc, ok := conn.(*proxiedConn); ok {
+		conn = pc.Conn
+	}
+
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	if period <= 0 {
+		return tc.SetKeepAlive(false)
+	}
+	if err := tc.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return tc.SetKeepAlivePeriod(period)
+}
@@ -0,0 +1,75 @@
+package ftp
+
+import (
+	"errors"
+	"sync"
+)
+
+// connection limit errors
+var errTooManyConns = errors.New("too many connections")
+var errTooManyConnsFromIP = errors.New("too many connections from this address")
+
+// connLimiter bounds the number of concurrent connections, both in total and from
+// any single IP address. A limit of zero means unlimited.
+type connLimiter struct {
+	// semaphore holding a slot for each active connection
+	sem chan struct{}
+	// maximum connections per IP address
+	perIP int
+	// active connections per IP address
+	ips  map[string]int
+	lock sync.Mutex
+}
+
+// newConnLimiter creates a connLimiter allowing max total connections and perIP
+// connections from each address
+func newConnLimiter(max, perIP int) *connLimiter {
+	c := &connLimiter{
+		perIP: perIP,
+		ips:   make(map[string]int),
+	}
+
+	if max > 0 {
+		c.sem = make(chan struct{}, max)
+	}
+
+	return c
+}
+
+// acquire reserves a connection slot for ip, failing without blocking if a
+// limit has been reached
+func (c *connLimiter) acquire(ip string) error {
+	if c.sem != nil {
+		select {
+		case c.sem <- struct{}{}:
+		default:
+			return errTooManyConns
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.perIP > 0 && c.ips[ip] >= c.perIP {
+		if c.sem != nil {
+			<-c.sem
+		}
+		return errTooManyConnsFromIP
+	}
+	c.ips[ip]++
+
+	return nil
+}
+
+// release frees a connection slot held by ip
+func (c *connLimiter) release(ip string) {
+	c.lock.Lock()
+	c.ips[ip]--
+	if c.ips[ip] <= 0 {
+		delete(c.ips, ip)
+	}
+	c.lock.Unlock()
+
+	if c.sem != nil {
+		<-c.sem
+	}
+}
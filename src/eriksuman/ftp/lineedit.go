@@ -0,0 +1,237 @@
+package ftp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// maximum number of lines kept in the command history
+const maxHistory = 500
+
+// lineEditor reads command lines from the user. On a terminal the line can be
+// edited with the arrow keys and common control keys, and previous lines recalled
+// with up and down. Otherwise lines are read as they are.
+type lineEditor struct {
+	in      *bufio.Reader
+	out     io.Writer
+	history []string
+}
+
+func newLineEditor(in *bufio.Reader, out io.Writer) *lineEditor {
+	return &lineEditor{in: in, out: out}
+}
+
+// editing keys, as decoded from control characters and escape sequences
+type editKey int
+
+const (
+	keyNone editKey = iota
+	keyUp
+	keyDown
+	keyLeft
+	keyRight
+	keyHome
+	keyEnd
+	keyDelete
+)
+
+// readLine prints prompt and returns the line the user enters, without its line
+// ending. The line is added to the history.
+func (e *lineEditor) readLine(prompt string) (string, error) {
+	if !isTerminal() {
+		return e.readPlain(prompt)
+	}
+
+	restore, err := makeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		return e.readPlain(prompt)
+	}
+	defer restore()
+
+	var line []rune
+	pos := 0
+	// position in the history, len(history) while editing a new line, and the
+	// new line saved while browsing the history
+	hist := len(e.history)
+	var pending []rune
+
+	recall := func(i int) {
+		if hist == len(e.history) {
+			pending = line
+		}
+		hist = i
+		if hist == len(e.history) {
+			line = pending
+		} else {
+			line = []rune(e.history[hist])
+		}
+		pos = len(line)
+	}
+
+	e.refresh(prompt, line, pos)
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			fmt.Fprint(e.out, "\r\n")
+			return "", err
+		}
+
+		key := keyNone
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\r\n")
+			s := string(line)
+			e.addHistory(s)
+			return s, nil
+		case 3: // ctrl-c abandons the line
+			fmt.Fprint(e.out, "^C\r\n")
+			line, pos, hist = nil, 0, len(e.history)
+		case 4: // ctrl-d ends input on an empty line
+			if len(line) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+			key = keyDelete
+		case 1:
+			key = keyHome
+		case 5:
+			key = keyEnd
+		case 2:
+			key = keyLeft
+		case 6:
+			key = keyRight
+		case 16:
+			key = keyUp
+		case 14:
+			key = keyDown
+		case 0x7f, '\b':
+			if pos > 0 {
+				line = append(line[:pos-1:pos-1], line[pos:]...)
+				pos--
+			}
+		case 11: // ctrl-k deletes to the end of the line
+			line = line[:pos:pos]
+		case 21: // ctrl-u deletes to the start of the line
+			line = append([]rune(nil), line[pos:]...)
+			pos = 0
+		case 0x1b:
+			key = e.readEscape()
+		default:
+			if unicode.IsPrint(r) {
+				line = append(line[:pos:pos], append([]rune{r}, line[pos:]...)...)
+				pos++
+			}
+		}
+
+		switch key {
+		case keyUp:
+			if hist > 0 {
+				recall(hist - 1)
+			}
+		case keyDown:
+			if hist < len(e.history) {
+				recall(hist + 1)
+			}
+		case keyLeft:
+			if pos > 0 {
+				pos--
+			}
+		case keyRight:
+			if pos < len(line) {
+				pos++
+			}
+		case keyHome:
+			pos = 0
+		case keyEnd:
+			pos = len(line)
+		case keyDelete:
+			if pos < len(line) {
+				line = append(line[:pos:pos], line[pos+1:]...)
+			}
+		}
+
+		e.refresh(prompt, line, pos)
+	}
+}
+
+// readPlain prints prompt and reads a line without editing
+func (e *lineEditor) readPlain(prompt string) (string, error) {
+	fmt.Fprint(e.out, prompt)
+	s, err := e.in.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	s = strings.TrimSuffix(s, "\n")
+	e.addHistory(s)
+	return s, nil
+}
+
+// readEscape decodes the rest of an escape sequence sent by a key, returning
+// keyNone for keys which aren't supported
+func (e *lineEditor) readEscape() editKey {
+	r, _, err := e.in.ReadRune()
+	if err != nil || (r != '[' && r != 'O') {
+		return keyNone
+	}
+
+	// sequences are either a single letter or a number ending in ~
+	seq := ""
+	for {
+		r, _, err = e.in.ReadRune()
+		if err != nil {
+			return keyNone
+		}
+		seq += string(r)
+		if r < '0' || r > '9' {
+			break
+		}
+	}
+
+	switch seq {
+	case "A":
+		return keyUp
+	case "B":
+		return keyDown
+	case "C":
+		return keyRight
+	case "D":
+		return keyLeft
+	case "H", "1~", "7~":
+		return keyHome
+	case "F", "4~", "8~":
+		return keyEnd
+	case "3~":
+		return keyDelete
+	}
+	return keyNone
+}
+
+// refresh redraws the prompt and line, placing the cursor at pos. Lines are
+// assumed to fit within the width of the terminal.
+func (e *lineEditor) refresh(prompt string, line []rune, pos int) {
+	fmt.Fprintf(e.out, "\r%s%s\x1b[K", prompt, string(line))
+	if n := len(line) - pos; n > 0 {
+		fmt.Fprintf(e.out, "\x1b[%dD", n)
+	}
+}
+
+// addHistory appends line to the history, skipping blank lines and repeats of the
+// previous line
+func (e *lineEditor) addHistory(line string) {
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	if n := len(e.history); n > 0 && e.history[n-1] == line {
+		return
+	}
+
+	e.history = append(e.history, line)
+	if len(e.history) > maxHistory {
+		e.history = e.history[1:]
+	}
+}
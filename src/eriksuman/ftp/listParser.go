@@ -0,0 +1,154 @@
+package ftp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FileInfo describes a single entry of a directory listing
+type FileInfo struct {
+	Name    string
+	Size    int64
+	Mode    os.FileMode
+	ModTime time.Time
+	// LinkTarget is the target of a symbolic link, empty for other entries
+	LinkTarget string
+}
+
+// IsDir reports whether the entry is a directory
+func (f FileInfo) IsDir() bool {
+	return f.Mode.IsDir()
+}
+
+// lsLineRegex matches a line of Unix "ls -l" output. The groups are the
+// permission string, size, month, day, time or year, and name.
+var lsLineRegex = regexp.MustCompile(`^([-bcdlps][-rwxsStTl]{9})[.+@]?\s+\d+\s+.*?\s+(\d+)\s+` +
+	`(Jan|Feb|Mar|Apr|May|Jun|Jul|Aug|Sep|Oct|Nov|Dec)\s+(\d{1,2})\s+(\d{1,2}:\d{2}|\d{4})\s(.*)$`)
+
+// parseList parses the lines of a Unix style directory listing. Lines which are
+// not entries, such as the "total" line, are skipped.
+func parseList(data []byte) ([]FileInfo, error) {
+	var entries []FileInfo
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := strings.TrimRight(s.Text(), "\r")
+		if line == "" || strings.HasPrefix(line, "total ") {
+			continue
+		}
+
+		entry, err := parseListLine(line, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, *entry)
+	}
+
+	return entries, s.Err()
+}
+
+// parseListLine parses a single line of "ls -l" output. now is used to determine
+// the year of recent entries, which are listed with a time instead of a year.
+func parseListLine(line string, now time.Time) (*FileInfo, error) {
+	m := lsLineRegex.FindStringSubmatch(line)
+	if m == nil {
+		return nil, fmt.Errorf("unrecognized listing line: %s", line)
+	}
+
+	entry := &FileInfo{Mode: parsePermissions(m[1])}
+
+	size, err := strconv.ParseInt(m[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid size in listing line: %s", line)
+	}
+	entry.Size = size
+
+	entry.ModTime, err = parseListTime(m[3], m[4], m[5], now)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time in listing line: %s", line)
+	}
+
+	// the name of a link is followed by its target
+	entry.Name = strings.TrimLeft(m[6], " ")
+	if entry.Mode&os.ModeSymlink != 0 {
+		if ind := strings.Index(entry.Name, " -> "); ind != -1 {
+			entry.LinkTarget = entry.Name[ind+4:]
+			entry.Name = entry.Name[:ind]
+		}
+	}
+
+	return entry, nil
+}
+
+// parseListTime parses the date columns of an "ls -l" line. Entries modified in
+// the last six months show a time rather than a year; their year is the one that
+// places them closest to now without being in the future.
+func parseListTime(month, day, timeOrYear string, now time.Time) (time.Time, error) {
+	if strings.Contains(timeOrYear, ":") {
+		t, err := time.ParseInLocation("Jan 2 15:04 2006",
+			fmt.Sprintf("%s %s %s %d", month, day, timeOrYear, now.Year()), time.Local)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		// allow a day of clock skew before deciding the entry is from last year
+		if t.After(now.Add(24 * time.Hour)) {
+			t = t.AddDate(-1, 0, 0)
+		}
+		return t, nil
+	}
+
+	return time.ParseInLocation("Jan 2 2006", fmt.Sprintf("%s %s %s", month, day, timeOrYear), time.Local)
+}
+
+// parsePermissions converts a permission string such as drwxr-xr-x into a mode
+func parsePermissions(perm string) os.FileMode {
+	var mode os.FileMode
+	switch perm[0] {
+	case 'd':
+		mode |= os.ModeDir
+	case 'l':
+		mode |= os.ModeSymlink
+	case 'p':
+		mode |= os.ModeNamedPipe
+	case 's':
+		mode |= os.ModeSocket
+	case 'c':
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case 'b':
+		mode |= os.ModeDevice
+	}
+
+	// read, write, and execute bits for user, group, and other
+	for i, c := range perm[1:10] {
+		bit := os.FileMode(1 << uint(8-i))
+		switch c {
+		case 'r', 'w', 'x':
+			mode |= bit
+		case 's':
+			mode |= bit | setBit(i)
+		case 'S', 'l':
+			mode |= setBit(i)
+		case 't':
+			mode |= bit | os.ModeSticky
+		case 'T':
+			mode |= os.ModeSticky
+		}
+	}
+
+	return mode
+}
+
+// setBit returns the setuid or setgid bit for the execute position i of a
+// permission string
+func setBit(i int) os.FileMode {
+	if i == 2 {
+		return os.ModeSetuid
+	}
+	return os.ModeSetgid
+}
@@ -1,10 +1,12 @@
 package ftp
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"path"
+	"strings"
 	"sync"
 	"time"
 )
@@ -15,81 +17,321 @@ const (
 	currentFileName  = logFileNameBase + logFileExtension
 )
 
+// logLevel is the severity of a log entry. Entries below the logger's level are
+// dropped.
+type logLevel int
+
+// enumeration for logLevel, from most to least verbose
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+// String returns the name of the level as used in the config file
+func (l logLevel) String() string {
+	switch l {
+	case levelDebug:
+		return "debug"
+	case levelInfo:
+		return "info"
+	case levelWarn:
+		return "warn"
+	case levelError:
+		return "error"
+	default:
+		return fmt.Sprintf("logLevel(%d)", int(l))
+	}
+}
+
+// MarshalText encodes the level by name in JSON log entries
+func (l logLevel) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// parseLogLevel converts the name of a level to a logLevel
+func parseLogLevel(name string) (logLevel, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return levelDebug, nil
+	case "info":
+		return levelInfo, nil
+	case "warn", "warning":
+		return levelWarn, nil
+	case "error":
+		return levelError, nil
+	default:
+		return 0, fmt.Errorf("unrecognized log level %s", name)
+	}
+}
+
+// logFormat is the encoding of log entries
+type logFormat int
+
+// enumeration for logFormat
+const (
+	// free-form text, one timestamped line per entry
+	formatText logFormat = iota
+	// one JSON object per line
+	formatJSON
+)
+
+// parseLogFormat converts the name of a format to a logFormat
+func parseLogFormat(name string) (logFormat, error) {
+	switch strings.ToLower(name) {
+	case "text":
+		return formatText, nil
+	case "json":
+		return formatJSON, nil
+	default:
+		return 0, fmt.Errorf("unrecognized log format %s", name)
+	}
+}
+
+// directions of the commands and replies in log entries
+const (
+	directionSend    = "send"
+	directionReceive = "receive"
+)
+
+// logEntry is a single entry written to a log
+type logEntry struct {
+	Time      time.Time `json:"timestamp"`
+	Level     logLevel  `json:"level"`
+	Direction string    `json:"direction,omitempty"`
+	Remote    string    `json:"remote,omitempty"`
+	Message   string    `json:"message"`
+}
+
+// newLogEntry returns an entry for msg timestamped with the current time
+func newLogEntry(level logLevel, direction, remote, msg string) logEntry {
+	return logEntry{
+		Time:      time.Now(),
+		Level:     level,
+		Direction: direction,
+		Remote:    remote,
+		Message:   msg,
+	}
+}
+
+// format encodes the entry as a single line, without the line ending
+func (e logEntry) format(f logFormat) string {
+	if f == formatJSON {
+		if b, err := json.Marshal(e); err == nil {
+			return string(b)
+		}
+	}
+
+	msg := e.Message
+	switch {
+	case e.Direction == directionSend:
+		msg = "Sent " + msg
+	case e.Direction == directionReceive:
+		msg = "Received " + msg
+	case e.Level == levelError:
+		msg = "Error: " + msg
+	case e.Level == levelWarn:
+		msg = "Warning: " + msg
+	}
+
+	// the remote address tells apart the lines of concurrent connections
+	if e.Remote != "" {
+		msg = e.Remote + " " + msg
+	}
+
+	return fmt.Sprintf("%s: %s", e.Time.Format(time.StampMicro), msg)
+}
+
+// logger writes log entries at a level. Sent and received commands are logged
+// at debug, messages at info and errors at error.
 type logger interface {
 	logMessage(msg string)
+	logWarning(msg string)
 	logSend(msg string)
 	logReceive(msg string)
 	logError(err error)
+	// forConn returns a logger which records remote as the address of the
+	// client in every entry
+	forConn(remote string) logger
 	close() error
 }
 
 type rolledLogger struct {
 	currentFile io.WriteCloser
 	lock        sync.Locker
+	// entries below level are dropped
+	level  logLevel
+	format logFormat
+	// directory holding the logs and the number of old files kept in it
+	dir string
+	max int
+	// size in bytes at which the current file is rolled, 0 for no limit, and the
+	// bytes written to the current file so far
+	maxSize, size int64
 }
 
-func newRolledLogger(dirPath string, max int) (*rolledLogger, error) {
-	if err := rollFiles(dirPath, 0, max); err != nil {
-		return nil, err
-	}
-
-	if dir, err := os.Stat(dirPath); os.IsNotExist(err) {
+func newRolledLogger(dirPath string, max int, maxSize int64, level logLevel, format logFormat) (*rolledLogger, error) {
+	if _, err := os.Stat(dirPath); os.IsNotExist(err) {
 		if err := os.Mkdir(dirPath, 0777); err != nil {
 			return nil, err
 		}
-	} else {
-		p := path.Join(dirPath, currentFileName)
-		if _, err := os.Stat(p); !os.IsNotExist(err) {
-			new := path.Join(dirPath, fmt.Sprintf("%s-%03d%s", logFileNameBase, 0, logFileExtension))
-			if err := os.Rename(p, new); err != nil {
-				return nil, err
-			}
+	}
+
+	r := &rolledLogger{
+		lock:    new(sync.Mutex),
+		level:   level,
+		format:  format,
+		dir:     dirPath,
+		max:     max,
+		maxSize: maxSize,
+	}
+	if err := r.roll(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// roll closes the current log file, if any, moves it to the first numbered file
+// after shifting the older files along, and opens a new current file. The
+// caller must hold the lock once the logger is in use.
+func (r *rolledLogger) roll() error {
+	if r.currentFile != nil {
+		r.currentFile.Close()
+		r.currentFile = nil
+	}
+
+	if err := rollFiles(r.dir, 0, r.max); err != nil {
+		return err
+	}
+
+	p := path.Join(r.dir, currentFileName)
+	if _, err := os.Stat(p); !os.IsNotExist(err) {
+		new := path.Join(r.dir, fmt.Sprintf("%s-%03d%s", logFileNameBase, 0, logFileExtension))
+		if err := os.Rename(p, new); err != nil {
+			return err
 		}
 	}
 
 	l, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	r.currentFile = l
+	r.size = 0
+	return nil
+}
+
+// write writes e if its level is at or above the logger's level. Once the
+// current file reaches the maximum size it is rolled.
+func (r *rolledLogger) write(e logEntry) {
+	if e.Level < r.level {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// a failed roll leaves no file to write to
+	if r.currentFile == nil {
+		return
 	}
 
-	return &rolledLogger{
-		currentFile: l,
-		lock:        new(sync.Mutex),
-	}, nil
+	n, _ := fmt.Fprintln(r.currentFile, e.format(r.format))
+	r.size += int64(n)
+
+	if r.maxSize > 0 && r.size >= r.maxSize {
+		if err := r.roll(); err != nil {
+			fmt.Printf("logger: rolling log file: %v\n", err)
+		}
+	}
 }
 
 // logMessage apends a timestamp and logs a message
 func (r *rolledLogger) logMessage(msg string) {
-	r.lock.Lock()
-	fmt.Fprintf(r.currentFile, "%s: %s\n", time.Now().Format(time.StampMicro), msg)
-	r.lock.Unlock()
+	r.write(newLogEntry(levelInfo, "", "", msg))
+}
+
+// logWarning appends a timestamp and logs a warning
+func (r *rolledLogger) logWarning(msg string) {
+	r.write(newLogEntry(levelWarn, "", "", msg))
 }
 
 // logSend appends a timestamp and logs a sent message
 func (r *rolledLogger) logSend(msg string) {
-	r.lock.Lock()
-	fmt.Fprintf(r.currentFile, "%s: Sent %s\n", time.Now().Format(time.StampMicro), msg)
-	r.lock.Unlock()
+	r.write(newLogEntry(levelDebug, directionSend, "", msg))
 }
 
 // logReceive appends a timestamp and logs a received message
 func (r *rolledLogger) logReceive(msg string) {
-	r.lock.Lock()
-	fmt.Fprintf(r.currentFile, "%s: Received %s\n", time.Now().Format(time.StampMicro), msg[:len(msg)-2])
-	r.lock.Unlock()
+	r.write(newLogEntry(levelDebug, directionReceive, "", msg[:len(msg)-2]))
 }
 
 // logError appends a timestamp and logs an error
 func (r *rolledLogger) logError(err error) {
-	r.lock.Lock()
-	fmt.Fprintf(r.currentFile, "%s: Error: %v\n", time.Now().Format(time.StampMicro), err)
-	r.lock.Unlock()
+	r.write(newLogEntry(levelError, "", "", err.Error()))
+}
+
+// forConn returns a logger for the connection from remote which writes to r
+func (r *rolledLogger) forConn(remote string) logger {
+	return &connLogger{r: r, remote: remote}
 }
 
 func (r *rolledLogger) close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.currentFile == nil {
+		return nil
+	}
 	return r.currentFile.Close()
 }
 
+// connLogger logs the entries of a single connection to a shared rolledLogger,
+// recording the address of the client in each
+type connLogger struct {
+	r      *rolledLogger
+	remote string
+}
+
+// logMessage apends a timestamp and logs a message
+func (c *connLogger) logMessage(msg string) {
+	c.r.write(newLogEntry(levelInfo, "", c.remote, msg))
+}
+
+// logWarning appends a timestamp and logs a warning
+func (c *connLogger) logWarning(msg string) {
+	c.r.write(newLogEntry(levelWarn, "", c.remote, msg))
+}
+
+// logSend appends a timestamp and logs a sent message
+func (c *connLogger) logSend(msg string) {
+	c.r.write(newLogEntry(levelDebug, directionSend, c.remote, msg))
+}
+
+// logReceive appends a timestamp and logs a received message
+func (c *connLogger) logReceive(msg string) {
+	c.r.write(newLogEntry(levelDebug, directionReceive, c.remote, msg[:len(msg)-2]))
+}
+
+// logError appends a timestamp and logs an error
+func (c *connLogger) logError(err error) {
+	c.r.write(newLogEntry(levelError, "", c.remote, err.Error()))
+}
+
+// forConn returns a logger for the connection from remote which writes to the
+// same rolledLogger as c
+func (c *connLogger) forConn(remote string) logger {
+	return c.r.forConn(remote)
+}
+
+// close does nothing, the shared logger is closed by its owner
+func (c *connLogger) close() error {
+	return nil
+}
+
 func rollFiles(dir string, current, max int) error {
 	cur := path.Join(dir, fmt.Sprintf("%s-%03d%s", logFileNameBase, current, logFileExtension))
 	// base case
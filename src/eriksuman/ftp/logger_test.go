@@ -0,0 +1,65 @@
+package ftp
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRolledLoggerMaxSize(t *testing.T) {
+	dir := t.TempDir()
+	l, err := newRolledLogger(dir, 2, 100, levelDebug, formatText)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each entry is over half the limit, so every second entry rolls the file
+	const entries = 20
+	for i := 0; i < entries; i++ {
+		l.logMessage(fmt.Sprintf("entry %02d %s", i, strings.Repeat("x", 30)))
+	}
+	if err := l.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	want := []string{"ftpsrv-000.log", "ftpsrv-001.log", "ftpsrv-002.log", "ftpsrv.log"}
+	if strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Fatalf("log directory holds %v, want %v", names, want)
+	}
+
+	// the files hold the most recent entries, oldest in the highest number
+	var all string
+	for i := len(want) - 2; i >= 0; i-- {
+		all += readTestFile(t, dir, want[i])
+	}
+	got := regexp.MustCompile(`entry (\d+)`).FindAllStringSubmatch(all, -1)
+	if len(got) != 6 {
+		t.Fatalf("rolled files hold %d entries, want 6:\n%s", len(got), all)
+	}
+	for i, m := range got {
+		if want := fmt.Sprintf("%02d", entries-len(got)+i); m[1] != want {
+			t.Errorf("entry %d of the rolled files is %s, want %s", i, m[1], want)
+		}
+	}
+
+	for _, name := range want[:len(want)-1] {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() < 100 {
+			t.Errorf("%s rolled at %d bytes, before reaching the maximum size", name, info.Size())
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package ftp
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// mlstFacts lists the facts MLST and MLSD can report, in the order they are
+// written
+var mlstFacts = []string{"type", "size", "modify", "perm", "unix.mode"}
+
+// defaultMLSTFacts are the facts reported until the client selects others with
+// OPTS MLST
+var defaultMLSTFacts = []string{"type", "size", "modify", "perm"}
+
+// parseMLSTFacts returns the supported facts named in the argument to OPTS MLST,
+// a list of fact names each followed by a semicolon. Unsupported facts are
+// ignored, and an empty list turns all facts off.
+func parseMLSTFacts(arg string) []string {
+	requested := make(map[string]bool)
+	for _, name := range strings.Split(arg, ";") {
+		requested[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+
+	facts := []string{}
+	for _, fact := range mlstFacts {
+		if requested[fact] {
+			facts = append(facts, fact)
+		}
+	}
+
+	return facts
+}
+
+// mlstFeature returns the MLST line advertised in reply to FEAT, with the facts
+// currently selected marked by a '*'
+func mlstFeature(selected []string) string {
+	var b strings.Builder
+	b.WriteString("MLST ")
+	for _, fact := range mlstFacts {
+		b.WriteString(fact)
+		if containsString(selected, fact) {
+			b.WriteByte('*')
+		}
+		b.WriteByte(';')
+	}
+
+	return b.String()
+}
+
+// mlstEntry formats the selected facts about a file followed by its name as a
+// line of an MLST reply or MLSD listing, without the line ending. typ overrides
+// the type fact, for the cdir entry of a listing.
+func mlstEntry(info os.FileInfo, name, typ string, facts []string) string {
+	if typ == "" {
+		typ = "file"
+		if info.IsDir() {
+			typ = "dir"
+		} else if !info.Mode().IsRegular() {
+			typ = "OS.unix=special"
+		}
+	}
+
+	var b strings.Builder
+	for _, fact := range facts {
+		switch fact {
+		case "type":
+			fmt.Fprintf(&b, "type=%s;", typ)
+		case "size":
+			// size is only meaningful for regular files
+			if info.Mode().IsRegular() {
+				fmt.Fprintf(&b, "size=%d;", info.Size())
+			}
+		case "modify":
+			fmt.Fprintf(&b, "modify=%s;", info.ModTime().UTC().Format(mdtmLayout))
+		case "perm":
+			fmt.Fprintf(&b, "perm=%s;", mlstPerm(info))
+		case "unix.mode":
+			fmt.Fprintf(&b, "unix.mode=0%o;", info.Mode().Perm())
+		}
+	}
+
+	return b.String() + " " + name
+}
+
+// mlstPerm returns the perm fact for a file, the commands the server would allow
+// on it judging by the owner's permission bits
+func mlstPerm(info os.FileInfo) string {
+	mode := info.Mode().Perm()
+	var perm string
+	if info.IsDir() {
+		if mode&0100 != 0 {
+			perm += "e"
+		}
+		if mode&0400 != 0 {
+			perm += "l"
+		}
+		if mode&0200 != 0 {
+			perm += "cm"
+		}
+		return perm
+	}
+
+	if mode&0400 != 0 {
+		perm += "r"
+	}
+	if mode&0200 != 0 {
+		perm += "aw"
+	}
+	return perm
+}
+
+// containsString reports whether s is one of a
+func containsString(a []string, s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package ftp
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// netrcEntry holds the credentials for a single machine in a .netrc file
+type netrcEntry struct {
+	login, password, account string
+}
+
+// netrcPath returns the path of the user's .netrc file
+func netrcPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, ".netrc"), nil
+}
+
+// lookupNetrc parses the .netrc file at p and returns the entry for host. If no
+// machine entry matches, the default entry is returned if present.
+func lookupNetrc(p, host string) (*netrcEntry, bool, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	// split the file into tokens, skipping macro definitions which run until
+	// the next blank line
+	var tokens []string
+	s := bufio.NewScanner(f)
+	inMacro := false
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if inMacro {
+			if len(fields) == 0 {
+				inMacro = false
+			}
+			continue
+		}
+
+		for i, field := range fields {
+			if field == "macdef" {
+				fields = fields[:i]
+				inMacro = true
+				break
+			}
+		}
+		tokens = append(tokens, fields...)
+	}
+	if err := s.Err(); err != nil {
+		return nil, false, err
+	}
+
+	var match, def, cur *netrcEntry
+	for i := 0; i < len(tokens); i++ {
+		switch tokens[i] {
+		case "machine":
+			if i+1 >= len(tokens) {
+				break
+			}
+			i++
+			cur = new(netrcEntry)
+			if match == nil && tokens[i] == host {
+				match = cur
+			}
+		case "default":
+			cur = new(netrcEntry)
+			if def == nil {
+				def = cur
+			}
+		case "login", "password", "account":
+			if i+1 >= len(tokens) || cur == nil {
+				break
+			}
+			switch tokens[i] {
+			case "login":
+				cur.login = tokens[i+1]
+			case "password":
+				cur.password = tokens[i+1]
+			case "account":
+				cur.account = tokens[i+1]
+			}
+			i++
+		}
+	}
+
+	if match != nil {
+		return match, true, nil
+	}
+	if def != nil {
+		return def, true, nil
+	}
+
+	return nil, false, nil
+}
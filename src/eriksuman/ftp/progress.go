@@ -0,0 +1,81 @@
+package ftp
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// interval between progress updates
+const progressInterval = 500 * time.Millisecond
+
+// progressWriter is an io.Writer which counts the bytes written through it and
+// periodically prints the progress and throughput of the transfer
+type progressWriter struct {
+	w   io.Writer
+	out io.Writer
+	// bytes transferred, and the expected total or -1 if unknown
+	written, total int64
+	start, last    time.Time
+}
+
+// newProgressWriter wraps w, printing progress to out. total is the expected size
+// of the transfer, or -1 if it is unknown.
+func newProgressWriter(w, out io.Writer, total int64) *progressWriter {
+	now := time.Now()
+	return &progressWriter{
+		w:     w,
+		out:   out,
+		total: total,
+		start: now,
+		last:  now,
+	}
+}
+
+// Write writes p to the underlying writer and prints the progress if the update
+// interval has passed
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.written += int64(n)
+
+	if now := time.Now(); now.Sub(p.last) >= progressInterval {
+		p.last = now
+		p.print()
+	}
+
+	return n, err
+}
+
+// finish prints the final progress of the transfer and ends the progress line
+func (p *progressWriter) finish() {
+	p.print()
+	fmt.Fprintln(p.out)
+}
+
+// print writes a single progress line, overwriting the previous one
+func (p *progressWriter) print() {
+	elapsed := time.Since(p.start).Seconds()
+	var rate float64
+	if elapsed > 0 {
+		rate = float64(p.written) / elapsed
+	}
+
+	if p.total > 0 {
+		pct := float64(p.written) * 100 / float64(p.total)
+		fmt.Fprintf(p.out, "\r%d/%d bytes (%.0f%%) at %s/s", p.written, p.total, pct, formatBytes(rate))
+	} else {
+		fmt.Fprintf(p.out, "\r%d bytes at %s/s", p.written, formatBytes(rate))
+	}
+}
+
+// formatBytes formats a number of bytes using binary unit prefixes
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
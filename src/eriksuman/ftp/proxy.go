@@ -0,0 +1,334 @@
+package ftp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// default ports of SOCKS5 and HTTP proxies
+const (
+	defaultSOCKSPort = "1080"
+	defaultHTTPPort  = "8080"
+)
+
+// dialer opens the TCP connections to the server, either directly or through a
+// proxy
+type dialer interface {
+	dial(addr string, timeout time.Duration) (net.Conn, error)
+}
+
+// directDialer connects to the server directly
+type directDialer struct{}
+
+func (directDialer) dial(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, timeout)
+}
+
+// newDialer returns a dialer which connects through the proxy at proxyURL, or
+// directly if proxyURL is empty. Proxies are given as socks5://[user:password@]host[:port]
+// for SOCKS5, or http://[user:password@]host[:port] to tunnel with HTTP CONNECT.
+func newDialer(proxyURL string) (dialer, error) {
+	if proxyURL == "" {
+		return directDialer{}, nil
+	}
+
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %s: %v", proxyURL, err)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid proxy %s: missing host", proxyURL)
+	}
+
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		port := u.Port()
+		if port == "" {
+			port = defaultSOCKSPort
+		}
+
+		d := &socks5Dialer{proxy: net.JoinHostPort(u.Hostname(), port)}
+		if u.User != nil {
+			d.user = u.User.Username()
+			d.password, _ = u.User.Password()
+		}
+		return d, nil
+	case "http":
+		port := u.Port()
+		if port == "" {
+			port = defaultHTTPPort
+		}
+
+		d := &httpConnectDialer{proxy: net.JoinHostPort(u.Hostname(), port)}
+		if u.User != nil {
+			d.user = u.User.Username()
+			d.password, _ = u.User.Password()
+		}
+		return d, nil
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+}
+
+// proxiedConn is a connection made through a proxy. Its remote address is the
+// server it reaches rather than the proxy.
+type proxiedConn struct {
+	net.Conn
+	remote proxiedAddr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// proxiedAddr is the address of a server reached through a proxy. The host may be
+// a name, which is resolved by the proxy.
+type proxiedAddr string
+
+func (a proxiedAddr) Network() string { return "tcp" }
+func (a proxiedAddr) String() string  { return string(a) }
+
+// SOCKS5 protocol constants from RFC 1928 and RFC 1929
+const (
+	socks5Version      = 5
+	socks5AuthNone     = 0
+	socks5AuthPassword = 2
+	socks5NoAcceptable = 0xff
+	socks5Connect      = 1
+	socks5AddrIPv4     = 1
+	socks5AddrDomain   = 3
+	socks5AddrIPv6     = 4
+)
+
+// descriptions of the failures a SOCKS5 proxy reports for a connect request
+var socks5Errors = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// socks5Dialer connects to the server through a SOCKS5 proxy, authenticating
+// with a username and password if one is set
+type socks5Dialer struct {
+	proxy          string
+	user, password string
+}
+
+// dial connects to the proxy and asks it to connect to addr. The whole exchange
+// must complete within timeout.
+func (d *socks5Dialer) dial(addr string, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", d.proxy, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := d.connect(conn, addr); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("socks5 proxy %s: %w", d.proxy, err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	return &proxiedConn{Conn: conn, remote: proxiedAddr(addr)}, nil
+}
+
+// connect negotiates authentication with the proxy and issues the connect
+// request for addr
+func (d *socks5Dialer) connect(conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %s", portStr)
+	}
+
+	// offer the authentication methods we can use
+	methods := []byte{socks5AuthNone}
+	if d.user != "" {
+		methods = append(methods, socks5AuthPassword)
+	}
+	if _, err := conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("unexpected protocol version %d", reply[0])
+	}
+
+	switch reply[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if err := d.authenticate(conn); err != nil {
+			return err
+		}
+	case socks5NoAcceptable:
+		return errors.New("no acceptable authentication method")
+	default:
+		return fmt.Errorf("unexpected authentication method %d", reply[1])
+	}
+
+	// request a connection to the server
+	req := []byte{socks5Version, socks5Connect, 0}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(append(req, socks5AddrIPv4), ip4...)
+		} else {
+			req = append(append(req, socks5AddrIPv6), ip...)
+		}
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("host name too long: %s", host)
+		}
+		req = append(append(req, socks5AddrDomain, byte(len(host))), host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// the reply ends with the address the proxy bound, which isn't needed
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0 {
+		if msg, ok := socks5Errors[header[1]]; ok {
+			return errors.New(msg)
+		}
+		return fmt.Errorf("connect failed with code %d", header[1])
+	}
+
+	var n int
+	switch header[3] {
+	case socks5AddrIPv4:
+		n = net.IPv4len
+	case socks5AddrIPv6:
+		n = net.IPv6len
+	case socks5AddrDomain:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return err
+		}
+		n = int(l[0])
+	default:
+		return fmt.Errorf("unexpected address type %d", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, n+2))
+	return err
+}
+
+// authenticate sends the username and password to the proxy
+func (d *socks5Dialer) authenticate(conn net.Conn) error {
+	if len(d.user) > 255 || len(d.password) > 255 {
+		return errors.New("username or password too long")
+	}
+
+	req := []byte{1, byte(len(d.user))}
+	req = append(req, d.user...)
+	req = append(req, byte(len(d.password)))
+	req = append(req, d.password...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return errors.New("credentials rejected")
+	}
+
+	return nil
+}
+
+// maximum size of the response to a CONNECT request
+const maxConnectResponse = 16 * 1024
+
+// httpConnectDialer connects to the server through a tunnel opened with the HTTP
+// CONNECT method, authenticating with basic auth if a username is set
+type httpConnectDialer struct {
+	proxy          string
+	user, password string
+}
+
+// dial connects to the proxy and asks it to open a tunnel to addr. The whole
+// exchange must complete within timeout.
+func (d *httpConnectDialer) dial(addr string, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", d.proxy, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := d.connect(conn, addr); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy %s: %w", d.proxy, err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	return &proxiedConn{Conn: conn, remote: proxiedAddr(addr)}, nil
+}
+
+// connect sends the CONNECT request for addr and checks that the proxy opened the
+// tunnel
+func (d *httpConnectDialer) connect(conn net.Conn, addr string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{"User-Agent": {clientName}},
+	}
+	if d.user != "" {
+		req.SetBasicAuth(d.user, d.password)
+		req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+		req.Header.Del("Authorization")
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+
+	// read the response a byte at a time, so nothing the server sends through
+	// the tunnel after it is consumed
+	var head []byte
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(head, []byte("\r\n\r\n")) {
+		if len(head) >= maxConnectResponse {
+			return errors.New("response to CONNECT too long")
+		}
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return err
+		}
+		head = append(head, b[0])
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(head)), req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("CONNECT failed: %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,343 @@
+package ftp
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startSOCKS5Proxy runs a minimal SOCKS5 proxy for the test, requiring the given
+// username and password if user is set. The address of each connect request is
+// sent on the returned channel.
+func startSOCKS5Proxy(t *testing.T, user, password string) (addr string, requests <-chan string) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	reqs := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSOCKS5(conn, user, password, reqs)
+		}
+	}()
+
+	return ln.Addr().String(), reqs
+}
+
+// serveSOCKS5 handles the handshake of one client of a test proxy, then relays
+// between it and the server it asked for
+func serveSOCKS5(conn net.Conn, user, password string, requests chan<- string) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+
+	// choose the authentication method
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return
+	}
+	method := byte(socks5AuthNone)
+	if user != "" {
+		method = socks5AuthPassword
+	}
+	if !strings.ContainsRune(string(methods), rune(method)) {
+		conn.Write([]byte{socks5Version, socks5NoAcceptable})
+		return
+	}
+	conn.Write([]byte{socks5Version, method})
+
+	if method == socks5AuthPassword {
+		// the subnegotiation version, then the length-prefixed credentials
+		if _, err := r.ReadByte(); err != nil {
+			return
+		}
+		gotUser, err := readSOCKS5String(r)
+		if err != nil {
+			return
+		}
+		gotPassword, err := readSOCKS5String(r)
+		if err != nil {
+			return
+		}
+		if gotUser != user || gotPassword != password {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	// read the connect request
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(r, req); err != nil {
+		return
+	}
+	var host string
+	switch req[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make([]byte, net.IPv4len)
+		if req[3] == socks5AddrIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return
+		}
+		host = net.IP(ip).String()
+	case socks5AddrDomain:
+		var err error
+		if host, err = readSOCKS5String(r); err != nil {
+			return
+		}
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	requests <- addr
+
+	server, err := net.Dial("tcp", addr)
+	if err != nil {
+		conn.Write([]byte{socks5Version, 5, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer server.Close()
+	conn.Write([]byte{socks5Version, 0, 0, socks5AddrIPv4, 127, 0, 0, 1, 0, 0})
+
+	conn.SetDeadline(time.Time{})
+	go io.Copy(server, r)
+	io.Copy(conn, server)
+}
+
+// readSOCKS5String reads a string preceded by its length in a single byte
+func readSOCKS5String(r *bufio.Reader) (string, error) {
+	n, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return string(b), err
+}
+
+// startHTTPProxy runs a minimal HTTP CONNECT proxy for the test, requiring the
+// given Proxy-Authorization header if auth is set. Each CONNECT request is sent on
+// the returned channel.
+func startHTTPProxy(t *testing.T, auth string) (addr string, requests <-chan *http.Request) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	reqs := make(chan *http.Request, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveHTTPConnect(conn, auth, reqs)
+		}
+	}()
+
+	return ln.Addr().String(), reqs
+}
+
+// serveHTTPConnect handles the CONNECT request of one client of a test proxy,
+// then relays between it and the server it asked for. The server's greeting is
+// sent in the same write as the response, as a proxy may do.
+func serveHTTPConnect(conn net.Conn, auth string, requests chan<- *http.Request) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return
+	}
+	requests <- req
+
+	if req.Method != http.MethodConnect {
+		io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\n\r\n")
+		return
+	}
+	if auth != "" && req.Header.Get("Proxy-Authorization") != auth {
+		io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"test\"\r\n\r\n")
+		return
+	}
+
+	server, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		return
+	}
+	defer server.Close()
+
+	sr := bufio.NewReader(server)
+	greeting, err := sr.ReadString('\n')
+	if err != nil {
+		return
+	}
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"+greeting)
+
+	conn.SetDeadline(time.Time{})
+	go io.Copy(server, r)
+	io.Copy(conn, sr)
+}
+
+// dialFTPThrough connects to the FTP server at addr through d and reads its
+// greeting
+func dialFTPThrough(t *testing.T, d dialer, addr string) {
+	t.Helper()
+
+	conn, err := d.dial(addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if got := conn.RemoteAddr().String(); got != addr {
+		t.Errorf("connection's remote address is %s, want the server at %s", got, addr)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	c := &testConn{t: t, conn: conn, reader: bufio.NewReader(conn)}
+	c.expect(StatusReady)
+}
+
+func TestSOCKS5Dialer(t *testing.T) {
+	s := startTestServer(t, nil)
+	_, port, err := net.SplitHostPort(s.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("no auth", func(t *testing.T) {
+		proxy, requests := startSOCKS5Proxy(t, "", "")
+		d, err := newDialer("socks5://" + proxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dialFTPThrough(t, d, s.addr)
+		if got := <-requests; got != s.addr {
+			t.Errorf("proxy asked to connect to %s, want %s", got, s.addr)
+		}
+
+		// names are resolved by the proxy
+		dialFTPThrough(t, d, net.JoinHostPort("localhost", port))
+		if got := <-requests; got != net.JoinHostPort("localhost", port) {
+			t.Errorf("proxy asked to connect to %s, want localhost:%s", got, port)
+		}
+	})
+
+	t.Run("auth", func(t *testing.T) {
+		proxy, _ := startSOCKS5Proxy(t, "user", "p@ss")
+		d, err := newDialer("socks5://user:p%40ss@" + proxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dialFTPThrough(t, d, s.addr)
+
+		for url, want := range map[string]string{
+			"socks5://user:wrong@" + proxy: "credentials rejected",
+			"socks5://" + proxy:            "no acceptable authentication method",
+		} {
+			d, err := newDialer(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := d.dial(s.addr, 5*time.Second); err == nil || !strings.Contains(err.Error(), want) {
+				t.Errorf("dialing through %s returned %v, want %q", url, err, want)
+			}
+		}
+	})
+
+	t.Run("connect refused", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		closed := ln.Addr().String()
+		ln.Close()
+
+		proxy, _ := startSOCKS5Proxy(t, "", "")
+		d := &socks5Dialer{proxy: proxy}
+		if _, err := d.dial(closed, 5*time.Second); err == nil || !strings.Contains(err.Error(), "connection refused") {
+			t.Errorf("dialing a closed port through the proxy returned %v, want connection refused", err)
+		}
+	})
+}
+
+func TestHTTPConnectDialer(t *testing.T) {
+	s := startTestServer(t, nil)
+
+	t.Run("no auth", func(t *testing.T) {
+		proxy, requests := startHTTPProxy(t, "")
+		d, err := newDialer("http://" + proxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the greeting arrives with the response, and must not be lost with it
+		dialFTPThrough(t, d, s.addr)
+		req := <-requests
+		if req.Host != s.addr {
+			t.Errorf("proxy asked to connect to %s, want %s", req.Host, s.addr)
+		}
+		if auth := req.Header.Get("Proxy-Authorization"); auth != "" {
+			t.Errorf("sent Proxy-Authorization %q without credentials", auth)
+		}
+	})
+
+	t.Run("auth", func(t *testing.T) {
+		want := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:p@ss"))
+		proxy, requests := startHTTPProxy(t, want)
+		d, err := newDialer("http://user:p%40ss@" + proxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dialFTPThrough(t, d, s.addr)
+		req := <-requests
+		if got := req.Header.Get("Proxy-Authorization"); got != want {
+			t.Errorf("sent Proxy-Authorization %q, want %q", got, want)
+		}
+		if got := req.Header.Get("Authorization"); got != "" {
+			t.Errorf("sent the credentials to the server as Authorization %q", got)
+		}
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		proxy, _ := startHTTPProxy(t, "Basic "+base64.StdEncoding.EncodeToString([]byte("user:p@ss")))
+		for _, url := range []string{"http://" + proxy, "http://user:wrong@" + proxy} {
+			d, err := newDialer(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := d.dial(s.addr, 5*time.Second); err == nil || !strings.Contains(err.Error(), "407") {
+				t.Errorf("dialing through %s returned %v, want the 407 reported", url, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package ftp
+
+import "errors"
+
+// makeRaw is not supported on this platform, so lines are read without editing
+func makeRaw(fd int) (func(), error) {
+	return nil, errors.New("raw terminal mode not supported on this platform")
+}
@@ -0,0 +1,281 @@
+package ftp
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// transferPlan collects the files a dry run of a recursive transfer would copy
+type transferPlan struct {
+	files int
+	bytes int64
+}
+
+// add prints a file which would be copied from src to dest and counts it
+func (p *transferPlan) add(src, dest string, size int64) {
+	fmt.Printf("%s -> %s (%s)\n", src, dest, formatBytes(float64(size)))
+	p.files++
+	p.bytes += size
+}
+
+// print prints the totals of the plan, describing them with verb
+func (p *transferPlan) print(verb string) {
+	fmt.Printf("Would %s %d files, %d bytes (%s)\n", verb, p.files, p.bytes, formatBytes(float64(p.bytes)))
+}
+
+// CommandGetRecursive downloads the remote directory tree rooted at dir into a
+// directory of the same name in the local working directory. Failures of
+// individual files are reported without stopping the rest of the download.
+// Existing local files are only replaced if force is set or the user agrees.
+// With dryRun, the files are listed and totalled but nothing is downloaded.
+func (c *Client) CommandGetRecursive(dir string, force, dryRun bool) {
+	// remember where to come back to
+	start, err := c.CommandPWD()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	var plan *transferPlan
+	if dryRun {
+		plan = new(transferPlan)
+	}
+
+	errs := c.getTree(dir, c.localPath(path.Base(path.Clean(dir))), force, plan, make(map[string]bool))
+
+	if err := c.changeDir(start); err != nil {
+		fmt.Printf("Failed to return to %s: %v\n", start, err)
+	}
+
+	if plan != nil {
+		plan.print("download")
+	}
+
+	if len(errs) > 0 {
+		fmt.Printf("%d errors occurred:\n", len(errs))
+		for _, err := range errs {
+			fmt.Printf("  %v\n", err)
+		}
+	}
+}
+
+// getTree downloads the remote directory dir into the local directory local. The
+// remote directories already visited are tracked so that symbolic links which
+// lead back into the tree are not followed forever. If plan is set, files are
+// added to it instead of being downloaded and no local directories are created.
+func (c *Client) getTree(dir, local string, force bool, plan *transferPlan, visited map[string]bool) []error {
+	if err := c.changeDir(dir); err != nil {
+		return []error{err}
+	}
+
+	cur, err := c.CommandPWD()
+	if err != nil {
+		return []error{err}
+	}
+
+	if visited[cur] {
+		fmt.Printf("Skipping %s: already downloaded\n", cur)
+		return nil
+	}
+	visited[cur] = true
+
+	if plan == nil {
+		if err := os.MkdirAll(local, 0755); err != nil {
+			return []error{err}
+		}
+	}
+
+	entries, err := c.CommandListEntries("")
+	if err != nil {
+		return []error{fmt.Errorf("%s: %v", cur, err)}
+	}
+
+	var errs []error
+	for _, e := range entries {
+		if e.Name == "." || e.Name == ".." {
+			continue
+		}
+
+		remote := path.Join(cur, e.Name)
+		dest := filepath.Join(local, e.Name)
+		switch {
+		case e.IsDir():
+			errs = append(errs, c.getTree(remote, dest, force, plan, visited)...)
+		case e.Mode&os.ModeSymlink != 0:
+			// skip links to the directory they are in or any of its parents
+			target := e.LinkTarget
+			if !path.IsAbs(target) {
+				target = path.Join(cur, target)
+			}
+			if isAncestor(target, cur) {
+				fmt.Printf("Skipping %s: link to parent directory %s\n", remote, target)
+				continue
+			}
+
+			// links to directories are followed, anything else is downloaded
+			if err := c.changeDir(remote); err == nil {
+				errs = append(errs, c.getTree(remote, dest, force, plan, visited)...)
+			} else if err := c.getTreeFile(remote, dest, e.Size, force, plan); err != nil {
+				errs = append(errs, err)
+			}
+		default:
+			if err := c.getTreeFile(remote, dest, e.Size, force, plan); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	return errs
+}
+
+// getTreeFile downloads a file of a recursive download, or adds it to plan if set
+func (c *Client) getTreeFile(remote, dest string, size int64, force bool, plan *transferPlan) error {
+	if plan != nil {
+		plan.add(remote, dest, size)
+		return nil
+	}
+
+	if !c.confirmOverwrite(dest, force) {
+		return nil
+	}
+
+	return c.retrieve(remote, dest)
+}
+
+// isAncestor reports whether dir is p or one of its parent directories
+func isAncestor(dir, p string) bool {
+	dir, p = path.Clean(dir), path.Clean(p)
+	return dir == p || dir == "/" || strings.HasPrefix(p, dir+"/")
+}
+
+// CommandPutRecursive uploads the local directory tree rooted at dir into a
+// directory of the same name in the remote working directory. Failures of
+// individual files are reported without stopping the rest of the upload. With
+// dryRun, the files are listed and totalled but nothing is uploaded.
+func (c *Client) CommandPutRecursive(dir string, dryRun bool) {
+	var plan *transferPlan
+	if dryRun {
+		plan = new(transferPlan)
+	}
+
+	if err := c.putTree(c.localPath(dir), path.Base(filepath.ToSlash(filepath.Clean(dir))), plan); err != nil {
+		fmt.Println(err)
+	}
+
+	if plan != nil {
+		plan.print("upload")
+	}
+}
+
+// putTree uploads the local directory local into the remote directory remote,
+// creating remote directories as needed. Paths are kept relative to local so the
+// remote tree mirrors the local one. The errors of every failed file and
+// directory are joined into the returned error. If plan is set, files are added to
+// it instead of being uploaded and no remote directories are created.
+func (c *Client) putTree(local, remote string, plan *transferPlan) error {
+	var errs []error
+	err := filepath.WalkDir(local, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// report unreadable entries and carry on with the rest of the tree
+			errs = append(errs, err)
+			if d != nil && d.IsDir() && p != local {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(local, p)
+		if err != nil {
+			errs = append(errs, err)
+			return nil
+		}
+		dest := path.Join(remote, filepath.ToSlash(rel))
+
+		switch {
+		case d.IsDir() && plan != nil:
+			// nothing is created in a dry run
+		case d.IsDir():
+			// a 550 usually means the directory is already there, so keep going
+			// and let the uploads into it report any real problem
+			if err := c.makeDir(dest); err != nil && !errors.Is(err, errRemoteExists) {
+				errs = append(errs, err)
+				return filepath.SkipDir
+			}
+		case d.Type().IsRegular() && plan != nil:
+			info, err := d.Info()
+			if err != nil {
+				errs = append(errs, err)
+				return nil
+			}
+			plan.add(p, dest, info.Size())
+		case d.Type().IsRegular():
+			if err := c.store(p, dest); err != nil {
+				errs = append(errs, err)
+			}
+		default:
+			fmt.Printf("Skipping %s: not a regular file\n", p)
+		}
+
+		return nil
+	})
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%d errors occurred:\n%w", len(errs), errors.Join(errs...))
+	}
+
+	return nil
+}
+
+// CommandDU prints the total size of the files in the remote directory tree rooted
+// at dir, or the current directory if dir is empty. With breakdown, the size of
+// every directory in the tree is printed as well. Directories which can't be
+// listed are skipped with a warning, and symbolic links are not followed.
+func (c *Client) CommandDU(dir string, breakdown bool) {
+	total := c.treeSize(dir, breakdown)
+
+	name := dir
+	if name == "" {
+		name = "."
+	}
+	fmt.Printf("%d bytes (%s) total in %s\n", total, formatBytes(float64(total)), name)
+}
+
+// treeSize returns the sum of the sizes of the files under the remote directory
+// dir, printing the size of each directory after its contents if breakdown is set
+func (c *Client) treeSize(dir string, breakdown bool) int64 {
+	entries, err := c.CommandListEntries(dir)
+	if err != nil {
+		fmt.Printf("Skipping %s: %v\n", dir, err)
+		return 0
+	}
+
+	var total int64
+	for _, e := range entries {
+		switch {
+		case e.Name == "." || e.Name == "..":
+			continue
+		case e.IsDir():
+			total += c.treeSize(path.Join(dir, e.Name), breakdown)
+		case e.Mode&os.ModeSymlink == 0:
+			total += e.Size
+		}
+	}
+
+	if breakdown {
+		name := dir
+		if name == "" {
+			name = "."
+		}
+		fmt.Printf("%12d  %s\n", total, name)
+	}
+
+	return total
+}
@@ -0,0 +1,40 @@
+package ftp
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestClientDiskUsage(t *testing.T) {
+	c, dir := startTestClient(t)
+	writeTestFile(t, dir, "a.txt", strings.Repeat("a", 100))
+	writeTestFile(t, dir, "sub/b.txt", strings.Repeat("b", 250))
+	writeTestFile(t, dir, "sub/deep/c.txt", strings.Repeat("c", 1000))
+	if err := os.Mkdir(filepath.Join(dir, "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// links aren't followed or counted
+	if err := os.Symlink("sub/deep/c.txt", filepath.Join(dir, "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	out := captureStdout(t, func() { c.CommandDU("", true) })
+	for _, want := range []string{
+		"        1000  sub/deep\n",
+		"        1250  sub\n",
+		"           0  empty\n",
+		"        1350  .\n",
+		"1350 bytes (",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("du printed %q, want it to include %q", out, want)
+		}
+	}
+
+	out = captureStdout(t, func() { c.CommandDU("sub", false) })
+	if !strings.Contains(out, "\n1250 bytes (") || !strings.HasSuffix(out, " total in sub\n") || strings.Contains(out, "  sub") {
+		t.Errorf("du sub printed %q, want the 1250 byte total without a breakdown", out)
+	}
+}
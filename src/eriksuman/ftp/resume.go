@@ -0,0 +1,120 @@
+package ftp
+
+import (
+	"fmt"
+	"math"
+	"os"
+)
+
+// defaultResumeRetries is the number of times a broken download is resumed if no
+// other count is set
+const defaultResumeRetries = 3
+
+// canResume reports whether a failed download can be continued from where it
+// stopped. Offsets count the bytes sent, so only binary downloads are resumed.
+func (c *Client) canResume() bool {
+	return c.resumeOnError && c.transferType == transferTypeBinary
+}
+
+// checkComplete returns an error if the local file dest is shorter than total, the
+// size of the remote file or -1 if it is unknown. A data connection closed early
+// looks like the end of the file, so only the size shows the download was cut
+// short.
+func checkComplete(dest string, total int64) error {
+	info, err := os.Stat(dest)
+	if err != nil {
+		return err
+	}
+
+	if total >= 0 && info.Size() < total {
+		return fmt.Errorf("transfer ended after %d of %d bytes", info.Size(), total)
+	}
+	return nil
+}
+
+// resumeRetrieve continues the download of the remote file to dest after it
+// failed with cause, restarting the transfer with REST at the size of the partial
+// file. total is the size of the remote file, or -1 if it is unknown. If the
+// control connection was lost it is reopened, logged in and returned to the
+// remote directory dir. The download is resumed up to c.resumeRetries times
+// before giving up with the last error.
+func (c *Client) resumeRetrieve(file, dest, dir string, total int64, cause error) error {
+	for attempt := 1; attempt <= c.resumeRetries; attempt++ {
+		var offset int64
+		if info, err := os.Stat(dest); err == nil {
+			offset = info.Size()
+		}
+		fmt.Printf("%v\nResuming %s at byte %d (attempt %d of %d)\n", cause, file, offset, attempt, c.resumeRetries)
+
+		if err := c.ensureConnected(dir); err != nil {
+			cause = err
+			continue
+		}
+
+		f, err := os.OpenFile(dest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to write file: %v", err)
+		}
+		cause = c.DownloadRange(file, offset, math.MaxInt64, f)
+		f.Close()
+		if cause == nil {
+			cause = checkComplete(dest, total)
+		}
+		if cause == nil {
+			fmt.Printf("Resumed download of %s complete.\n", file)
+			return nil
+		}
+	}
+
+	return cause
+}
+
+// ensureConnected checks that the control connection still works, reconnecting
+// and logging in again if it doesn't. After reconnecting the transfer settings are
+// restored and the remote directory is changed to dir.
+func (c *Client) ensureConnected(dir string) error {
+	if _, err := c.control.getReplyForCommand(newCommand(CommandPWD, "")); err == nil {
+		return nil
+	}
+
+	c.control.Close()
+	p := c.params
+	cont, rply, localAddr, remoteAddr, err := newControlConn(c.dialer, p.host, p.port, p.logFile, c.timeout, p.format, p.retry, p.keepAlive)
+	if err != nil {
+		if cont != nil {
+			cont.Close()
+		}
+		return fmt.Errorf("reconnecting: %v", err)
+	}
+	cont.debug = c.control.debug
+	c.control, c.localAddr, c.remoteAddr = cont, localAddr, remoteAddr
+
+	if rply.StatusCode != StatusReady {
+		return fmt.Errorf("reconnecting: %w", newReplyError(rply))
+	}
+
+	if err := c.logInAs(c.login); err != nil {
+		return fmt.Errorf("reconnecting: %v", err)
+	}
+
+	// restore the session's settings
+	cmds := []*Command{newCommand(CommandTYPE, "I")}
+	if c.compressed {
+		cmds = append(cmds, newCommand(CommandMODE, "Z"))
+	}
+	if dir != "" {
+		cmds = append(cmds, newCommand(CommandCWD, dir))
+	}
+	for _, cmd := range cmds {
+		rply, err := c.control.getReplyForCommand(cmd)
+		if err != nil {
+			return fmt.Errorf("reconnecting: %v", err)
+		}
+		if !rply.StatusCode.IsPositive() {
+			return fmt.Errorf("reconnecting: %w", newReplyError(rply))
+		}
+	}
+
+	fmt.Println("Reconnected.")
+	return nil
+}
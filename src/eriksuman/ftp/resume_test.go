@@ -0,0 +1,166 @@
+package ftp
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// cutConn is a data connection which fails once limit bytes have been read
+type cutConn struct {
+	net.Conn
+	limit int
+}
+
+func (c *cutConn) Read(p []byte) (int, error) {
+	if c.limit <= 0 {
+		c.Conn.Close()
+		return 0, errors.New("connection cut")
+	}
+	if len(p) > c.limit {
+		p = p[:c.limit]
+	}
+	n, err := c.Conn.Read(p)
+	c.limit -= n
+	return n, err
+}
+
+// cuttingDialer connects directly, cutting the first cuts connections it opens
+// after limit bytes have been read from each
+type cuttingDialer struct {
+	mu    sync.Mutex
+	cuts  int
+	limit int
+}
+
+func (d *cuttingDialer) dial(addr string, timeout time.Duration) (net.Conn, error) {
+	conn, err := directDialer{}.dial(addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cuts == 0 {
+		return conn, nil
+	}
+	d.cuts--
+	return &cutConn{Conn: conn, limit: d.limit}, nil
+}
+
+// resumeContent is a file large enough to be cut part way through
+var resumeContent = strings.Repeat("0123456789abcdefghijklmnopqrstuvwxyz", 8<<10)
+
+func TestClientResumeAfterDataConnectionDrops(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		cuts        int
+		retries     int
+		wantResumes int
+		complete    bool
+	}{
+		{"resumed", 2, 3, 2, true},
+		{"retries exhausted", 5, 2, 2, false},
+	} {
+		c, dir := startTestClient(t)
+		writeTestFile(t, dir, "remote.bin", resumeContent)
+		c.resumeOnError = true
+		c.resumeRetries = tt.retries
+		c.dialer = &cuttingDialer{cuts: tt.cuts, limit: 10000}
+
+		var err error
+		out := captureStdout(t, func() { err = c.retrieve("remote.bin", filepath.Join(c.localDir, "local.bin")) })
+
+		if got := strings.Count(out, "Resuming remote.bin"); got != tt.wantResumes {
+			t.Errorf("%s: resumed %d times, want %d:\n%s", tt.name, got, tt.wantResumes, out)
+		}
+		// each attempt continues from where the last one stopped
+		if strings.Contains(out, "at byte 0 ") {
+			t.Errorf("%s: restarted the download from the beginning:\n%s", tt.name, out)
+		}
+		// the control connection survived, so there was no need to reconnect
+		if strings.Contains(out, "Reconnected.") {
+			t.Errorf("%s: reconnected after only the data connection dropped", tt.name)
+		}
+
+		got := readTestFile(t, c.localDir, "local.bin")
+		if !tt.complete {
+			if err == nil || len(got) >= len(resumeContent) {
+				t.Errorf("%s: got %d bytes and error %v, want a partial download and an error", tt.name, len(got), err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if got != resumeContent {
+			t.Errorf("%s: downloaded %d bytes, not the %d sent", tt.name, len(got), len(resumeContent))
+		}
+	}
+}
+
+func TestClientResumeAfterControlConnectionLost(t *testing.T) {
+	// at this rate the download takes over a second, leaving time to kick the
+	// session part way through
+	s := startTestServer(t, func(c *config) { c.maxTransferRate = int64(len(resumeContent)) / 2 })
+	writeTestFile(t, s.dir, "remote.bin", resumeContent)
+
+	c := newTestClient(t, s.addr)
+	c.resumeOnError = true
+
+	kicked := make(chan error, 1)
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		sessions := s.ActiveSessions()
+		if len(sessions) != 1 {
+			kicked <- errors.New("no session to kick")
+			return
+		}
+		kicked <- s.Kick(sessions[0].RemoteAddr)
+	}()
+
+	var err error
+	out := captureStdout(t, func() { err = c.retrieve("remote.bin", filepath.Join(c.localDir, "local.bin")) })
+	if kerr := <-kicked; kerr != nil {
+		t.Fatal(kerr)
+	}
+	if err != nil {
+		t.Fatalf("download failed: %v\n%s", err, out)
+	}
+
+	if !strings.Contains(out, "Reconnected.") {
+		t.Errorf("printed %q, want the client to reconnect", out)
+	}
+	if got := readTestFile(t, c.localDir, "local.bin"); got != resumeContent {
+		t.Errorf("downloaded %d bytes, not the %d sent", len(got), len(resumeContent))
+	}
+}
+
+func TestCheckComplete(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "partial")
+	if err := ioutil.WriteFile(dest, []byte("12345"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		total   int64
+		wantErr bool
+	}{
+		{10, true},
+		{5, false},
+		{-1, false},
+	} {
+		if err := checkComplete(dest, tt.total); (err != nil) != tt.wantErr {
+			t.Errorf("checkComplete with a total of %d returned %v", tt.total, err)
+		}
+	}
+
+	if err := checkComplete(dest+".missing", 5); err == nil {
+		t.Error("checkComplete of a missing file succeeded")
+	}
+}
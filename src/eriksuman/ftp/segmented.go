@@ -0,0 +1,192 @@
+package ftp
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// minSegmentSize is the smallest part of a file worth opening another connection
+// to download
+const minSegmentSize = 1 << 20
+
+// sessionParams holds what is needed to open further control connections to the
+// server, for downloading segments of a file concurrently
+type sessionParams struct {
+	host, port, logFile string
+	format              logFormat
+	retry               retryPolicy
+	keepAlive           time.Duration
+}
+
+// credentials are the username, password and account the client logged in with
+type credentials struct {
+	user, password, account string
+}
+
+// retrieveSegmented downloads the remote file to dest in up to c.segments parts
+// at once, each over its own control connection, writing each part at its offset
+// in dest. size is the size of the remote file, or -1 if it is unknown. It
+// reports false without downloading anything if the file can't or needn't be
+// split: the server must support REST and SIZE, the transfer must be binary, and
+// the file must be large enough to be worth splitting.
+func (c *Client) retrieveSegmented(file, dest string, size int64) (bool, error) {
+	if c.segments < 2 || c.transferType != transferTypeBinary || !c.Supports("REST") || !c.Supports("SIZE") || size < 2*minSegmentSize {
+		return false, nil
+	}
+
+	n := c.segments
+	if max := int(size / minSegmentSize); n > max {
+		n = max
+	}
+
+	// the first segment is downloaded over this connection, the rest over
+	// connections opened for them
+	sessions := []*Client{c}
+	for len(sessions) < n {
+		s, err := c.openSession()
+		if err != nil {
+			fmt.Printf("Opening connection for segment %d failed: %v\n", len(sessions)+1, err)
+			break
+		}
+		defer s.Close()
+		sessions = append(sessions, s)
+	}
+	if len(sessions) < 2 {
+		return false, nil
+	}
+	n = len(sessions)
+
+	f, err := os.Create(dest)
+	if err != nil {
+		return true, fmt.Errorf("failed to write file: %v", err)
+	}
+	defer f.Close()
+
+	fmt.Printf("Downloading %s in %d segments\n", file, n)
+
+	var progress io.Writer = io.Discard
+	var pw *progressWriter
+	if !c.quiet {
+		pw = newProgressWriter(io.Discard, os.Stdout, size)
+		progress = &syncWriter{w: pw}
+	}
+
+	// each segment writes its range at its own offset in the file
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	segSize := size / int64(n)
+	for i, s := range sessions {
+		off := int64(i) * segSize
+		length := segSize
+		if i == n-1 {
+			length = size - off
+		}
+
+		wg.Add(1)
+		go func(i int, s *Client, off, length int64) {
+			defer wg.Done()
+			w := io.MultiWriter(io.NewOffsetWriter(f, off), progress)
+			errs[i] = s.DownloadRange(file, off, length, w)
+		}(i, s, off, length)
+	}
+	wg.Wait()
+
+	if pw != nil {
+		pw.finish()
+	}
+
+	for i, err := range errs {
+		if err != nil {
+			os.Remove(dest)
+			return true, fmt.Errorf("%s: segment %d: %v", file, i+1, err)
+		}
+	}
+
+	return true, nil
+}
+
+// openSession opens another control connection to the server, logged in as the
+// client is, for downloading a segment. Its replies are not printed.
+func (c *Client) openSession() (*Client, error) {
+	p := c.params
+	cont, rply, localAddr, remoteAddr, err := newControlConn(c.dialer, p.host, p.port, p.logFile, c.timeout, p.format, p.retry, p.keepAlive)
+	if err != nil {
+		if cont != nil {
+			cont.Close()
+		}
+		return nil, err
+	}
+
+	s := &Client{
+		control:         cont,
+		localAddr:       localAddr,
+		remoteAddr:      remoteAddr,
+		dialer:          c.dialer,
+		proxied:         c.proxied,
+		dataConnType:    c.dataConnType,
+		extended:        c.extended,
+		transferType:    transferTypeBinary,
+		timeout:         c.timeout,
+		dataIdleTimeout: c.dataIdleTimeout,
+		quiet:           true,
+		features:        c.features,
+	}
+
+	if rply.StatusCode != StatusReady {
+		cont.Close()
+		return nil, newReplyError(rply)
+	}
+
+	if err := s.logInAs(c.login); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	rply, err = cont.getReplyForCommand(newCommand(CommandTYPE, "I"))
+	if err == nil && rply.StatusCode != StatusCommandOK {
+		err = newReplyError(rply)
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// logInAs logs in with the given credentials without prompting or printing the
+// replies
+func (c *Client) logInAs(cred credentials) error {
+	rply, err := c.control.getReplyForCommand(newCommand(CommandUSER, cred.user))
+	if err == nil && rply.StatusCode == StatusUserOK {
+		rply, err = c.control.getReplyForCommand(newCommand(CommandPASS, cred.password))
+	}
+	if err == nil && rply.StatusCode == StatusLoginNeedAccount {
+		rply, err = c.control.getReplyForCommand(newCommand(CommandACCT, cred.account))
+	}
+	if err != nil {
+		return err
+	}
+
+	switch rply.StatusCode {
+	case StatusLoggedIn, StatusCommandNotImplemented:
+		return nil
+	default:
+		return fmt.Errorf("login failed: %w", newReplyError(rply))
+	}
+}
+
+// syncWriter serializes writes to w from several goroutines
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
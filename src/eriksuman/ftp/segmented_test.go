@@ -0,0 +1,88 @@
+package ftp
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// segmentedContent returns size bytes which don't repeat, so a segment written
+// at the wrong offset can't go unnoticed
+func segmentedContent(size int) string {
+	b := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(b)
+	return string(b)
+}
+
+func TestClientSegmentedDownload(t *testing.T) {
+	c, dir := startTestClient(t)
+	// the last segment also gets the bytes left over from dividing the file
+	content := segmentedContent(3*minSegmentSize + 7)
+	writeTestFile(t, dir, "big.bin", content)
+
+	captureStdout(t, func() {
+		if _, err := c.CommandFEAT(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	c.segments = 3
+	c.quiet = false
+
+	var err error
+	out := captureStdout(t, func() { err = c.retrieve("big.bin", filepath.Join(c.localDir, "big.bin")) })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(out, "in 3 segments") {
+		t.Errorf("printed %q, want the download split in 3", out)
+	}
+	// the progress of every segment is counted together
+	if want := fmt.Sprintf("%d/%d bytes (100%%)", len(content), len(content)); !strings.Contains(out, want) {
+		t.Errorf("printed %q, want the progress to reach %q", out, want)
+	}
+	if got := readTestFile(t, c.localDir, "big.bin"); got != content {
+		t.Errorf("downloaded %d bytes which differ from the %d on the server", len(got), len(content))
+	}
+}
+
+func TestClientSegmentedFallsBack(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		features string
+		size     int
+	}{
+		{"no REST", "-Features:\n SIZE\n MDTM\n211 End", 2*minSegmentSize + 7},
+		{"too small", "-Features:\n REST STREAM\n SIZE\n211 End", 2*minSegmentSize - 1},
+	} {
+		c, dir := startTestClient(t)
+		content := segmentedContent(tt.size)
+		writeTestFile(t, dir, "big.bin", content)
+
+		c.features = parseFeatures(tt.features)
+		c.segments = 3
+		c.quiet = false
+		var sent bytes.Buffer
+		c.control.logger = nopWriteCloser{&sent}
+
+		var err error
+		out := captureStdout(t, func() { err = c.retrieve("big.bin", filepath.Join(c.localDir, "big.bin")) })
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		if strings.Contains(out, "segments") {
+			t.Errorf("%s: printed %q, want a single stream", tt.name, out)
+		}
+		// the size found while deciding whether to split is used for the progress
+		if n := strings.Count(sent.String(), string(CommandSIZE)+" big.bin"); n != 1 {
+			t.Errorf("%s: sent SIZE %d times, want once", tt.name, n)
+		}
+		if got := readTestFile(t, c.localDir, "big.bin"); got != content {
+			t.Errorf("%s: downloaded %d bytes which differ from the %d on the server", tt.name, len(got), len(content))
+		}
+	}
+}
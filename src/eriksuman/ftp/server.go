@@ -2,6 +2,7 @@ package ftp
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -10,141 +11,483 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 )
 
 // common errors
 var errTimeout = errors.New("timeout reached, connection closed")
+var errShutdown = errors.New("server shutting down")
+var errInvalidArgument = errors.New("invalid characters in command argument")
 var errDataConnNotSetUp = errors.New("data connection not set up")
 
-// StartServer starts up the server listening on port
-func StartServer(port string) error {
+// bounds of the backoff between accepts after temporary accept errors
+const (
+	minAcceptRetryDelay = 5 * time.Millisecond
+	maxAcceptRetryDelay = 1 * time.Second
+)
+
+// Server is a running FTP server. It tracks the active sessions so operators can
+// list them and end them individually.
+type Server struct {
+	ctx    context.Context
+	config *config
+	logger *rolledLogger
+	users  map[string]userEntry
+	// active handlers, which shutdown waits for and ends if they don't finish
+	wg       sync.WaitGroup
+	sessions *sessionSet
+	limiter  *connLimiter
+	// closed when the server has shut down, with the error that stopped it
+	done chan struct{}
+	err  error
+}
+
+// SessionInfo describes an active session
+type SessionInfo struct {
+	// RemoteAddr is the address of the client, used to identify the session
+	RemoteAddr string
+	// Username is empty until the client logs in
+	Username  string
+	Dir       string
+	Connected time.Time
+}
+
+// StartServer starts up the server listening on port and returns once it is
+// accepting connections. When ctx is cancelled the listener is closed, active
+// sessions are closed once their current command completes, and Wait returns
+// after all of them have finished.
+func StartServer(ctx context.Context, port string) (*Server, error) {
+	s, err := NewServer(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// create listener
+	ln, err := net.Listen("tcp", net.JoinHostPort("", port))
+	if err != nil {
+		s.logger.logError(err)
+		s.logger.close()
+		return nil, err
+	}
+
+	go s.Serve(ln)
+
+	return s, nil
+}
+
+// NewServer loads the configuration and users file and opens the log, returning a
+// server ready to Serve connections. When ctx is cancelled the server shuts down.
+func NewServer(ctx context.Context) (*Server, error) {
 	config, err := loadConfig(configPath)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	// set the umask before any files are created
+	if config.umask >= 0 {
+		if err := setUmask(config.umask); err != nil {
+			return nil, err
+		}
 	}
 
-	l, err := newRolledLogger(config.logDir, config.nLogFiles)
+	l, err := newRolledLogger(config.logDir, config.nLogFiles, config.maxLogSize, config.logLevel, config.logFormat)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer l.close()
 
 	if !config.pasv && !config.port {
 		err := errors.New("ftpserver: port_mode and pasv_mode cannot both be NO")
 		l.logError(err)
-		return err
+		l.close()
+		return nil, err
 	}
 
 	// populate users
-	u, err := ioutil.ReadFile(config.usersFile)
+	users, skipped, err := loadUsers(config.usersFile)
 	if err != nil {
 		l.logError(err)
-		return err
+		l.close()
+		return nil, err
+	}
+	if skipped > 0 {
+		l.logWarning(fmt.Sprintf("Skipped %d malformed lines in users file %s", skipped, config.usersFile))
+	}
+	if len(users) == 0 {
+		err := fmt.Errorf("ftpserver: no valid users in users file %s, expected lines of the form: username password [account]", config.usersFile)
+		l.logError(err)
+		l.close()
+		return nil, err
+	}
+
+	return newServer(ctx, config, l, users), nil
+}
+
+// loadUsers reads the users file at path, returning the users it defines and the
+// number of malformed lines that were skipped. Fields may be separated by any
+// whitespace, and blank lines and lines starting with # are ignored.
+func loadUsers(path string) (map[string]userEntry, int, error) {
+	u, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
 	}
 
 	lines := strings.Split(string(u), "\n")
-	users := make(map[string]string)
+	users := make(map[string]userEntry)
+	skipped := 0
 	for _, l := range lines {
-		user := strings.Split(l, " ")
-		if len(user) != 2 {
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+
+		// each line is a username, password, and optional account
+		user := strings.Fields(l)
+		if len(user) != 2 && len(user) != 3 {
+			skipped++
 			continue
 		}
-		users[user[0]] = user[1]
+
+		entry := userEntry{password: user[1]}
+		if len(user) == 3 {
+			entry.account = user[2]
+		}
+		users[user[0]] = entry
 	}
 
-	// create listener
-	ln, err := net.Listen("tcp", net.JoinHostPort("", port))
-	if err != nil {
-		l.logError(err)
-		return err
+	return users, skipped, nil
+}
+
+// newServer creates a server from a loaded configuration
+func newServer(ctx context.Context, config *config, l *rolledLogger, users map[string]userEntry) *Server {
+	return &Server{
+		ctx:      ctx,
+		config:   config,
+		logger:   l,
+		users:    users,
+		sessions: newSessionSet(),
+		limiter:  newConnLimiter(config.maxConns, config.maxConnsPerIP),
+		done:     make(chan struct{}),
+	}
+}
+
+// Serve accepts connections on ln until the server's context is cancelled, then
+// waits for the active sessions to finish. It returns nil after a shutdown, or
+// the error that made ln unusable. The log is closed when Serve returns, so it
+// may only be called once.
+func (s *Server) Serve(ln net.Listener) error {
+	// stop accepting connections on shutdown
+	stop := context.AfterFunc(s.ctx, func() { ln.Close() })
+	defer stop()
+
+	s.err = s.serve(ln)
+	s.logger.close()
+	close(s.done)
+	return s.err
+}
+
+// Wait blocks until Serve has returned, returning the error that stopped it, or
+// nil if it was shut down by cancelling its context
+func (s *Server) Wait() error {
+	<-s.done
+	return s.err
+}
+
+// ActiveSessions returns a description of each active session
+func (s *Server) ActiveSessions() []SessionInfo {
+	return s.sessions.info()
+}
+
+// Kick forcibly ends the session of the client at addr, as given in the
+// RemoteAddr of its SessionInfo, aborting any transfer in progress
+func (s *Server) Kick(addr string) error {
+	h, ok := s.sessions.get(addr)
+	if !ok {
+		return fmt.Errorf("no active session from %s", addr)
 	}
 
+	s.logger.logWarning(fmt.Sprintf("Kicking session from %s", addr))
+	h.kill()
+	return nil
+}
+
+// serve accepts connections until the listener is closed, then waits for the
+// active sessions to finish
+func (s *Server) serve(ln net.Listener) error {
+	l := s.logger
+
 	//listen loop
+	var retryDelay time.Duration
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			// listener was closed for shutdown
+			if s.ctx.Err() != nil {
+				l.logMessage("Shutting down, waiting for active sessions to close")
+				if !waitTimeout(&s.wg, s.config.shutdownTimeout) {
+					l.logWarning(fmt.Sprintf("Sessions still active after %v, closing them", s.config.shutdownTimeout))
+					s.sessions.killAll()
+					s.wg.Wait()
+				}
+				return nil
+			}
+
+			// temporary errors such as running out of file descriptors are
+			// retried with exponential backoff, anything else means the
+			// listener is unusable
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if retryDelay == 0 {
+					retryDelay = minAcceptRetryDelay
+				} else {
+					retryDelay *= 2
+				}
+				if retryDelay > maxAcceptRetryDelay {
+					retryDelay = maxAcceptRetryDelay
+				}
+
+				l.logError(fmt.Errorf("accept: %v; retrying in %v", err, retryDelay))
+				time.Sleep(retryDelay)
+				continue
+			}
+
 			l.logError(err)
 			return err
 		}
+		retryDelay = 0
+
+		if err := setKeepAlive(conn, s.config.keepAlive); err != nil {
+			l.logWarning(fmt.Sprintf("Failed to enable keepalive for %v: %v", conn.RemoteAddr(), err))
+		}
+
+		ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil {
+			l.logError(err)
+			conn.Close()
+			continue
+		}
+
+		if err := s.limiter.acquire(ip); err != nil {
+			l.logWarning(fmt.Sprintf("Rejected connection from %v: %v", conn.RemoteAddr(), err))
+			go rejectConn(conn, err, s.config.connRetryDelay)
+			continue
+		}
 
-		handler, err := newHandler(conn, l, config, users)
+		handler, err := newHandler(s.ctx, conn, l, s.config, s.users)
 		if err != nil {
 			l.logError(err)
 			conn.Close()
+			s.limiter.release(ip)
 			continue
 		}
 
-		go handler.handle()
+		s.wg.Add(1)
+		s.sessions.add(handler)
+		go func() {
+			defer s.wg.Done()
+			defer s.limiter.release(ip)
+			defer s.sessions.remove(handler)
+			handler.handle()
+		}()
 	}
 }
 
+// waitTimeout waits for wg, giving up after timeout. It reports whether wg
+// finished in time.
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// sessionSet is a set of active sessions, keyed by the remote address of their
+// control connections, which can be ended together or individually
+type sessionSet struct {
+	lock     sync.Mutex
+	handlers map[string]*handler
+}
+
+func newSessionSet() *sessionSet {
+	return &sessionSet{handlers: make(map[string]*handler)}
+}
+
+func (s *sessionSet) add(h *handler) {
+	s.lock.Lock()
+	s.handlers[h.conn.RemoteAddr().String()] = h
+	s.lock.Unlock()
+}
+
+func (s *sessionSet) remove(h *handler) {
+	s.lock.Lock()
+	delete(s.handlers, h.conn.RemoteAddr().String())
+	s.lock.Unlock()
+}
+
+func (s *sessionSet) get(addr string) (*handler, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	h, ok := s.handlers[addr]
+	return h, ok
+}
+
+// info describes every session in the set
+func (s *sessionSet) info() []SessionInfo {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sessions := make([]SessionInfo, 0, len(s.handlers))
+	for _, h := range s.handlers {
+		sessions = append(sessions, h.sessionInfo())
+	}
+	return sessions
+}
+
+// killAll forcibly ends every session in the set
+func (s *sessionSet) killAll() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, h := range s.handlers {
+		h.kill()
+	}
+}
+
+// time allowed for sending the rejection reply and for the client to close its end
+const rejectTimeout = 2 * time.Second
+
+// rejectConn tells a client its connection cannot be served, suggesting when to
+// retry, and closes it. The write side is shut down first and anything the client
+// sent is drained so the reply is not lost to a connection reset.
+func rejectConn(conn net.Conn, reason error, retry time.Duration) {
+	defer conn.Close()
+
+	msg := "Too many connections"
+	if reason == errTooManyConnsFromIP {
+		msg = "Too many connections from your address"
+	}
+	msg = fmt.Sprintf("%s, try again in %d seconds.", msg, int(retry/time.Second))
+
+	conn.SetDeadline(time.Now().Add(rejectTimeout))
+	if _, err := conn.Write([]byte(newReply(StatusNotAvailable, msg).String() + "\r\n")); err != nil {
+		return
+	}
+
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.CloseWrite()
+		io.Copy(ioutil.Discard, conn)
+	}
+}
+
+// userEntry holds the credentials of a user from the users file
+type userEntry struct {
+	password string
+	// account required to complete login, empty if none is required
+	account string
+}
+
 // hanldeFunc is a function pointer which handles a specific command
 type handleFunc func(string)
 
 type handler struct {
 	config *config
-	// control connection
-	conn net.Conn
+	// cancelled when the server shuts down
+	ctx context.Context
+	// cancelled to abort the session's transfers when it is closed forcibly
+	abortCtx context.Context
+	abort    context.CancelFunc
+	// control connection, and the reader buffering commands from it. The reader
+	// is kept between commands so pipelined commands are not lost.
+	conn   net.Conn
+	reader *bufio.Reader
 	// log file
 	logger logger
 	// username of currently loged in user, current directory
 	username, dir string
+	// directory sessions start in
+	startDir string
 	// data connection
 	dataConn serverDataConn
 	// map of available users
-	users map[string]string
+	users map[string]userEntry
 	// logged in flag
 	isLoggedIn bool
+	// transfer type and line ending used for ascii transfers
+	transferType, eol string
+	// transfer mode and file structure
+	transferMode, structure string
+	// set when the password was accepted but an account is still required
+	needAccount bool
+	// set by EPSV ALL, after which only EPSV may set up data connections
+	epsvAll bool
+	// client software identified with CLNT
+	clientName string
+	// facts reported by MLST and MLSD, selected with OPTS MLST
+	mlstFacts []string
+	// algorithm used by HASH, selected with OPTS HASH
+	hashAlgorithm string
+	// offset the next RETR starts at, set by REST for the command following it
+	restOffset int64
 	// map of command codes to handleFunc functions
 	commands map[CommandCode]handleFunc
+	// totals for the session summary logged when the connection closes
+	stats sessionStats
+	// copy of the session's state for other goroutines, updated after each
+	// command
+	info     SessionInfo
+	infoLock sync.Mutex
+}
+
+// sessionStats counts the activity of a connection
+type sessionStats struct {
+	start                 time.Time
+	commands              int
+	bytesSent, bytesRecvd int64
 }
 
 // newHandler creates a new handler for a client
-func newHandler(conn net.Conn, l logger, c *config, users map[string]string) (*handler, error) {
-	// get current directory
-	dir, err := os.Getwd()
-	if err != nil {
-		return nil, err
+func newHandler(ctx context.Context, conn net.Conn, l logger, c *config, users map[string]userEntry) (*handler, error) {
+	// start in the configured root, or the current directory
+	dir := c.rootDir
+	if dir == "" {
+		var err error
+		if dir, err = os.Getwd(); err != nil {
+			return nil, err
+		}
 	}
 
 	// create a new handler object
+	abortCtx, abort := context.WithCancel(context.Background())
 	h := &handler{
-		config:     c,
-		conn:       conn,
-		logger:     l,
-		dir:        dir,
-		users:      users,
-		isLoggedIn: false,
-		commands:   make(map[CommandCode]handleFunc),
+		config:   c,
+		ctx:      ctx,
+		abortCtx: abortCtx,
+		abort:    abort,
+		conn:     conn,
+		reader:   bufio.NewReader(conn),
+		logger:   l.forConn(conn.RemoteAddr().String()),
+		startDir: dir,
+		users:    users,
+		commands: make(map[CommandCode]handleFunc),
+		stats:    sessionStats{start: time.Now()},
 	}
 
 	h.logMessage(fmt.Sprintf("Accepted connection from %v", h.conn.RemoteAddr()))
 
-	// initialize commands for not logged in state
-	h.initCommandTable()
-
-	//initialize default data connection
-	if h.config.pasv {
-		h.initPassiveDataConn()
-	} else {
-		// calculate default data port
-		host, port, err := net.SplitHostPort(conn.RemoteAddr().String())
-		if err != nil {
-			return nil, err
-		}
-
-		var portNum int
-		_, err = fmt.Sscanf(port, "%d", &portNum)
-		if err != nil {
-			return nil, err
-		}
-
-		portNum++
-		port = fmt.Sprintf("%d", portNum)
-		h.initActiveDataConn(net.JoinHostPort(host, port))
-	}
+	// start in the not logged in state
+	h.resetSession()
+	h.updateInfo()
 
+	// there is no default data connection, transfers need a PORT, EPRT, PASV or
+	// EPSV first
 	return h, nil
 }
 
@@ -153,6 +496,11 @@ func (h *handler) logMessage(msg string) {
 	h.logger.logMessage(msg)
 }
 
+// logWarning appends a timestamp and logs a warning
+func (h *handler) logWarning(msg string) {
+	h.logger.logWarning(msg)
+}
+
 // logSend appends a timestamp and logs a sent message
 func (h *handler) logSend(msg string) {
 	h.logger.logSend(msg)
@@ -169,14 +517,20 @@ func (h *handler) logError(err error) {
 }
 
 // readCommand reads from the control connection and translates into a Command. If no commands are
-// received in 2 minutes, the connection times out.
+// received within the idle timeout, the connection times out. If the server shuts down while waiting,
+// errShutdown is returned.
 func (h *handler) readCommand() (*Command, error) {
-	// spin off goroutine for listener on connection
-	msgChan := make(chan string)
-	errChan := make(chan error)
+	// commands buffered before the session was killed are dropped
+	if h.abortCtx.Err() != nil {
+		return nil, net.ErrClosed
+	}
+
+	// spin off goroutine for listener on connection, buffered so it can exit
+	// after a timeout or shutdown
+	msgChan := make(chan string, 1)
+	errChan := make(chan error, 1)
 	go func() {
-		reader := bufio.NewReader(h.conn)
-		msg, err := reader.ReadString('\n')
+		msg, err := h.reader.ReadString('\n')
 		if err != nil {
 			errChan <- err
 			return
@@ -186,7 +540,7 @@ func (h *handler) readCommand() (*Command, error) {
 	}()
 
 	// wait for command or timeout
-	timer := time.After(2 * time.Minute)
+	timer := time.After(h.config.idleTimeout)
 	var msg string
 	select {
 	case msg = <-msgChan:
@@ -195,10 +549,17 @@ func (h *handler) readCommand() (*Command, error) {
 		return nil, err
 	case <-timer:
 		return nil, errTimeout
+	case <-h.ctx.Done():
+		return nil, errShutdown
 	}
 
 	h.logReceive(msg)
 
+	// once draining, commands sent during the last transfer are refused
+	if h.ctx.Err() != nil {
+		return nil, errShutdown
+	}
+
 	// make sure command syntax is valid
 	commandRegex, err := regexp.Compile("^[a-zA-Z]{3,4} *.*")
 	if err != nil {
@@ -220,44 +581,97 @@ func (h *handler) readCommand() (*Command, error) {
 		arg = strings.Trim(msg[ind+1:], "\r\n")
 	}
 
+	// line endings can only end a command, embedded ones are an injection attempt
+	if strings.ContainsAny(arg, "\r\n") {
+		return nil, errInvalidArgument
+	}
+
 	return &Command{
 		Code:     CommandCode(code),
 		Arugment: arg,
 	}, nil
 }
 
-// need to handle multi line replies?
+// logDataConnError logs an error that occurred while writing to the data connection.
+// A client disconnecting mid-transfer is expected, so it is logged as a message
+// rather than an error.
+func (h *handler) logDataConnError(err error) {
+	if isBrokenPipe(err) {
+		h.logWarning(fmt.Sprintf("Data connection closed by %v during transfer", h.conn.RemoteAddr()))
+		return
+	}
+
+	h.logError(err)
+}
+
+// writeTransferError logs an error that occurred during a transfer and writes the
+// reply matching the point at which the transfer failed
+func (h *handler) writeTransferError(err error) {
+	h.logDataConnError(err)
+
+	switch {
+	case errors.Is(err, errDataConnNotSetUp):
+		h.writeReply(newReply(StatusCanNotOpenDataConnection, "Use PORT or PASV first."))
+	case errors.Is(err, errDataConnOpen):
+		h.writeError425DataConn()
+	case errors.Is(err, errDataConnStalled):
+		h.writeReply(newReply(StatusTransferAborted, "Connection closed; transfer aborted."))
+	default:
+		h.writeReply(newReply(StatusActionAborted, "Error occurred in transfer."))
+	}
+}
+
+// writeReply sends r to the client. If the client doesn't accept the reply within
+// the control write timeout, the session is torn down rather than left blocked.
 func (h *handler) writeReply(r *Reply) error {
-	msg := r.String()
+	return h.writeRawReply(r.format(h.config.replySuffix))
+}
+
+// writeRawReply writes a reply that has already been formatted, for replies such
+// as MLST's whose lines must be laid out exactly
+func (h *handler) writeRawReply(msg string) error {
 	h.logSend(msg)
+	h.conn.SetWriteDeadline(time.Now().Add(h.config.controlWriteTimeout))
 	_, err := h.conn.Write([]byte(msg + "\r\n"))
+	if err != nil {
+		h.logError(fmt.Errorf("writing reply: %v", err))
+		h.kill()
+	}
 	return err
 }
 
 // general use error replies
 
 func (h *handler) writeError501Args() {
-	h.writeReply(newReply("501", "Error in arguments."))
+	h.writeReply(newReply(StatusBadArguments, "Error in arguments."))
+}
+
+func (h *handler) writeError501EPSVAll() {
+	h.writeReply(newReply(StatusBadArguments, "Not allowed after EPSV ALL, use EPSV."))
 }
 
 func (h *handler) writeError500Syntax(cmd string) {
-	h.writeReply(newReply("500", fmt.Sprintf("%s: command not understood.", cmd)))
+	h.writeReply(newReply(StatusBadCommand, fmt.Sprintf("%s: command not understood.", cmd)))
 }
 
 func (h *handler) writeError550FileAction() {
-	h.writeReply(newReply("550", "File action failed."))
+	h.writeReply(newReply(StatusFileUnavailable, "File action failed."))
 }
 
 func (h *handler) writeError425DataConn() {
-	h.writeReply(newReply("425", "Failed to open data connection."))
+	h.writeReply(newReply(StatusCanNotOpenDataConnection, "Failed to open data connection."))
 }
 
 func (h *handler) writeError530NotLoggedIn(arg string) {
-	h.writeReply(newReply("530", "Log in with USER and PASS first."))
+	h.writeReply(newReply(StatusNotLoggedIn, "Log in with USER and PASS first."))
+}
+
+func (h *handler) writeError553FileName() {
+	h.writeReply(newReply(StatusBadFileName, "Requested action not taken; file name not allowed."))
 }
 
 func (h *handler) writeError421Server() {
-	h.writeReply(newReply("421", "An internal error occurred."))
+	h.writeReply(newReply(StatusNotAvailable, "An internal error occurred."))
 }
 
 // handle handles a connection to a specific client. It interprets and executes commands in a loop
@@ -266,7 +680,7 @@ func (h *handler) handle() {
 	defer h.Close()
 
 	// send welcome message
-	h.writeReply(newReply("220", "Welcome to Erik's FTP Server"))
+	h.writeReply(newReply(StatusReady, h.config.welcome))
 
 	for {
 		// get a command from client
@@ -280,18 +694,45 @@ func (h *handler) handle() {
 
 			// timeout occurred
 			if err == errTimeout {
-				h.writeReply(newReply("421", "Timeout."))
+				h.logMessage(fmt.Sprintf("Idle timeout for %v", h.conn.RemoteAddr()))
+				h.writeReply(newReply(StatusNotAvailable, fmt.Sprintf("Idle timeout (%d seconds); closing control connection.",
+					int(h.config.idleTimeout/time.Second))))
+				return
+			}
+
+			// server is shutting down
+			if err == errShutdown {
+				h.writeReply(newReply(StatusNotAvailable, "Service shutting down, closing control connection."))
+				return
+			}
+
+			// argument can't be used
+			if err == errInvalidArgument {
+				h.logError(fmt.Errorf("reading command: %v", err))
+				h.writeError501Args()
+				continue
+			}
+
+			// connection was reset, or closed after a failed write
+			var ne net.Error
+			if errors.Is(err, net.ErrClosed) || errors.As(err, &ne) {
+				h.logError(fmt.Errorf("reading command: %v", err))
 				return
 			}
 
 			h.logError(fmt.Errorf("reading command: %v", err))
-			h.writeReply(newReply("500", "Unrecognized command."))
+			h.writeReply(newReply(StatusBadCommand, "Unrecognized command."))
 			continue
 		}
 
+		h.stats.commands++
+
 		// check for quit command
 		cmd.Code = CommandCode(strings.ToUpper(string(cmd.Code)))
-		if cmd.Code == "QUIT" {
+		if target, ok := h.config.aliases[cmd.Code]; ok {
+			cmd.Code = target
+		}
+		if cmd.Code == CommandQUIT {
 			h.HandleQUIT(cmd.Arugment)
 			return
 		}
@@ -299,52 +740,90 @@ func (h *handler) handle() {
 		// see if command is in command table, execute it
 		command, exists := h.commands[cmd.Code]
 		if !exists {
-			h.writeReply(newReply("500", fmt.Sprintf("%s: command not recognized.", cmd.Code)))
+			h.writeReply(newReply(StatusBadCommand, fmt.Sprintf("%s: command not recognized.", cmd.Code)))
 			continue
 		}
 
 		command(cmd.Arugment)
+		// a restart offset only applies to the command right after REST
+		if cmd.Code != CommandREST {
+			h.restOffset = 0
+		}
+		h.updateInfo()
+	}
+}
+
+// updateInfo refreshes the copy of the session's state returned by sessionInfo
+func (h *handler) updateInfo() {
+	h.infoLock.Lock()
+	h.info = SessionInfo{
+		RemoteAddr: h.conn.RemoteAddr().String(),
+		Dir:        h.dir,
+		Connected:  h.stats.start,
+	}
+	if h.isLoggedIn {
+		h.info.Username = h.username
+	}
+	h.infoLock.Unlock()
+}
+
+// sessionInfo describes the session as of its last command. It is safe to call
+// from other goroutines.
+func (h *handler) sessionInfo() SessionInfo {
+	h.infoLock.Lock()
+	defer h.infoLock.Unlock()
+	return h.info
+}
+
+// resetSession returns the session to its just-connected state: no user is logged
+// in, the directory and transfer settings are restored to their defaults, and any
+// data connection set up by the previous session is torn down so it cannot be
+// used by the next one.
+func (h *handler) resetSession() {
+	h.closeDataConn()
+	h.username = ""
+	h.isLoggedIn = false
+	h.needAccount = false
+	h.epsvAll = false
+	h.dir = h.startDir
+	h.transferType = h.config.transferType
+	h.eol = eolCRLF
+	h.transferMode = modeStream
+	h.structure = struFile
+	h.mlstFacts = defaultMLSTFacts
+	h.hashAlgorithm = defaultHashAlgorithm
+	h.restOffset = 0
+
+	// initialize commands for not logged in state
+	h.initCommandTable()
+}
+
+// kill forcibly ends the session, aborting any transfer in progress and
+// closing the control connection so the handler returns
+func (h *handler) kill() {
+	h.abort()
+	h.conn.Close()
+}
+
+// closeDataConn releases the current data connection, if any
+func (h *handler) closeDataConn() {
+	if h.dataConn == nil {
+		return
+	}
+
+	if err := h.dataConn.close(); err != nil {
+		h.logError(fmt.Errorf("closing data connection: %v", err))
 	}
+	h.dataConn = nil
 }
 
-// initCommandTable initializes the command table to the not logged in state allowing only login and
-// help commands. All other commands result in an error reply
-func (h *handler) initCommandTable() {
-	h.commands[CommandUSER] = h.HandleUSER
-	h.commands[CommandPASS] = h.HandlePASS
-	h.commands[CommandHELP] = h.HandleHELP
-	h.commands[CommandPWD] = h.writeError530NotLoggedIn
-	h.commands[CommandCWD] = h.writeError530NotLoggedIn
-	h.commands[CommandCDUP] = h.writeError530NotLoggedIn
-	h.commands[CommandPORT] = h.writeError530NotLoggedIn
-	h.commands[CommandEPRT] = h.writeError530NotLoggedIn
-	h.commands[CommandPASV] = h.writeError530NotLoggedIn
-	h.commands[CommandEPSV] = h.writeError530NotLoggedIn
-	h.commands[CommandLIST] = h.writeError530NotLoggedIn
-	h.commands[CommandRETR] = h.writeError530NotLoggedIn
-	h.commands[CommandQUIT] = h.HandleQUIT
-}
-
-// initCommandTableLoggedIn initializes the command table to the logged in state giving the
-// user full functionality.
-func (h *handler) initCommandTableLoggedIn() {
-	h.commands[CommandUSER] = h.HandleUSER
-	h.commands[CommandPASS] = h.HandlePASS
-	h.commands[CommandHELP] = h.HandleHELP
-	h.commands[CommandPWD] = h.HandlePWD
-	h.commands[CommandCWD] = h.HandleCWD
-	h.commands[CommandCDUP] = h.HandleCDUP
-	h.commands[CommandPORT] = h.HandlePORT
-	h.commands[CommandEPRT] = h.HandleEPRT
-	h.commands[CommandPASV] = h.HandlePASV
-	h.commands[CommandEPSV] = h.HandleEPSV
-	h.commands[CommandLIST] = h.HandleLIST
-	h.commands[CommandRETR] = h.HandleRETR
-	h.commands[CommandQUIT] = h.HandleQUIT
-}
-
-// Close closes the logfile and connection.
+// Close closes the data connection and control connection.
 func (h *handler) Close() error {
+	h.abort()
+	h.closeDataConn()
+	h.logMessage(fmt.Sprintf("Session summary for %v: %d commands, %d bytes sent, %d bytes received, duration %v",
+		h.conn.RemoteAddr(), h.stats.commands, h.stats.bytesSent, h.stats.bytesRecvd,
+		time.Since(h.stats.start).Round(time.Millisecond)))
 	h.logMessage(fmt.Sprintf("Closing connection to %v", h.conn.RemoteAddr()))
 	return h.conn.Close()
 }
@@ -1,84 +1,341 @@
 package ftp
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand"
 	"net"
+	"syscall"
+	"time"
 )
 
-// serverDataConn is an interface for writing to a data connection
+// serverDataConn is an interface for writing to and reading from a data connection
 type serverDataConn interface {
 	write([]byte) error
+	read(w io.Writer) (int64, error)
+	close() error
+}
+
+// size of the chunks written to a data connection. The idle deadline is refreshed
+// before each chunk.
+const dataChunkSize = 32 * 1024
+
+// data connection errors
+var errDataConnOpen = errors.New("data connection could not be established")
+var errDataConnStalled = errors.New("data connection stalled")
+var errNoPasvPort = errors.New("no free port in passive port range")
+
+// countingDataConn adds the bytes transferred over a data connection to the
+// session's statistics
+type countingDataConn struct {
+	serverDataConn
+	stats *sessionStats
+}
+
+func (c countingDataConn) write(data []byte) error {
+	err := c.serverDataConn.write(data)
+	if err == nil {
+		c.stats.bytesSent += int64(len(data))
+	}
+	return err
+}
+
+func (c countingDataConn) read(w io.Writer) (int64, error) {
+	n, err := c.serverDataConn.read(w)
+	c.stats.bytesRecvd += n
+	return n, err
 }
 
 // serverActiveDataConn is an active data connection which connects to the client.
 type serverActiveDataConn struct {
+	// cancelled to abort the transfer
+	ctx     context.Context
 	address string
+	// time allowed to connect, and to make progress once connected
+	connectTimeout, idleTimeout time.Duration
+	// maximum transfer rate in bytes per second, 0 for unlimited
+	rate int64
 }
 
 // initActiveDataConn sets up an active connection
 func (h *handler) initActiveDataConn(addr string) {
+	h.closeDataConn()
 	h.logMessage(fmt.Sprintf("Active data connection ready for %s", addr))
-	h.dataConn = &serverActiveDataConn{address: addr}
+	h.dataConn = &serverActiveDataConn{
+		ctx:            h.abortCtx,
+		address:        addr,
+		connectTimeout: h.config.dataConnectTimeout,
+		idleTimeout:    h.config.dataIdleTimeout,
+		rate:           h.config.maxTransferRate,
+	}
+}
+
+// connect opens a connection to the client
+func (s *serverActiveDataConn) connect() (net.Conn, error) {
+	d := net.Dialer{Timeout: s.connectTimeout}
+	conn, err := d.DialContext(s.ctx, "tcp", s.address)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errDataConnOpen, err)
+	}
+
+	return conn, nil
 }
 
 // write connects to the client and writes data, closing the connection when finished.
 func (s *serverActiveDataConn) write(msg []byte) error {
-	conn, err := net.DialTimeout("tcp", s.address, connTimeout)
+	conn, err := s.connect()
 	if err != nil {
 		return err
 	}
+	defer context.AfterFunc(s.ctx, func() { conn.Close() })()
 
-	_, err = conn.Write(msg)
+	return writeAndClose(conn, msg, s.idleTimeout, s.rate)
+}
+
+// read connects to the client and copies the data it sends to w until the client
+// closes the connection.
+func (s *serverActiveDataConn) read(w io.Writer) (int64, error) {
+	conn, err := s.connect()
 	if err != nil {
-		return err
+		return 0, err
 	}
+	defer conn.Close()
+	defer context.AfterFunc(s.ctx, func() { conn.Close() })()
 
-	return conn.Close()
+	return readWithIdleTimeout(w, conn, s.idleTimeout, s.rate)
+}
+
+// close releases the active data connection. Connections are closed after each
+// write, so there is nothing to release.
+func (s *serverActiveDataConn) close() error {
+	return nil
 }
 
 // serverPassiveDataConn is a passive data connection which listens for connections
 type serverPassiveDataConn struct {
+	// cancelled to abort the transfer
+	ctx context.Context
 	ln net.Listener
 	localAddr string
+	// time allowed for the client to connect, and to make progress once connected
+	connectTimeout, idleTimeout time.Duration
+	// maximum transfer rate in bytes per second, 0 for unlimited
+	rate int64
 }
 
 // initPassiveDataConn sets up a passive data connection
 func (h *handler) initPassiveDataConn() (string, error) {
-	ln, err := net.Listen("tcp", ":0")
+	h.closeDataConn()
+	ln, err := listenPassive(h.config.pasvMinPort, h.config.pasvMaxPort)
 	if err != nil {
 		return "", err
 	}
 
-	h.logMessage(fmt.Sprintf("Passive data connection listening on %s", ln.Addr()))
 	addr, _, err := net.SplitHostPort(h.conn.RemoteAddr().String())
+	if err != nil {
+		ln.Close()
+		return "", err
+	}
+
+	h.logMessage(fmt.Sprintf("Passive data connection listening on %s", ln.Addr()))
 	h.dataConn = &serverPassiveDataConn{
+		ctx: h.abortCtx,
 		ln: ln,
 		localAddr: addr,
+		connectTimeout: h.config.dataConnectTimeout,
+		idleTimeout:    h.config.dataIdleTimeout,
+		rate:           h.config.maxTransferRate,
 	}
 	return ln.Addr().String(), nil
 }
 
-// write accepts a connection from a client and writes data over the connection
-func (s *serverPassiveDataConn) write(msg []byte) error {
+// listenPassive opens a listener for a passive data connection on a free port
+// between min and max inclusive, or on any port if no range is set. The ports are
+// tried from a random starting point so concurrent sessions don't all contend
+// for the first ones.
+func listenPassive(min, max int) (net.Listener, error) {
+	if min == 0 || max == 0 {
+		return net.Listen("tcp", ":0")
+	}
+
+	n := max - min + 1
+	start := rand.Intn(n)
+	for i := 0; i < n; i++ {
+		port := min + (start+i)%n
+		ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err == nil {
+			return ln, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %d-%d", errNoPasvPort, min, max)
+}
+
+// accept waits for the client to connect, making sure the connection comes from
+// the same host as the control connection. If the client doesn't connect within
+// the connect timeout the listener is closed, releasing its port.
+func (s *serverPassiveDataConn) accept() (net.Conn, error) {
+	// stop waiting for the client after the connect timeout
+	if tl, ok := s.ln.(*net.TCPListener); ok {
+		tl.SetDeadline(time.Now().Add(s.connectTimeout))
+	}
+
+	stop := context.AfterFunc(s.ctx, func() { s.ln.Close() })
 	conn, err := s.ln.Accept()
+	stop()
 	if err != nil {
-		return err
+		s.ln.Close()
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			return nil, fmt.Errorf("%w: client did not connect within %v", errDataConnOpen, s.connectTimeout)
+		}
+		return nil, fmt.Errorf("%w: %v", errDataConnOpen, err)
 	}
 
-	// logic for checking host 
+	// logic for checking host
 	dip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
 	if err != nil {
-		return err
+		conn.Close()
+		return nil, err
 	}
 
 	if dip != s.localAddr {
-		return fmt.Errorf("Unexpeted data client: want %s got %s", s.localAddr, dip)
+		conn.Close()
+		return nil, fmt.Errorf("Unexpeted data client: want %s got %s", s.localAddr, dip)
+	}
+
+	return conn, nil
+}
+
+// write accepts a connection from a client and writes data over the connection
+func (s *serverPassiveDataConn) write(msg []byte) error {
+	conn, err := s.accept()
+	if err != nil {
+		return err
 	}
+	defer context.AfterFunc(s.ctx, func() { conn.Close() })()
 
-	_, err = conn.Write(msg)
+	return writeAndClose(conn, msg, s.idleTimeout, s.rate)
+}
+
+// read accepts a connection from a client and copies the data it sends to w until
+// the client closes the connection.
+func (s *serverPassiveDataConn) read(w io.Writer) (int64, error) {
+	conn, err := s.accept()
 	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	defer context.AfterFunc(s.ctx, func() { conn.Close() })()
+
+	return readWithIdleTimeout(w, conn, s.idleTimeout, s.rate)
+}
+
+// close stops listening for data connections. The listener may already have been
+// closed after the client failed to connect.
+func (s *serverPassiveDataConn) close() error {
+	if err := s.ln.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+// writeAndClose writes msg to conn and closes it. An error closing the connection
+// is returned, as it may mean the data never reached the client.
+func writeAndClose(conn net.Conn, msg []byte, idle time.Duration, rate int64) error {
+	if err := writeWithIdleTimeout(conn, msg, idle, rate); err != nil {
+		conn.Close()
 		return err
 	}
 
-	return conn.Close()
+	if err := conn.Close(); err != nil {
+		return fmt.Errorf("closing data connection: %w", err)
+	}
+	return nil
+}
+
+// writeWithIdleTimeout writes msg to conn in chunks, failing with errDataConnStalled
+// if any chunk makes no progress within idle. If rate is non-zero, the transfer is
+// limited to rate bytes per second.
+func writeWithIdleTimeout(conn net.Conn, msg []byte, idle time.Duration, rate int64) error {
+	// the throttle sleeps between chunks, outside the deadline, so a slow rate
+	// isn't mistaken for a stalled client
+	var t *throttle
+	if rate > 0 {
+		t = newThrottle(rate)
+	}
+
+	for len(msg) > 0 {
+		n := len(msg)
+		if n > dataChunkSize {
+			n = dataChunkSize
+		}
+		if t != nil {
+			n = t.maxChunk(n)
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(idle))
+		written, err := conn.Write(msg[:n])
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				return fmt.Errorf("%w: %v", errDataConnStalled, err)
+			}
+			return err
+		}
+		// a writer must report why it stopped short, don't spin if one doesn't
+		if written < n {
+			return io.ErrShortWrite
+		}
+
+		msg = msg[written:]
+		if t != nil {
+			t.wait(written)
+		}
+	}
+
+	return nil
+}
+
+// readWithIdleTimeout copies from conn to w until EOF, failing with
+// errDataConnStalled if no data arrives within idle. If rate is non-zero, the
+// transfer is limited to rate bytes per second.
+func readWithIdleTimeout(w io.Writer, conn net.Conn, idle time.Duration, rate int64) (int64, error) {
+	var r io.Reader = conn
+	if rate > 0 {
+		r = newThrottledReader(conn, rate)
+	}
+
+	var total int64
+	buf := make([]byte, dataChunkSize)
+	for {
+		conn.SetReadDeadline(time.Now().Add(idle))
+		n, err := r.Read(buf)
+		if n > 0 {
+			written, werr := w.Write(buf[:n])
+			total += int64(written)
+			if werr != nil {
+				return total, werr
+			}
+		}
+
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				return total, fmt.Errorf("%w: %v", errDataConnStalled, err)
+			}
+			return total, err
+		}
+	}
+}
+
+// isBrokenPipe reports whether err was caused by the client closing the data
+// connection before the write completed
+func isBrokenPipe(err error) bool {
+	return errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET)
 }
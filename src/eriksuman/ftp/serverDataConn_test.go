@@ -0,0 +1,106 @@
+package ftp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	client, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = ln.Accept()
+	if err != nil {
+		client.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	return client, server
+}
+
+func TestWriteAndCloseBrokenPipe(t *testing.T) {
+	client, server := tcpPair(t)
+
+	// the client resets the connection rather than reading the data
+	client.(*net.TCPConn).SetLinger(0)
+	client.Close()
+
+	err := writeAndClose(server, make([]byte, 8<<20), 5*time.Second, 0)
+	if err == nil {
+		t.Fatal("writing to a closed connection succeeded")
+	}
+	if !isBrokenPipe(err) {
+		t.Errorf("got error %v, want a broken pipe or connection reset", err)
+	}
+
+	// the connection is closed whatever the error
+	if _, err := server.Write([]byte("x")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("got %v writing after the failed transfer, want the connection closed", err)
+	}
+}
+
+func TestWriteThrottledWithinIdleTimeout(t *testing.T) {
+	client, server := tcpPair(t)
+
+	// at 40KB/s the transfer takes half a second, far longer than the idle
+	// timeout, but no single write waits on the client for that long
+	msg := bytes.Repeat([]byte("0123456789"), 2000)
+	received := make(chan []byte)
+	go func() {
+		data, _ := ioutil.ReadAll(client)
+		received <- data
+	}()
+
+	start := time.Now()
+	if err := writeWithIdleTimeout(server, msg, 100*time.Millisecond, 40000); err != nil {
+		t.Fatalf("throttled write failed: %v", err)
+	}
+	elapsed := time.Since(start)
+	server.Close()
+
+	if elapsed < 400*time.Millisecond {
+		t.Errorf("wrote %d bytes in %v, faster than the rate limit allows", len(msg), elapsed)
+	}
+	if data := <-received; !bytes.Equal(data, msg) {
+		t.Errorf("received %d bytes, want the %d written", len(data), len(msg))
+	}
+}
+
+// shortConn is a connection whose writes stop short without reporting why
+type shortConn struct {
+	net.Conn
+}
+
+func (c shortConn) Write(p []byte) (int, error) {
+	return c.Conn.Write(p[:len(p)/2])
+}
+
+func TestWriteShort(t *testing.T) {
+	_, server := tcpPair(t)
+
+	for _, rate := range []int64{0, 40000} {
+		err := writeWithIdleTimeout(shortConn{server}, []byte("some data"), time.Second, rate)
+		if err != io.ErrShortWrite {
+			t.Errorf("write at rate %d returned %v, want %v", rate, err, io.ErrShortWrite)
+		}
+	}
+}
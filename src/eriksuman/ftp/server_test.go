@@ -0,0 +1,1365 @@
+package ftp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testServer is a server started for a single test, serving a temporary
+// directory
+type testServer struct {
+	*Server
+	addr, dir string
+	// shuts the server down, as cancelling the context given to StartServer does
+	shutdown context.CancelFunc
+}
+
+// startTestServer starts a server for the test, changing its default
+// configuration with configure if it is not nil. The server is shut down when
+// the test ends.
+func startTestServer(t *testing.T, configure func(*config)) *testServer {
+	t.Helper()
+
+	dir, logDir := t.TempDir(), t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	s, addr, err := newTestServer(ctx, dir, logDir, configure)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		s.Wait()
+	})
+
+	return &testServer{Server: s, addr: addr, dir: dir, shutdown: cancel}
+}
+
+// testConn is a raw control connection to a test server, sending commands
+// exactly as they are written so the server's handling of the protocol itself
+// can be tested
+type testConn struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// dialTestServer connects to the server at addr and reads its greeting
+func dialTestServer(t *testing.T, addr string) *testConn {
+	t.Helper()
+
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	c := &testConn{t: t, conn: conn, reader: bufio.NewReader(conn)}
+	c.expect(StatusReady)
+	return c
+}
+
+// send writes raw to the connection followed by CRLF
+func (c *testConn) send(raw string) {
+	c.t.Helper()
+
+	c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.conn.Write([]byte(raw + "\r\n")); err != nil {
+		c.t.Fatalf("sending %q: %v", raw, err)
+	}
+}
+
+// reply reads a single or multi-line reply, returning its status code and text
+// with the lines joined by LF
+func (c *testConn) reply() (StatusCode, string) {
+	c.t.Helper()
+
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("reading reply: %v", err)
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if len(line) < 4 {
+		c.t.Fatalf("malformed reply %q", line)
+	}
+
+	code, text := StatusCode(line[:3]), line[4:]
+	if line[3] != '-' {
+		return code, text
+	}
+
+	for {
+		next, err := c.reader.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("reading reply: %v", err)
+		}
+		next = strings.TrimRight(next, "\r\n")
+		if strings.HasPrefix(next, string(code)+" ") {
+			return code, text + "\n" + next[4:]
+		}
+		text += "\n" + next
+	}
+}
+
+// expect reads a reply and fails the test unless it has the given status code,
+// returning its text
+func (c *testConn) expect(code StatusCode) string {
+	c.t.Helper()
+
+	got, text := c.reply()
+	if got != code {
+		c.t.Fatalf("got reply %s %s, want %s", got, text, code)
+	}
+	return text
+}
+
+// cmd sends a command and expects a reply with the given status code
+func (c *testConn) cmd(raw string, code StatusCode) string {
+	c.t.Helper()
+
+	c.send(raw)
+	return c.expect(code)
+}
+
+// login logs in with the test server's credentials
+func (c *testConn) login() {
+	c.t.Helper()
+
+	c.cmd("USER "+TestUsername, StatusUserOK)
+	c.cmd("PASS "+TestPassword, StatusLoggedIn)
+}
+
+// pasv enters passive mode and returns the address of the data connection
+func (c *testConn) pasv() string {
+	c.t.Helper()
+
+	addr, err := parsePASVString(c.cmd("PASV", StatusPasvMode))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return addr
+}
+
+// dialData connects to a passive data connection at addr
+func (c *testConn) dialData(addr string) net.Conn {
+	c.t.Helper()
+
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return conn
+}
+
+// retrieve runs a data transfer command over a passive data connection and
+// returns what the server sent, expecting the transfer to succeed
+func (c *testConn) retrieve(raw string) string {
+	c.t.Helper()
+
+	data := c.dialData(c.pasv())
+	c.send(raw)
+	if code, text := c.reply(); code != StatusAboutToSend && code != StatusAlreadyOpen {
+		c.t.Fatalf("%s: got reply %s %s", raw, code, text)
+	}
+
+	got, err := ioutil.ReadAll(data)
+	if err != nil {
+		c.t.Fatalf("%s: reading data: %v", raw, err)
+	}
+	c.expect(StatusClosingDataConnection)
+	return string(got)
+}
+
+// store runs a data transfer command over a passive data connection, sending
+// content and expecting the transfer to succeed
+func (c *testConn) store(raw, content string) {
+	c.t.Helper()
+
+	data := c.dialData(c.pasv())
+	c.send(raw)
+	if code, text := c.reply(); code != StatusAboutToSend && code != StatusAlreadyOpen {
+		c.t.Fatalf("%s: got reply %s %s", raw, code, text)
+	}
+
+	if _, err := data.Write([]byte(content)); err != nil {
+		c.t.Fatalf("%s: writing data: %v", raw, err)
+	}
+	data.Close()
+	c.expect(StatusClosingDataConnection)
+}
+
+func TestServerRetrieveAndStore(t *testing.T) {
+	s := startTestServer(t, nil)
+	writeTestFile(t, s.dir, "hello.txt", "hello, world\n")
+
+	c := dialTestServer(t, s.addr)
+	c.login()
+
+	if got := c.retrieve("RETR hello.txt"); got != "hello, world\n" {
+		t.Errorf("RETR sent %q, want %q", got, "hello, world\n")
+	}
+
+	c.store("STOR upload.bin", "\x00\x01binary\r\n")
+	if got := readTestFile(t, s.dir, "upload.bin"); got != "\x00\x01binary\r\n" {
+		t.Errorf("STOR stored %q, want %q", got, "\x00\x01binary\r\n")
+	}
+
+	list := c.retrieve("LIST")
+	for _, name := range []string{"hello.txt", "upload.bin"} {
+		if !strings.Contains(list, name) {
+			t.Errorf("LIST output %q doesn't include %s", list, name)
+		}
+	}
+
+	c.cmd("QUIT", StatusClosing)
+}
+
+func TestServerRequiresLogin(t *testing.T) {
+	s := startTestServer(t, nil)
+
+	c := dialTestServer(t, s.addr)
+	c.cmd("PWD", StatusNotLoggedIn)
+	c.cmd("USER "+TestUsername, StatusUserOK)
+	c.cmd("PASS wrong", StatusNotLoggedIn)
+	c.cmd("RETR anything", StatusNotLoggedIn)
+	c.login()
+	c.cmd("PWD", StatusPathCreated)
+}
+
+func TestSupportedCommands(t *testing.T) {
+	s := startTestServer(t, nil)
+
+	c := dialTestServer(t, s.addr)
+	help := c.cmd("HELP", StatusHelp)
+	for _, code := range SupportedCommands() {
+		if !strings.Contains(help, string(code)) {
+			t.Errorf("HELP doesn't list %s", code)
+		}
+		c.cmd("HELP "+string(code), StatusHelp)
+	}
+	c.cmd("HELP NOPE", StatusNotImplemented)
+}
+
+func TestServerPipelinedCommands(t *testing.T) {
+	addr, cleanup, err := NewTestServer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	// several commands arriving in one write are all handled, in order
+	c := dialTestServer(t, addr)
+	c.send("USER " + TestUsername + "\r\nPASS " + TestPassword + "\r\nPWD")
+	c.expect(StatusUserOK)
+	c.expect(StatusLoggedIn)
+	c.expect(StatusPathCreated)
+
+	c.send("TYPE A\r\nTYPE I\r\nQUIT")
+	if text := c.expect(StatusCommandOK); !strings.Contains(text, "ASCII") {
+		t.Errorf("got %q for TYPE A", text)
+	}
+	if text := c.expect(StatusCommandOK); !strings.Contains(text, "Binary") {
+		t.Errorf("got %q for TYPE I", text)
+	}
+	c.expect(StatusClosing)
+}
+
+func TestServerClientClosesDataConnection(t *testing.T) {
+	s := startTestServer(t, nil)
+	writeTestFile(t, s.dir, "big.bin", strings.Repeat("x", 16<<20))
+
+	c := dialTestServer(t, s.addr)
+	c.login()
+
+	data := c.dialData(c.pasv())
+	c.cmd("RETR big.bin", StatusAboutToSend)
+	if _, err := data.Read(make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	data.(*net.TCPConn).SetLinger(0)
+	data.Close()
+
+	if code, text := c.reply(); code != StatusTransferAborted && code != StatusActionAborted {
+		t.Fatalf("got reply %s %s, want the transfer aborted", code, text)
+	}
+	// a client going away is expected, and logged as a warning rather than an error
+	if log := readTestFile(t, s.config.logDir, currentFileName); !strings.Contains(log, "Data connection closed by") {
+		t.Errorf("log %q doesn't record the client closing the data connection", log)
+	}
+
+	// the session carries on, and the server released the data connection
+	c.cmd("PWD", StatusPathCreated)
+	if status := c.cmd("STAT", StatusSystem); !strings.Contains(status, "No data connection") {
+		t.Errorf("STAT reported %q after the transfer, want no data connection", status)
+	}
+}
+
+func TestServerDataConnectTimeout(t *testing.T) {
+	s := startTestServer(t, func(c *config) { c.dataConnectTimeout = 100 * time.Millisecond })
+	writeTestFile(t, s.dir, "file.txt", "data")
+
+	c := dialTestServer(t, s.addr)
+	c.login()
+
+	// the client never connects to the passive data connection
+	c.pasv()
+	c.send("RETR file.txt")
+	code, _ := c.reply()
+	if code == StatusAboutToSend {
+		code, _ = c.reply()
+	}
+	if code != StatusCanNotOpenDataConnection {
+		t.Errorf("got reply %s, want %s", code, StatusCanNotOpenDataConnection)
+	}
+}
+
+func TestServerDataIdleTimeout(t *testing.T) {
+	s := startTestServer(t, func(c *config) { c.dataIdleTimeout = 100 * time.Millisecond })
+
+	c := dialTestServer(t, s.addr)
+	c.login()
+
+	// the client connects and sends part of the file, then stalls
+	data := c.dialData(c.pasv())
+	c.cmd("STOR stalled.txt", StatusAboutToSend)
+	if _, err := data.Write([]byte("partial")); err != nil {
+		t.Fatal(err)
+	}
+	c.expect(StatusTransferAborted)
+}
+
+func TestServerQuitAfterRetrieve(t *testing.T) {
+	s := startTestServer(t, nil)
+	content := strings.Repeat("0123456789", 100000)
+	writeTestFile(t, s.dir, "big.bin", content)
+
+	c := dialTestServer(t, s.addr)
+	c.login()
+
+	// QUIT sent straight after RETR waits for the transfer to finish
+	data := c.dialData(c.pasv())
+	c.send("RETR big.bin\r\nQUIT")
+	got, err := ioutil.ReadAll(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(content) {
+		t.Errorf("received %d bytes, want %d", len(got), len(content))
+	}
+	c.expect(StatusAboutToSend)
+	c.expect(StatusClosingDataConnection)
+	c.expect(StatusClosing)
+
+	// and then the server closes the control connection
+	if _, err := c.reader.ReadByte(); err != io.EOF {
+		t.Errorf("got %v reading after QUIT, want EOF", err)
+	}
+}
+
+func TestServerQuitReleasesDataConnection(t *testing.T) {
+	s := startTestServer(t, nil)
+
+	c := dialTestServer(t, s.addr)
+	c.login()
+	addr := c.pasv()
+	c.cmd("QUIT", StatusClosing)
+
+	if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		conn.Close()
+		t.Errorf("passive data connection at %s still accepts connections after QUIT", addr)
+	}
+}
+
+func TestServerAVBL(t *testing.T) {
+	var asked string
+	real := availableSpace
+	t.Cleanup(func() { availableSpace = real })
+	availableSpace = func(p string) (uint64, error) {
+		asked = p
+		return 123456789, nil
+	}
+
+	s := startTestServer(t, nil)
+	writeTestFile(t, s.dir, "sub/file.txt", "data")
+
+	c := dialTestServer(t, s.addr)
+	c.login()
+	if feat := c.cmd("FEAT", StatusSystem); !strings.Contains(feat, "AVBL") {
+		t.Errorf("FEAT %q doesn't advertise AVBL", feat)
+	}
+
+	if got := c.cmd("AVBL", StatusFile); got != "123456789" {
+		t.Errorf("AVBL replied %q, want the stubbed 123456789", got)
+	}
+	c.cmd("AVBL sub", StatusFile)
+	if want := filepath.Join(s.dir, "sub"); asked != want {
+		t.Errorf("AVBL sub asked for the space in %s, want %s", asked, want)
+	}
+
+	c.cmd("AVBL sub/file.txt", StatusFileUnavailable)
+	c.cmd("AVBL missing", StatusFileUnavailable)
+}
+
+// temporaryError is an accept error the server should retry
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// acceptResult is what a call to scriptedListener.Accept returns
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// scriptedListener is a listener whose Accept returns the results sent on
+// results, recording when it was called
+type scriptedListener struct {
+	results chan acceptResult
+	closed  chan struct{}
+	once    sync.Once
+
+	lock    sync.Mutex
+	accepts []time.Time
+}
+
+func newScriptedListener() *scriptedListener {
+	return &scriptedListener{results: make(chan acceptResult), closed: make(chan struct{})}
+}
+
+func (ln *scriptedListener) Accept() (net.Conn, error) {
+	ln.lock.Lock()
+	ln.accepts = append(ln.accepts, time.Now())
+	ln.lock.Unlock()
+
+	select {
+	case r := <-ln.results:
+		return r.conn, r.err
+	case <-ln.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (ln *scriptedListener) Close() error {
+	ln.once.Do(func() { close(ln.closed) })
+	return nil
+}
+
+func (ln *scriptedListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+// gaps returns the time between each call to Accept and the next
+func (ln *scriptedListener) gaps() []time.Duration {
+	ln.lock.Lock()
+	defer ln.lock.Unlock()
+
+	var gaps []time.Duration
+	for i := 1; i < len(ln.accepts); i++ {
+		gaps = append(gaps, ln.accepts[i].Sub(ln.accepts[i-1]))
+	}
+	return gaps
+}
+
+// serveScripted runs a server with the default configuration on ln, returning
+// the directory it logs to and a channel receiving the error Serve returns
+func serveScripted(t *testing.T, ln *scriptedListener) (logDir string, served <-chan error) {
+	t.Helper()
+
+	config := defaultConfig()
+	config.rootDir = t.TempDir()
+	config.logDir = t.TempDir()
+	config.setNameDefaults()
+	l, err := newRolledLogger(config.logDir, config.nLogFiles, config.maxLogSize, config.logLevel, config.logFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := newServer(ctx, config, l, map[string]userEntry{TestUsername: {password: TestPassword}})
+	errc := make(chan error, 1)
+	go func() { errc <- s.Serve(ln) }()
+	t.Cleanup(func() {
+		cancel()
+		s.Wait()
+	})
+
+	return config.logDir, errc
+}
+
+// serveOne hands the server one end of a loopback connection through ln and
+// runs a session on it, checking the connection is served
+func serveOne(t *testing.T, ln *scriptedListener) {
+	t.Helper()
+
+	client, server := tcpPair(t)
+	ln.results <- acceptResult{conn: server}
+
+	c := &testConn{t: t, conn: client, reader: bufio.NewReader(client)}
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	c.expect(StatusReady)
+	c.cmd("QUIT", StatusClosing)
+	if _, err := c.reader.ReadByte(); err != io.EOF {
+		t.Errorf("got %v after QUIT, want EOF", err)
+	}
+}
+
+func TestServerRetriesTemporaryAcceptErrors(t *testing.T) {
+	ln := newScriptedListener()
+	logDir, served := serveScripted(t, ln)
+
+	ln.results <- acceptResult{err: temporaryError{}}
+	ln.results <- acceptResult{err: temporaryError{}}
+	serveOne(t, ln)
+
+	broken := errors.New("listener broken")
+	ln.results <- acceptResult{err: broken}
+	select {
+	case err := <-served:
+		if err != broken {
+			t.Errorf("Serve returned %v, want the permanent error %v", err, broken)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve still running after a permanent accept error")
+	}
+
+	if n := len(ln.gaps()) + 1; n != 4 {
+		t.Errorf("Accept called %d times, want 4", n)
+	}
+	log := readTestFile(t, logDir, currentFileName)
+	if n := strings.Count(log, "accept: too many open files; retrying"); n != 2 {
+		t.Errorf("logged %d retries, want 2:\n%s", n, log)
+	}
+	if !strings.Contains(log, "listener broken") {
+		t.Errorf("permanent error not logged:\n%s", log)
+	}
+}
+
+func TestServerAcceptBackoff(t *testing.T) {
+	ln := newScriptedListener()
+	logDir, _ := serveScripted(t, ln)
+
+	// the delay doubles with each temporary error in a row
+	const failures = 5
+	for i := 0; i < failures; i++ {
+		ln.results <- acceptResult{err: temporaryError{}}
+	}
+	serveOne(t, ln)
+
+	// and starts again from the minimum after a connection is accepted
+	ln.results <- acceptResult{err: temporaryError{}}
+	serveOne(t, ln)
+
+	gaps := ln.gaps()
+	for i := 0; i < failures; i++ {
+		if want := minAcceptRetryDelay << i; gaps[i] < want {
+			t.Errorf("retry %d after %v, want at least %v", i+1, gaps[i], want)
+		}
+	}
+	before, after := gaps[failures-1], gaps[failures+1]
+	if after >= before {
+		t.Errorf("retry after a successful accept took %v, no shorter than the %v before it", after, before)
+	}
+
+	var delays []string
+	for _, line := range strings.Split(readTestFile(t, logDir, currentFileName), "\n") {
+		if i := strings.Index(line, "retrying in "); i >= 0 {
+			delays = append(delays, line[i+len("retrying in "):])
+		}
+	}
+	want := []string{"5ms", "10ms", "20ms", "40ms", "80ms", "5ms"}
+	if strings.Join(delays, " ") != strings.Join(want, " ") {
+		t.Errorf("logged delays %v, want %v", delays, want)
+	}
+}
+
+func TestServerASCIILineEndings(t *testing.T) {
+	s := startTestServer(t, nil)
+	writeTestFile(t, s.dir, "lines.txt", "one\ntwo\n")
+
+	c := dialTestServer(t, s.addr)
+	c.login()
+	c.cmd("TYPE A", StatusCommandOK)
+
+	for _, tt := range []struct {
+		name, eol string
+	}{
+		{"CRLF", "\r\n"},
+		{"LF", "\n"},
+		{"CR", "\r"},
+	} {
+		c.cmd("SITE EOL "+tt.name, StatusCommandOK)
+
+		want := "one" + tt.eol + "two" + tt.eol
+		if got := c.retrieve("RETR lines.txt"); got != want {
+			t.Errorf("RETR with %s line endings sent %q, want %q", tt.name, got, want)
+		}
+
+		c.store("STOR up.txt", "three"+tt.eol+"four"+tt.eol)
+		if got := readTestFile(t, s.dir, "up.txt"); got != "three\nfour\n" {
+			t.Errorf("STOR with %s line endings stored %q, want %q", tt.name, got, "three\nfour\n")
+		}
+	}
+
+	// a lone CR ends a line as well as CRLF
+	c.cmd("SITE EOL CRLF", StatusCommandOK)
+	c.store("STOR up.txt", "five\rsix\r\n")
+	if got := readTestFile(t, s.dir, "up.txt"); got != "five\nsix\n" {
+		t.Errorf("STOR with a lone CR stored %q, want %q", got, "five\nsix\n")
+	}
+}
+
+func TestServerConnectionLimits(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		configure func(*config)
+		want      string
+	}{
+		{"total", func(c *config) { c.maxConns = 1 }, "Too many connections, try again in 30 seconds."},
+		{"per address", func(c *config) { c.maxConnsPerIP = 1 }, "Too many connections from your address, try again in 30 seconds."},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startTestServer(t, tt.configure)
+			first := dialTestServer(t, s.addr)
+
+			conn, err := net.DialTimeout("tcp", s.addr, 5*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			rejected := &testConn{t: t, conn: conn, reader: bufio.NewReader(conn)}
+			if got := rejected.expect(StatusNotAvailable); got != tt.want {
+				t.Errorf("rejected with %q, want %q", got, tt.want)
+			}
+			if _, err := rejected.reader.ReadByte(); err != io.EOF {
+				t.Errorf("got %v after the rejection, want EOF", err)
+			}
+
+			// the first session still works, and its slot is freed when it ends
+			first.login()
+			first.cmd("QUIT", StatusClosing)
+			for deadline := time.Now().Add(5 * time.Second); ; {
+				conn, err := net.DialTimeout("tcp", s.addr, 5*time.Second)
+				if err != nil {
+					t.Fatal(err)
+				}
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				c := &testConn{t: t, conn: conn, reader: bufio.NewReader(conn)}
+				code, _ := c.reply()
+				conn.Close()
+				if code == StatusReady {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("still rejected with %s after the first session ended", code)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestServerReinitialize(t *testing.T) {
+	s := startTestServer(t, nil)
+	writeTestFile(t, s.dir, "file.txt", "data")
+
+	c := dialTestServer(t, s.addr)
+	c.login()
+	c.cmd("TYPE A", StatusCommandOK)
+	addr := c.pasv()
+
+	c.cmd("REIN", StatusReady)
+	c.cmd("RETR file.txt", StatusNotLoggedIn)
+
+	// the passive listener from before REIN is closed, and a transfer in the
+	// new session needs a data connection of its own
+	if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		conn.Close()
+		t.Errorf("passive listener at %s still accepting after REIN", addr)
+	}
+	c.login()
+	c.cmd("RETR file.txt", StatusCanNotOpenDataConnection)
+	if status := c.cmd("STAT", StatusSystem); !strings.Contains(status, "Type: BINARY") {
+		t.Errorf("STAT after REIN replied %q, want the default binary type", status)
+	}
+
+	if got := c.retrieve("RETR file.txt"); got != "data" {
+		t.Errorf("RETR after REIN sent %q, want %q", got, "data")
+	}
+}
+
+func TestServerStatusReportsType(t *testing.T) {
+	s := startTestServer(t, nil)
+	c := dialTestServer(t, s.addr)
+
+	if status := c.cmd("STAT", StatusSystem); !strings.Contains(status, "Not logged in") {
+		t.Errorf("STAT before logging in replied %q", status)
+	}
+	c.login()
+
+	for _, tt := range []struct{ typ, want string }{
+		{"A", "Type: ASCII"},
+		{"I", "Type: BINARY"},
+	} {
+		c.cmd("TYPE "+tt.typ, StatusCommandOK)
+		status := c.cmd("STAT", StatusSystem)
+		if !strings.Contains(status, tt.want) || !strings.Contains(status, "Logged in as "+TestUsername) {
+			t.Errorf("STAT after TYPE %s replied %q, want %q", tt.typ, status, tt.want)
+		}
+	}
+
+	_, port, err := net.SplitHostPort(c.pasv())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := c.cmd("STAT", StatusSystem); !strings.Contains(status, "Passive data connection listening on") || !strings.Contains(status, ":"+port+"\n") {
+		t.Errorf("STAT after PASV replied %q, want the listener on port %s", status, port)
+	}
+}
+
+// addrConn is a connection reporting the given addresses, so a handler can be
+// tested as if its client were elsewhere on the network
+type addrConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c addrConn) LocalAddr() net.Addr  { return c.local }
+func (c addrConn) RemoteAddr() net.Addr { return c.remote }
+
+// newAddrHandler returns a handler for a connection from remote to local, and
+// the client's end of the connection
+func newAddrHandler(t *testing.T, local, remote string, configure func(*config)) (*handler, *testConn) {
+	t.Helper()
+
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	conn := addrConn{
+		Conn:   server,
+		local:  &net.TCPAddr{IP: net.ParseIP(local), Port: 21},
+		remote: &net.TCPAddr{IP: net.ParseIP(remote), Port: 50000},
+	}
+
+	c := defaultConfig()
+	c.rootDir = t.TempDir()
+	c.logDir = t.TempDir()
+	if configure != nil {
+		configure(c)
+	}
+	l, err := newRolledLogger(c.logDir, c.nLogFiles, c.maxLogSize, c.logLevel, c.logFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.close() })
+
+	h, err := newHandler(context.Background(), conn, l, c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	return h, &testConn{t: t, conn: client, reader: bufio.NewReader(client)}
+}
+
+func TestPasvHost(t *testing.T) {
+	for _, tt := range []struct {
+		name, local, remote, public string
+		want                        string
+		unreachable                 bool
+	}{
+		{"both private", "10.0.0.5", "10.0.0.7", "", "10.0.0.5", false},
+		{"both loopback", "127.0.0.1", "127.0.0.1", "", "127.0.0.1", false},
+		{"public server", "192.0.2.10", "203.0.113.9", "", "192.0.2.10", false},
+		{"behind NAT", "10.0.0.5", "203.0.113.9", "", "", true},
+		{"unspecified", "0.0.0.0", "203.0.113.9", "", "", true},
+		{"configured public address", "10.0.0.5", "203.0.113.9", "198.51.100.1", "198.51.100.1", false},
+	} {
+		h, _ := newAddrHandler(t, tt.local, tt.remote, func(c *config) { c.pasvPublicIP = tt.public })
+		got, err := h.pasvHost()
+		if tt.unreachable {
+			if !errors.Is(err, errPasvUnreachable) {
+				t.Errorf("%s: pasvHost() = %q, %v, want errPasvUnreachable", tt.name, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: pasvHost() = %q, %v, want %s", tt.name, got, err, tt.want)
+		}
+	}
+
+	// PASV can't carry an IPv6 address, which is a different failure
+	h, _ := newAddrHandler(t, "2001:db8::1", "2001:db8::2", nil)
+	if _, err := h.pasvHost(); err == nil || errors.Is(err, errPasvUnreachable) {
+		t.Errorf("pasvHost() on IPv6 returned %v, want an error other than errPasvUnreachable", err)
+	}
+}
+
+func TestServerEPSVProtocol(t *testing.T) {
+	for _, tt := range []struct {
+		local, arg string
+		want       StatusCode
+	}{
+		{"127.0.0.1", "", StatusExtendedPasvMode},
+		{"127.0.0.1", "1", StatusExtendedPasvMode},
+		{"127.0.0.1", "2", StatusBadNetworkProtocol},
+		{"::1", "2", StatusExtendedPasvMode},
+		{"::1", "1", StatusBadNetworkProtocol},
+		{"127.0.0.1", "3", StatusBadArguments},
+		{"127.0.0.1", "x", StatusBadArguments},
+	} {
+		h, c := newAddrHandler(t, tt.local, tt.local, nil)
+
+		done := make(chan struct{})
+		go func() {
+			h.HandleEPSV(tt.arg)
+			close(done)
+		}()
+		msg := c.expect(tt.want)
+		<-done
+		h.closeDataConn()
+
+		// the reply suggests the supported protocol, not the one asked for
+		if tt.want == StatusBadNetworkProtocol && strings.Contains(msg, "("+tt.arg+")") {
+			t.Errorf("EPSV %s on %s replied %q, want the supported protocol", tt.arg, tt.local, msg)
+		}
+	}
+}
+
+func TestServerPasvBehindNAT(t *testing.T) {
+	h, c := newAddrHandler(t, "10.0.0.5", "203.0.113.9", nil)
+
+	done := make(chan struct{})
+	go func() {
+		h.HandlePASV("")
+		close(done)
+	}()
+	if msg := c.expect(StatusCanNotOpenDataConnection); !strings.Contains(msg, "pasv_public_ip") || !strings.Contains(msg, "EPSV") {
+		t.Errorf("PASV replied %q, want a hint to set pasv_public_ip or use EPSV", msg)
+	}
+	<-done
+	if h.dataConn != nil {
+		t.Error("PASV left a data connection listening after refusing")
+	}
+}
+
+func TestServerCommandAliases(t *testing.T) {
+	aliases, err := parseAliases("dir:LIST, GET:retr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := startTestServer(t, func(c *config) { c.aliases = aliases })
+	writeTestFile(t, s.dir, "file.txt", "aliased")
+
+	c := dialTestServer(t, s.addr)
+	c.login()
+	if got := c.retrieve("DIR"); !strings.Contains(got, "file.txt") {
+		t.Errorf("DIR listed %q, want a listing including file.txt", got)
+	}
+	if got := c.retrieve("get file.txt"); got != "aliased" {
+		t.Errorf("GET sent %q, want %q", got, "aliased")
+	}
+	if got := c.cmd("HELP DIR", StatusHelp); !strings.Contains(got, "LIST [<path>]") {
+		t.Errorf("HELP DIR replied %q, want the syntax of LIST", got)
+	}
+
+	for _, bad := range []string{"DIR", "DIR:NOPE", "LIST:RETR", ":LIST"} {
+		if _, err := parseAliases(bad); err == nil {
+			t.Errorf("parseAliases(%q) succeeded, want an error", bad)
+		}
+	}
+}
+
+func TestServerNameList(t *testing.T) {
+	s := startTestServer(t, nil)
+	writeTestFile(t, s.dir, "top.txt", "")
+	writeTestFile(t, s.dir, "sub/a.txt", "")
+	writeTestFile(t, s.dir, "sub/b.txt", "")
+	writeTestFile(t, s.dir, "sub/.hidden", "")
+
+	c := dialTestServer(t, s.addr)
+	c.login()
+
+	for _, tt := range []struct {
+		cmd  string
+		want []string
+	}{
+		{"NLST", []string{"sub", "top.txt"}},
+		// names in another directory are qualified with the path given, so they
+		// can be passed straight back to RETR
+		{"NLST sub", []string{"sub/a.txt", "sub/b.txt"}},
+		{"NLST -a sub", []string{"sub/.hidden", "sub/a.txt", "sub/b.txt"}},
+		{"NLST sub/a.txt", []string{"sub/a.txt"}},
+	} {
+		got := strings.Fields(c.retrieve(tt.cmd))
+		sort.Strings(got)
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%s listed %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+
+	c.pasv()
+	c.cmd("NLST missing", StatusFileUnavailable)
+}
+
+func TestServerShutdownDrainsTransfers(t *testing.T) {
+	// the transfer takes about a second at the limited rate
+	s := startTestServer(t, func(c *config) {
+		c.maxTransferRate = 20000
+		c.shutdownTimeout = 10 * time.Second
+	})
+	content := strings.Repeat("0123456789", 2000)
+	writeTestFile(t, s.dir, "slow.txt", content)
+
+	c := dialTestServer(t, s.addr)
+	c.login()
+	data := c.dialData(c.pasv())
+	c.cmd("RETR slow.txt", StatusAboutToSend)
+
+	time.Sleep(200 * time.Millisecond)
+	s.shutdown()
+
+	// the transfer in progress completes, then the session is closed
+	got, err := ioutil.ReadAll(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != content {
+		t.Errorf("received %d bytes during shutdown, want all %d", len(got), len(content))
+	}
+	c.expect(StatusClosingDataConnection)
+	if msg := c.expect(StatusNotAvailable); !strings.Contains(msg, "shutting down") {
+		t.Errorf("got %q after the transfer, want the shutdown notice", msg)
+	}
+
+	done := make(chan error)
+	go func() { done <- s.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Wait returned %v after a shutdown, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server still running after its only session ended")
+	}
+	if conn, err := net.DialTimeout("tcp", s.addr, time.Second); err == nil {
+		conn.Close()
+		t.Error("server accepting connections after shutdown")
+	}
+}
+
+func TestServerControlWriteTimeout(t *testing.T) {
+	s := startTestServer(t, func(c *config) { c.controlWriteTimeout = 200 * time.Millisecond })
+	c := dialTestServer(t, s.addr)
+
+	// send commands without ever reading the replies, until the server's writes
+	// block and it gives up on the client
+	go func() {
+		cmds := []byte(strings.Repeat("HELP\r\n", 1000))
+		for {
+			if _, err := c.conn.Write(cmds); err != nil {
+				return
+			}
+		}
+	}()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for len(s.ActiveSessions()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("session still active with its replies unread")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if log := readTestFile(t, s.config.logDir, currentFileName); !strings.Contains(log, "writing reply") {
+		t.Errorf("log doesn't record the failed write:\n%s", log)
+	}
+}
+
+func TestServerIdleTimeout(t *testing.T) {
+	s := startTestServer(t, func(c *config) { c.idleTimeout = time.Second })
+	c := dialTestServer(t, s.addr)
+	c.login()
+
+	start := time.Now()
+	if msg := c.expect(StatusNotAvailable); !strings.Contains(msg, "Idle timeout (1 seconds)") {
+		t.Errorf("got %q, want the idle timeout notice", msg)
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf("timed out after %v, before the 1s idle timeout", elapsed)
+	}
+	if _, err := c.reader.ReadByte(); err != io.EOF {
+		t.Errorf("got %v after the idle timeout, want EOF", err)
+	}
+}
+
+func TestServerRejectsBadCredentials(t *testing.T) {
+	s := startTestServer(t, nil)
+	c := dialTestServer(t, s.addr)
+
+	long := strings.Repeat("x", maxCredentialLength+1)
+	for _, user := range []string{"te\rst", "te\x00st", "te\x1b[2Jst", "te\tst", long} {
+		c.cmd("USER "+user, StatusBadArguments)
+	}
+
+	c.cmd("USER "+TestUsername, StatusUserOK)
+	for _, password := range []string{"te\rst", "te\x00st", "te\x7fst", long} {
+		c.cmd("PASS "+password, StatusBadArguments)
+	}
+
+	// none of the rejected arguments disturbed the session
+	c.cmd("PASS "+TestPassword, StatusLoggedIn)
+	c.cmd("USER "+strings.Repeat("x", maxCredentialLength), StatusUserOK)
+}
+
+func TestServerConfinedToRoot(t *testing.T) {
+	s := startTestServer(t, nil)
+	outside := t.TempDir()
+	writeTestFile(t, outside, "secret.txt", "secret")
+	writeTestFile(t, s.dir, "sub/file.txt", "inside")
+	for link, target := range map[string]string{
+		"escape":     outside,
+		"secret.txt": filepath.Join(outside, "secret.txt"),
+		"inside":     filepath.Join(s.dir, "sub"),
+		"dangling":   filepath.Join(outside, "missing"),
+	} {
+		if err := os.Symlink(target, filepath.Join(s.dir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := dialTestServer(t, s.addr)
+	c.login()
+
+	for _, dir := range []string{"..", "sub/../..", outside, "/", "escape"} {
+		c.cmd("CWD "+dir, StatusFileUnavailable)
+	}
+	c.cmd("SIZE "+filepath.Join(outside, "secret.txt"), StatusFileUnavailable)
+	c.cmd("SIZE ../"+filepath.Base(outside), StatusFileUnavailable)
+
+	// links out of the root can't be followed, to read or to write
+	for _, file := range []string{"secret.txt", "escape/secret.txt"} {
+		c.pasv()
+		c.cmd("RETR "+file, StatusFileUnavailable)
+	}
+	c.pasv()
+	c.send("STOR escape/new.txt")
+	if code, _ := c.reply(); code == StatusAboutToSend || code == StatusAlreadyOpen {
+		t.Fatal("STOR through a link out of the root started a transfer")
+	}
+	c.cmd("MKD escape/newdir", StatusFileUnavailable)
+	c.cmd("SIZE dangling", StatusFileUnavailable)
+	if _, err := os.Stat(filepath.Join(outside, "newdir")); err == nil {
+		t.Error("MKD created a directory outside the root")
+	}
+	if got := c.retrieve("LIST *"); strings.Contains(got, "escape") || strings.Contains(got, "secret.txt") {
+		t.Errorf("LIST * listed links out of the root:\n%s", got)
+	}
+
+	// links within the root work as usual
+	c.cmd("CWD inside", StatusRequestedFileActionOK)
+	if got := c.retrieve("RETR file.txt"); got != "inside" {
+		t.Errorf("RETR through a link within the root sent %q, want %q", got, "inside")
+	}
+	c.cmd("CWD ..", StatusRequestedFileActionOK)
+	c.store("STOR inside/new.txt", "new")
+	if got := readTestFile(t, s.dir, "sub/new.txt"); got != "new" {
+		t.Errorf("stored %q through a link within the root, want %q", got, "new")
+	}
+}
+
+func TestServerStoreFailsBeforeTransfer(t *testing.T) {
+	s := startTestServer(t, nil)
+	writeTestFile(t, s.dir, "file.txt", "")
+
+	c := dialTestServer(t, s.addr)
+	c.login()
+
+	// each refusal comes instead of the 150 that starts the transfer
+	for _, tt := range []struct{ file, want string }{
+		{"missing/new.txt", "Directory does not exist."},
+		{"file.txt/new.txt", "Directory does not exist."},
+	} {
+		c.pasv()
+		if got := c.cmd("STOR "+tt.file, StatusFileUnavailable); got != tt.want {
+			t.Errorf("STOR %s replied %q, want %q", tt.file, got, tt.want)
+		}
+	}
+
+	if os.Geteuid() == 0 {
+		t.Skip("root can write to read-only directories")
+	}
+	if err := os.Mkdir(filepath.Join(s.dir, "readonly"), 0555); err != nil {
+		t.Fatal(err)
+	}
+	c.pasv()
+	if got := c.cmd("STOR readonly/new.txt", StatusFileUnavailable); got != "Permission denied." {
+		t.Errorf("STOR in a read-only directory replied %q, want %q", got, "Permission denied.")
+	}
+}
+
+func TestServerQuotesPaths(t *testing.T) {
+	s := startTestServer(t, nil)
+	c := dialTestServer(t, s.addr)
+	c.login()
+
+	const name = `say "hi"`
+	quoted := `"` + s.dir + `/say ""hi"""`
+	if got := c.cmd("MKD "+name, StatusPathCreated); got != quoted+" created." {
+		t.Errorf("MKD replied %q, want %q", got, quoted+" created.")
+	}
+	c.cmd("CWD "+name, StatusRequestedFileActionOK)
+	if got := c.cmd("PWD", StatusPathCreated); got != quoted+" is the current directory." {
+		t.Errorf("PWD replied %q, want %q", got, quoted+" is the current directory.")
+	}
+}
+
+func TestServerListHiddenFiles(t *testing.T) {
+	s := startTestServer(t, nil)
+	writeTestFile(t, s.dir, "visible.txt", "")
+	writeTestFile(t, s.dir, ".hidden", "")
+	writeTestFile(t, s.dir, "sub/.profile", "")
+	writeTestFile(t, s.dir, "sub/plain.txt", "")
+
+	c := dialTestServer(t, s.addr)
+	c.login()
+
+	for _, tt := range []struct {
+		cmd          string
+		shown, notIn []string
+	}{
+		{"LIST", []string{"visible.txt", "sub"}, []string{".hidden"}},
+		{"LIST -a", []string{"visible.txt", ".hidden"}, nil},
+		{"LIST -la", []string{".hidden"}, nil},
+		{"LIST sub", []string{"plain.txt"}, []string{".profile"}},
+		{"LIST -a sub", []string{"plain.txt", ".profile"}, nil},
+		{"LIST -l -a sub", []string{".profile"}, nil},
+	} {
+		got := c.retrieve(tt.cmd)
+		for _, name := range tt.shown {
+			if !strings.Contains(got, " "+name+"\r\n") {
+				t.Errorf("%s doesn't list %s:\n%s", tt.cmd, name, got)
+			}
+		}
+		for _, name := range tt.notIn {
+			if strings.Contains(got, name) {
+				t.Errorf("%s lists %s:\n%s", tt.cmd, name, got)
+			}
+		}
+	}
+}
+
+func TestServerStoreNameTooLong(t *testing.T) {
+	s := startTestServer(t, nil)
+	c := dialTestServer(t, s.addr)
+	c.login()
+
+	c.pasv()
+	c.cmd("STOR "+strings.Repeat("n", 300), StatusBadFileName)
+
+	// the session carries on, and a file with a usable name can be stored
+	c.store("STOR "+strings.Repeat("n", 200), "data")
+}
+
+func TestServerListPattern(t *testing.T) {
+	s := startTestServer(t, nil)
+	for _, name := range []string{"a.txt", "b.txt", "c.log", "sub/d.txt", ".e.txt"} {
+		writeTestFile(t, s.dir, name, "")
+	}
+
+	c := dialTestServer(t, s.addr)
+	c.login()
+
+	for _, tt := range []struct {
+		cmd          string
+		shown, notIn []string
+	}{
+		{"LIST *.txt", []string{"a.txt", "b.txt"}, []string{"c.log", "d.txt", ".e.txt"}},
+		{"LIST -a *.txt", []string{"a.txt", "b.txt", ".e.txt"}, []string{"c.log"}},
+		{"LIST sub/*.txt", []string{"sub/d.txt"}, []string{"a.txt"}},
+		{"LIST ?.log", []string{"c.log"}, []string{"a.txt"}},
+	} {
+		got := c.retrieve(tt.cmd)
+		for _, name := range tt.shown {
+			if !strings.Contains(got, " "+name+"\r\n") {
+				t.Errorf("%s doesn't list %s:\n%s", tt.cmd, name, got)
+			}
+		}
+		for _, name := range tt.notIn {
+			if strings.Contains(got, " "+name+"\r\n") {
+				t.Errorf("%s lists %s:\n%s", tt.cmd, name, got)
+			}
+		}
+	}
+
+	// a pattern matching nothing is an empty listing rather than an error
+	if got := c.retrieve("LIST *.pdf"); got != "" {
+		t.Errorf("LIST *.pdf listed %q, want nothing", got)
+	}
+}
+
+func TestLoadUsers(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "users", "# users allowed to log in\n"+
+		"\n"+
+		"alice\tsecret\n"+
+		"  bob   hunter2   acct42  \r\n"+
+		"   # an indented comment\n"+
+		"carol pass\t \n"+
+		"malformed\n"+
+		"too many fields here now\n")
+
+	users, skipped, err := loadUsers(filepath.Join(dir, "users"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]userEntry{
+		"alice": {password: "secret"},
+		"bob":   {password: "hunter2", account: "acct42"},
+		"carol": {password: "pass"},
+	}
+	if len(users) != len(want) {
+		t.Errorf("loaded %v, want %v", users, want)
+	}
+	for name, entry := range want {
+		if users[name] != entry {
+			t.Errorf("loaded %+v for %s, want %+v", users[name], name, entry)
+		}
+	}
+	if skipped != 2 {
+		t.Errorf("skipped %d lines, want the 2 malformed ones", skipped)
+	}
+
+	if _, _, err := loadUsers(filepath.Join(dir, "missing")); err == nil {
+		t.Error("loaded a missing users file without an error")
+	}
+}
+
+func TestServerRetrieveWithoutDataConnection(t *testing.T) {
+	s := startTestServer(t, nil)
+	writeTestFile(t, s.dir, "file.txt", "data")
+
+	c := dialTestServer(t, s.addr)
+	c.login()
+
+	// there is no default data connection to fall back on
+	for _, file := range []string{"file.txt", "missing.txt"} {
+		if got := c.cmd("RETR "+file, StatusCanNotOpenDataConnection); got != "Use PORT or PASV first." {
+			t.Errorf("RETR %s replied %q, want %q", file, got, "Use PORT or PASV first.")
+		}
+	}
+
+	if got := c.retrieve("RETR file.txt"); got != "data" {
+		t.Errorf("RETR after PASV sent %q, want %q", got, "data")
+	}
+}
+
+func TestServerDataConnectionNotReused(t *testing.T) {
+	s := startTestServer(t, nil)
+	c := dialTestServer(t, s.addr)
+	c.login()
+
+	for _, cmd := range []string{"LIST", "NLST", "MLSD", "STOR new.txt", "APPE new.txt"} {
+		if got := c.cmd(cmd, StatusCanNotOpenDataConnection); got != "Use PORT or PASV first." {
+			t.Errorf("%s replied %q, want %q", cmd, got, "Use PORT or PASV first.")
+		}
+	}
+
+	// each PASV is good for a single transfer
+	c.retrieve("LIST")
+	c.cmd("LIST", StatusCanNotOpenDataConnection)
+	c.store("STOR new.txt", "data")
+	c.cmd("STOR new.txt", StatusCanNotOpenDataConnection)
+	if got := readTestFile(t, s.dir, "new.txt"); got != "data" {
+		t.Errorf("stored %q, want %q", got, "data")
+	}
+}
+
+func TestServerReleasesUnusedPassiveListener(t *testing.T) {
+	s := startTestServer(t, func(c *config) { c.dataConnectTimeout = 150 * time.Millisecond })
+	writeTestFile(t, s.dir, "file.txt", "data")
+
+	c := dialTestServer(t, s.addr)
+	c.login()
+
+	// the client never connects, so the listener is closed once the transfer
+	// gives up waiting
+	addr := c.pasv()
+	start := time.Now()
+	c.send("RETR file.txt")
+	code, _ := c.reply()
+	if code == StatusAboutToSend {
+		code, _ = c.reply()
+	}
+	if code != StatusCanNotOpenDataConnection {
+		t.Fatalf("got reply %s, want %s", code, StatusCanNotOpenDataConnection)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("gave up waiting after %v, want about 150ms", elapsed)
+	}
+
+	if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		conn.Close()
+		t.Errorf("passive listener at %s still open after the transfer failed", addr)
+	}
+	if status := c.cmd("STAT", StatusSystem); !strings.Contains(status, "No data connection") {
+		t.Errorf("STAT after the failed transfer replied %q, want no data connection", status)
+	}
+
+	if got := c.retrieve("RETR file.txt"); got != "data" {
+		t.Errorf("RETR with a new PASV sent %q, want %q", got, "data")
+	}
+}
+
+func TestServerOptsMLST(t *testing.T) {
+	s := startTestServer(t, nil)
+	writeTestFile(t, s.dir, "a.txt", "12345")
+	c := dialTestServer(t, s.addr)
+	c.login()
+
+	// unknown facts are dropped from the selection
+	if got := c.cmd("OPTS MLST size;bogus;UNIX.mode;", StatusCommandOK); got != "MLST OPTS size;unix.mode;" {
+		t.Errorf("OPTS MLST replied %q, want only the known facts selected", got)
+	}
+	if feat := c.cmd("FEAT", StatusSystem); !strings.Contains(feat, "MLST type;size*;modify;perm;unix.mode*;") {
+		t.Errorf("FEAT replied %q, want size and unix.mode marked selected", feat)
+	}
+
+	lines := strings.Split(c.cmd("MLST a.txt", StatusRequestedFileActionOK), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], " size=5;unix.mode=0") || !strings.HasSuffix(lines[1], "; "+filepath.Join(s.dir, "a.txt")) {
+		t.Errorf("MLST replied %q, want only the size and unix.mode facts", lines)
+	}
+
+	for _, entry := range strings.Split(strings.TrimSuffix(c.retrieve("MLSD"), "\r\n"), "\r\n") {
+		facts := entry[:strings.Index(entry, " ")]
+		if strings.Contains(facts, "type=") || strings.Contains(facts, "modify=") || strings.Contains(facts, "perm=") {
+			t.Errorf("MLSD entry %q has facts that weren't selected", entry)
+		}
+		if strings.HasSuffix(entry, " a.txt") && !strings.HasPrefix(entry, "size=5;unix.mode=0") {
+			t.Errorf("MLSD entry %q, want the size and unix.mode facts", entry)
+		}
+	}
+
+	// selecting nothing turns every fact off
+	c.cmd("OPTS MLST", StatusCommandOK)
+	if lines := strings.Split(c.cmd("MLST a.txt", StatusRequestedFileActionOK), "\n"); len(lines) != 3 || lines[1] != "  "+filepath.Join(s.dir, "a.txt") {
+		t.Errorf("MLST with no facts selected replied %q", lines)
+	}
+}
@@ -0,0 +1,72 @@
+package ftp
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+)
+
+// Credentials accepted by a server started with NewTestServer
+const (
+	TestUsername = "test"
+	TestPassword = "test"
+)
+
+// NewTestServer starts a server on a random local port serving dir, for tests
+// that drive a client against a real server in the same process. It uses the
+// default configuration with no config or users file, and logs to a temporary
+// directory outside of dir. It returns the address to connect to and a function
+// that shuts the server down and removes its logs.
+func NewTestServer(dir string) (addr string, cleanup func(), err error) {
+	logDir, err := ioutil.TempDir("", "goftp-log")
+	if err != nil {
+		return "", nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s, addr, err := newTestServer(ctx, dir, logDir, nil)
+	if err != nil {
+		cancel()
+		os.RemoveAll(logDir)
+		return "", nil, err
+	}
+
+	cleanup = func() {
+		cancel()
+		s.Wait()
+		os.RemoveAll(logDir)
+	}
+	return addr, cleanup, nil
+}
+
+// newTestServer starts a server as NewTestServer does, logging to logDir. If
+// configure is not nil it is called to change the default configuration before
+// the server starts. The server shuts down when ctx is cancelled.
+func newTestServer(ctx context.Context, dir, logDir string, configure func(*config)) (*Server, string, error) {
+	config := defaultConfig()
+	config.rootDir = dir
+	config.logDir = logDir
+	config.shutdownTimeout = 0
+	if configure != nil {
+		configure(config)
+	}
+	config.setNameDefaults()
+
+	l, err := newRolledLogger(config.logDir, config.nLogFiles, config.maxLogSize, config.logLevel, config.logFormat)
+	if err != nil {
+		return nil, "", err
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		l.close()
+		return nil, "", err
+	}
+
+	users := map[string]userEntry{TestUsername: {password: TestPassword}}
+	s := newServer(ctx, config, l, users)
+	go s.Serve(ln)
+
+	return s, ln.Addr().String(), nil
+}
@@ -0,0 +1,57 @@
+package ftp
+
+import (
+	"io"
+	"time"
+)
+
+// throttle tracks the bytes transferred through a connection and delays callers
+// to keep the average rate at or below a limit in bytes per second
+type throttle struct {
+	rate  int64
+	start time.Time
+	total int64
+}
+
+// newThrottle creates a throttle limited to rate bytes per second
+func newThrottle(rate int64) *throttle {
+	return &throttle{rate: rate, start: time.Now()}
+}
+
+// wait records n bytes transferred and sleeps until the average rate falls
+// back under the limit
+func (t *throttle) wait(n int) {
+	t.total += int64(n)
+	expected := time.Duration(t.total * int64(time.Second) / t.rate)
+	if elapsed := time.Since(t.start); elapsed < expected {
+		time.Sleep(expected - elapsed)
+	}
+}
+
+// maxChunk returns the largest amount to transfer at once, so the data is sent
+// in bursts of no more than a tenth of a second
+func (t *throttle) maxChunk(n int) int {
+	if limit := int(t.rate / 10); limit > 0 && n > limit {
+		return limit
+	}
+	return n
+}
+
+// throttledReader is an io.Reader which limits the rate data is read from r
+type throttledReader struct {
+	r io.Reader
+	t *throttle
+}
+
+// newThrottledReader wraps r to read at no more than rate bytes per second
+func newThrottledReader(r io.Reader, rate int64) *throttledReader {
+	return &throttledReader{r: r, t: newThrottle(rate)}
+}
+
+// Read reads from the underlying reader, sleeping as necessary to stay under
+// the rate limit
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	n, err := tr.r.Read(p[:tr.t.maxChunk(len(p))])
+	tr.t.wait(n)
+	return n, err
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package ftp
+
+import "errors"
+
+// setUmask is not supported on this platform
+func setUmask(mask int) error {
+	return errors.New("umask not supported on this platform")
+}
@@ -0,0 +1,11 @@
+//go:build unix
+
+package ftp
+
+import "syscall"
+
+// setUmask sets the file mode creation mask of the process
+func setUmask(mask int) error {
+	syscall.Umask(mask)
+	return nil
+}
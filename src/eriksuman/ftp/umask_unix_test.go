@@ -0,0 +1,42 @@
+//go:build unix
+
+package ftp
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestSetUmask(t *testing.T) {
+	old := syscall.Umask(0)
+	t.Cleanup(func() { syscall.Umask(old) })
+
+	if err := setUmask(0077); err != nil {
+		t.Fatal(err)
+	}
+
+	p := filepath.Join(t.TempDir(), "private")
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// uploads are created the same way, with the configured file mode
+	s := startTestServer(t, nil)
+	c := dialTestServer(t, s.addr)
+	c.login()
+	c.store("STOR upload.txt", "data")
+
+	for _, p := range []string{p, filepath.Join(s.dir, "upload.txt")} {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := info.Mode().Perm(); mode != 0600 {
+			t.Errorf("%s created with mode %o, want 0600 under umask 0077", filepath.Base(p), mode)
+		}
+	}
+}
@@ -1,29 +1,57 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
-	
+	"time"
+
 	"eriksuman/ftp"
 )
 
 func main() {
+	opts := new(ftp.ClientOptions)
+	flag.BoolVar(&opts.Passive, "passive", false, "use passive data connections")
+	flag.BoolVar(&opts.Extended, "extended", false, "prefer EPSV/EPRT over PASV/PORT")
+	flag.StringVar(&opts.User, "user", "", "username to log in with")
+	flag.StringVar(&opts.Password, "pass", "", "password to log in with")
+	flag.DurationVar(&opts.Timeout, "timeout", 5*time.Second, "timeout for establishing connections")
+	flag.BoolVar(&opts.Quiet, "quiet", false, "do not print transfer progress")
+	flag.DurationVar(&opts.DataIdleTimeout, "idle-timeout", 10*time.Second, "timeout for a stalled data transfer")
+	flag.StringVar(&opts.LogFormat, "log-format", "text", "format of the log file, text or json")
+	flag.BoolVar(&opts.Overwrite, "f", false, "overwrite existing local files on download without asking")
+	flag.BoolVar(&opts.PreserveTimes, "p", false, "preserve the modification times of transferred files")
+	flag.BoolVar(&opts.Verify, "verify", false, "verify binary downloads against the server's HASH, XMD5 or XCRC checksum")
+	flag.IntVar(&opts.Retries, "retries", 0, "number of times to retry a failed connection")
+	flag.DurationVar(&opts.RetryBackoff, "retry-backoff", time.Second, "delay before the first retry, doubling after each one")
+	flag.DurationVar(&opts.KeepAlive, "keepalive", 15*time.Second, "interval between TCP keepalive probes on the control connection, negative to disable")
+	flag.BoolVar(&opts.ResumeOnError, "resume", false, "resume binary downloads which fail part way through")
+	flag.IntVar(&opts.ResumeRetries, "resume-retries", 3, "number of times a broken download is resumed")
+	flag.IntVar(&opts.Segments, "segments", 1, "number of connections to split large binary downloads across")
+	flag.StringVar(&opts.Proxy, "proxy", "", "proxy to connect through, as socks5://[user:password@]host[:port] or http://[user:password@]host[:port]")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: ftpclient [options] <host> <logfile> [port]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
 	var host, log string
 	port := "21"
-	if len(os.Args) == 3 {
-		host = os.Args[1]
-		log = os.Args[2]
-	} else if len(os.Args) == 4 {
-		host = os.Args[1]
-		log = os.Args[2]
-		port = os.Args[3]
+	args := flag.Args()
+	if len(args) == 2 {
+		host = args[0]
+		log = args[1]
+	} else if len(args) == 3 {
+		host = args[0]
+		log = args[1]
+		port = args[2]
 	} else {
-		fmt.Println("Usage: ftpclient <host> <logfile> [port]")
+		flag.Usage()
 		return
 	}
-	
-	if err := ftp.StartClient(host, port, log); err != nil {
+
+	if err := ftp.StartClient(host, port, log, opts); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
-}
\ No newline at end of file
+}
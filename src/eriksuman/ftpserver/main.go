@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"eriksuman/ftp"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
@@ -12,8 +15,18 @@ func main() {
 		return
 	}
 
+	// shut down gracefully on interrupt or termination
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	port := os.Args[1]
-	if err := ftp.StartServer(port); err != nil {
+	srv, err := ftp.StartServer(ctx, port)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	if err := srv.Wait(); err != nil {
 		fmt.Printf("Error: %s\n", err)
 		os.Exit(1)
 	}